@@ -0,0 +1,17 @@
+//go:build darwin || freebsd || netbsd
+
+package fio
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func fileAccessTime(fi os.FileInfo) (time.Time, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(st.Atimespec.Sec), int64(st.Atimespec.Nsec)), true
+}
@@ -291,3 +291,158 @@ func envBool(name string, def bool) bool {
 		return def
 	}
 }
+
+func BenchmarkCountLines(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "lines.txt")
+	data := bytes.Repeat([]byte("lorem ipsum dolor sit amet, consectetur adipiscing\n"), 200000)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		b.Fatalf("WriteFile: %v", err)
+	}
+
+	b.Run("CountLines", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		for i := 0; i < b.N; i++ {
+			if _, err := fio.CountLines(path); err != nil {
+				b.Fatalf("CountLines: %v", err)
+			}
+		}
+	})
+	b.Run("ReadFileLines", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(data)))
+		ctx := context.Background()
+		for i := 0; i < b.N; i++ {
+			var n int64
+			err := fio.ReadFileLines(ctx, path, func(string) error {
+				n++
+				return nil
+			})
+			if err != nil {
+				b.Fatalf("ReadFileLines: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkAppendLines(b *testing.B) {
+	lines := make([]string, 1000)
+	for i := range lines {
+		lines[i] = "event " + strconv.Itoa(i)
+	}
+
+	b.Run("AppendLines", func(b *testing.B) {
+		path := filepath.Join(b.TempDir(), "app.log")
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := fio.AppendLines(path, lines, 0o644); err != nil {
+				b.Fatalf("AppendLines: %v", err)
+			}
+		}
+	})
+	b.Run("line-by-line", func(b *testing.B) {
+		path := filepath.Join(b.TempDir(), "app.log")
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, line := range lines {
+				if err := fio.AppendLines(path, []string{line}, 0o644); err != nil {
+					b.Fatalf("AppendLines: %v", err)
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 16<<10)
+
+	for _, bc := range []struct {
+		name string
+		opts []fio.ManagerOption
+	}{
+		{"default", nil},
+		{"pool", []fio.ManagerOption{fio.WithBufferPool(32 << 10)}},
+	} {
+		mgr, err := fio.NewIoManager(b.TempDir(), fio.Memory, bc.opts...)
+		if err != nil {
+			b.Fatalf("NewIoManager: %v", err)
+		}
+		ses, err := mgr.NewSession()
+		if err != nil {
+			b.Fatalf("NewSession: %v", err)
+		}
+		ctx := fio.WithSession(context.Background(), ses)
+		stream := func() fio.Source { return fio.ReaderSource(struct{ io.Reader }{bytes.NewReader(data)}) }
+
+		b.Run("Copy/"+bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := fio.Copy(ctx, stream(), fio.Out(fio.Txt, fio.File)); err != nil {
+					b.Fatalf("Copy: %v", err)
+				}
+			}
+		})
+		b.Run("Read/"+bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				err := fio.Read(ctx, stream(), func(r io.Reader) error {
+					_, err := io.Copy(struct{ io.Writer }{io.Discard}, r)
+					return err
+				})
+				if err != nil {
+					b.Fatalf("Read: %v", err)
+				}
+			}
+		})
+
+		_ = ses.Cleanup()
+		_ = mgr.Cleanup()
+	}
+}
+
+// BenchmarkMmapAdvice reads a 100MB mapped file front to back, so page
+// faults dominate and read-ahead hints show up in ns/op.
+func BenchmarkMmapAdvice(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "big.bin")
+	data := bytes.Repeat([]byte("0123456789abcdef"), (100<<20)/16)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		b.Fatalf("WriteFile: %v", err)
+	}
+
+	for _, bc := range []struct {
+		name   string
+		advice fio.MmapAdvice
+	}{
+		{"none", 0},
+		{"sequential", fio.MmapSequential},
+		{"sequential+willneed", fio.MmapSequential | fio.MmapWillNeed},
+		{"random", fio.MmapRandom},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			mgr, err := fio.NewIoManager(b.TempDir(), fio.Memory, fio.WithMmap(true), fio.WithMmapAdvice(bc.advice))
+			if err != nil {
+				b.Fatalf("NewIoManager: %v", err)
+			}
+			defer func() { _ = mgr.Cleanup() }()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				ses, err := mgr.NewSession()
+				if err != nil {
+					b.Fatalf("NewSession: %v", err)
+				}
+				out, err := fio.Copy(fio.WithSession(context.Background(), ses), fio.PathSource(path), fio.Out(fio.Txt))
+				if err != nil {
+					b.Fatalf("Copy: %v", err)
+				}
+				var sum byte
+				for _, c := range out.Data() {
+					sum += c
+				}
+				_ = sum
+				_ = ses.Cleanup()
+			}
+		})
+	}
+}
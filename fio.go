@@ -3,18 +3,43 @@ package fio
 import (
 	"bufio"
 	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"math"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
+	"os/user"
+	"path"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf16"
 )
 
 /* -------------------------------------------------------------------------- */
@@ -39,6 +64,7 @@ const (
 const (
 	defaultMaxPreallocate = 1 << 20  // 1MB
 	defaultSpillThreshold = 64 << 20 // 64MB
+	defaultMaxLineSize    = 1 << 20  // 1MB
 )
 
 const (
@@ -54,6 +80,7 @@ const DefaultBaseTempDir = "./temp"
 
 func MB(size int64) int64        { return size * 1024 * 1024 }
 func ToExt(format string) string { return "." + format }
+func ptrInt(v int) *int          { return &v }
 func ptrInt64(v int64) *int64    { return &v }
 func ptrBool(v bool) *bool       { return &v }
 
@@ -108,6 +135,15 @@ var (
 	ErrCannotResetInput       = errors.New("fio: cannot reset input")
 	ErrToReaderAtNilReader    = errors.New("fio: ToReaderAt: nil reader")
 	ErrNilInput               = errors.New("fio: nil input")
+	ErrLineTooLong            = errors.New("fio: line too long")
+	ErrNotGzip                = errors.New("fio: not gzip data")
+	ErrUnsupportedCompression = errors.New("fio: unsupported compression")
+	ErrNilHash                = errors.New("fio: nil hash")
+	ErrChecksumMismatch       = errors.New("fio: checksum mismatch")
+	ErrDecrypt                = errors.New("fio: decryption failed")
+	ErrNilReader              = errors.New("fio: nil reader")
+	ErrInvalidSize            = errors.New("fio: invalid size")
+	ErrSumIncomplete          = errors.New("fio: source not read to the end")
 )
 
 /* -------------------------------------------------------------------------- */
@@ -137,13 +173,42 @@ type Source interface {
 	open(ctx context.Context) (rc io.ReadCloser, cleanup func() error, size int64, kind, path string, err error)
 }
 
+// Sizer is an optional interface for a Source that knows its length before
+// it is read. Copy, Process and the other output helpers use it to pre-size
+// memory buffers and pick storage; it takes precedence over the size found
+// when the source is opened, and returning (0, false) disables preallocation
+// for that source. BytesSource and PathSource implement it. URLSource does
+// not, as it cannot know without a request; its Content-Length is used once
+// the response arrives. To add a size to a custom source, embed it:
+//
+//	type sized struct {
+//		fio.Source
+//		n int64
+//	}
+//
+//	func (s sized) Size() (int64, bool) { return s.n, true }
+type Sizer interface {
+	Size() (int64, bool)
+}
+
 // Constructors (type safe)
-func PathSource(p string) Source               { return pathSource(p) }
-func URLSource(u string) Source                { return urlSource(u) }
-func BytesSource(b []byte) Source              { return bytesSource(b) }
-func ReaderSource(r io.Reader) Source          { return readerSource{r: r} }
+func PathSource(p string) Source  { return pathSource(p) }
+func URLSource(u string) Source   { return urlSource(u) }
+func BytesSource(b []byte) Source { return bytesSource(b) }
+
+// ReaderSource adapts any io.Reader (a pipe, a network stream, another
+// library's reader) to a Source; fio never closes r. Unlike PathSource or
+// BytesSource it is single-use: r is consumed by the first read and a second
+// read sees only what is left. The size is known only when r reports one
+// (Len, Size or Seek, see SizeAny); otherwise it is -1 and the preallocation
+// fast paths are skipped. Open it with OpenIn and Reusable to read it twice.
+func ReaderSource(r io.Reader) Source { return readerSource{r: r} }
+
+// ReadCloserSource is ReaderSource that hands ownership of rc to fio: rc is
+// closed when the read scope or Input is done with it.
 func ReadCloserSource(rc io.ReadCloser) Source { return readCloserSource{rc: rc} }
-func FileSource(f *os.File) Source             { return fileSource{f: f} }
+
+func FileSource(f *os.File) Source { return fileSource{f: f} }
 func MultipartSource(fh *multipart.FileHeader) Source {
 	return multipartSource{fh: fh}
 }
@@ -152,6 +217,14 @@ func InputSource(in *Input) Source  { return inputSource{in: in} } // for passin
 
 type pathSource string
 
+func (p pathSource) Size() (int64, bool) {
+	fi, err := os.Stat(strings.TrimSpace(string(p)))
+	if err != nil || !fi.Mode().IsRegular() {
+		return 0, false
+	}
+	return fi.Size(), true
+}
+
 func (p pathSource) open(ctx context.Context) (io.ReadCloser, func() error, int64, string, string, error) {
 	path := strings.TrimSpace(string(p))
 	if path == "" {
@@ -171,7 +244,62 @@ func (u urlSource) open(ctx context.Context) (io.ReadCloser, func() error, int64
 	if urlStr == "" {
 		return nil, nil, -1, "", "", ErrEmptyURL
 	}
-	rc, cleanup, size, err := openURLDirect(ctx, urlStr)
+	rc, cleanup, size, err := openURLDirect(ctx, urlStr, nil)
+	if err != nil {
+		return nil, nil, -1, "", "", err
+	}
+	return rc, cleanup, size, KindURL, urlStr, nil
+}
+
+type URLOption func(*urlConfig)
+type urlConfig struct {
+	method string
+	header http.Header
+	body   []byte
+}
+
+// WithHeader adds a request header, e.g. Authorization. Repeating a key adds
+// another value rather than replacing it.
+func WithHeader(key, value string) URLOption {
+	return func(c *urlConfig) {
+		if c.header == nil {
+			c.header = make(http.Header)
+		}
+		c.header.Add(key, value)
+	}
+}
+
+// WithMethod sets the HTTP method (GET by default).
+func WithMethod(method string) URLOption { return func(c *urlConfig) { c.method = method } }
+
+// WithBody sets the request body. It is kept as bytes so the source can be
+// opened again, and redirects can resend it.
+func WithBody(body []byte) URLOption { return func(c *urlConfig) { c.body = body } }
+
+// URLSourceWith is URLSource with a configured request: headers, method and
+// body are applied to every request the source makes. A non-2xx response
+// fails with ErrDownloadFailed.
+func URLSourceWith(u string, opts ...URLOption) Source {
+	cfg := &urlConfig{}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(cfg)
+		}
+	}
+	return urlSourceWith{url: u, cfg: cfg}
+}
+
+type urlSourceWith struct {
+	url string
+	cfg *urlConfig
+}
+
+func (u urlSourceWith) open(ctx context.Context) (io.ReadCloser, func() error, int64, string, string, error) {
+	urlStr := strings.TrimSpace(u.url)
+	if urlStr == "" {
+		return nil, nil, -1, "", "", ErrEmptyURL
+	}
+	rc, cleanup, size, err := openURLDirect(ctx, urlStr, u.cfg)
 	if err != nil {
 		return nil, nil, -1, "", "", err
 	}
@@ -180,6 +308,8 @@ func (u urlSource) open(ctx context.Context) (io.ReadCloser, func() error, int64
 
 type bytesSource []byte
 
+func (b bytesSource) Size() (int64, bool) { return int64(len(b)), b != nil }
+
 func (b bytesSource) open(ctx context.Context) (io.ReadCloser, func() error, int64, string, string, error) {
 	if b == nil {
 		return nil, nil, -1, "", "", ErrNilSource
@@ -187,6 +317,51 @@ func (b bytesSource) open(ctx context.Context) (io.ReadCloser, func() error, int
 	return io.NopCloser(bytes.NewReader(b)), nil, int64(len(b)), KindMemory, "", nil
 }
 
+// Base64Source streams the bytes encoded in s, decoding lazily as they are
+// read, so a large payload is never held decoded in full. A nil enc means
+// base64.StdEncoding; newlines in s are ignored. Malformed input surfaces as
+// a base64.CorruptInputError from the read. The size is reported as unknown,
+// and like BytesSource the source can be read any number of times.
+func Base64Source(s string, enc *base64.Encoding) Source {
+	if enc == nil {
+		enc = base64.StdEncoding
+	}
+	return base64Source{s: s, enc: enc}
+}
+
+type base64Source struct {
+	s   string
+	enc *base64.Encoding
+}
+
+func (b base64Source) open(ctx context.Context) (io.ReadCloser, func() error, int64, string, string, error) {
+	return io.NopCloser(base64.NewDecoder(b.enc, strings.NewReader(b.s))), nil, -1, KindMemory, "", nil
+}
+
+// OpenFunc opens a stream for FuncSource. size is -1 when unknown.
+type OpenFunc func(ctx context.Context) (rc io.ReadCloser, size int64, err error)
+
+// FuncSource turns open into a Source, so packages outside fio (such as
+// fio/s3fio) can add their own. open is called with the read's context each
+// time the source is read, and fio closes the returned stream.
+func FuncSource(open OpenFunc) Source { return funcSource{fn: open} }
+
+type funcSource struct{ fn OpenFunc }
+
+func (s funcSource) open(ctx context.Context) (io.ReadCloser, func() error, int64, string, string, error) {
+	if s.fn == nil {
+		return nil, nil, -1, "", "", ErrNilFunc
+	}
+	rc, size, err := s.fn(ctx)
+	if err != nil {
+		return nil, nil, -1, "", "", err
+	}
+	if rc == nil {
+		return nil, nil, -1, "", "", ErrNilSource
+	}
+	return rc, rc.Close, size, KindStream, "", nil
+}
+
 type readerSource struct{ r io.Reader }
 
 func (s readerSource) open(ctx context.Context) (io.ReadCloser, func() error, int64, string, string, error) {
@@ -249,6 +424,251 @@ func (s inputSource) open(ctx context.Context) (io.ReadCloser, func() error, int
 	return s.in.Reader, s.in.Close, s.in.Size, s.in.Kind, s.in.Path, nil
 }
 
+// ResumableURLSource is URLSourceWith that keeps what it downloads in the
+// file at partPath (created with parent dirs if missing) and resumes from
+// there. When partPath already holds bytes, the request carries a Range
+// header for the rest:
+//
+//   - 206 Partial Content must start at the current size, or the open fails;
+//     when Content-Range gives the total, the final size is checked against it.
+//   - 200 OK means the server ignored the range: partPath is truncated and the
+//     whole body is downloaded again.
+//   - 416 with a total equal to the current size means the download was
+//     already complete; any other 416 restarts from scratch.
+//
+// The reader yields the whole content (the bytes already in partPath, then
+// the rest as it arrives), so it can be copied to any Out. New bytes are
+// appended to partPath as they are read; a failed transfer keeps them for
+// the next attempt, and after a full read partPath holds the complete file.
+// The reported size is the total when known. A truncated transfer fails
+// with io.ErrUnexpectedEOF. Resuming assumes the remote content has not
+// changed in between; verify a checksum when that matters.
+//
+// Copying this source into an Out writes every byte twice, once to
+// partPath and once to the output, so it needs twice the disk space; the
+// caller removes partPath when done. To download into a file, use
+// SaveResumable, which resumes into the destination's own part file.
+func ResumableURLSource(u, partPath string, opts ...URLOption) Source {
+	return newResumableURLSource(u, partPath, opts)
+}
+
+func newResumableURLSource(u, partPath string, opts []URLOption) resumableURLSource {
+	cfg := &urlConfig{}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(cfg)
+		}
+	}
+	return resumableURLSource{url: u, part: partPath, cfg: cfg}
+}
+
+type resumableURLSource struct {
+	url  string
+	part string
+	cfg  *urlConfig
+}
+
+func (u resumableURLSource) open(ctx context.Context) (io.ReadCloser, func() error, int64, string, string, error) {
+	rr, err := u.openPart(ctx)
+	if err != nil {
+		return nil, nil, -1, "", "", err
+	}
+	return rr, rr.Close, rr.total, KindURL, strings.TrimSpace(u.url), nil
+}
+
+// openPart opens the part file and requests what it is missing.
+func (u resumableURLSource) openPart(ctx context.Context) (*resumeReader, error) {
+	urlStr := strings.TrimSpace(u.url)
+	if urlStr == "" {
+		return nil, ErrEmptyURL
+	}
+	if strings.TrimSpace(u.part) == "" {
+		return nil, ErrEmptyPath
+	}
+	if err := os.MkdirAll(filepath.Dir(u.part), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(u.part, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	rr, err := u.resume(ctx, urlStr, f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return rr, nil
+}
+
+// SaveResumable downloads u to path, resuming an earlier attempt. Bytes are
+// appended to path+".part" as they arrive; when the transfer is complete
+// the part file is synced and renamed over path (with perm, less the
+// umask) and the directory is synced. A failed or cancelled transfer keeps
+// the part file, and calling SaveResumable again requests only the missing
+// range, with the same 206/200/416 handling as ResumableURLSource. Unlike
+// copying that source to an Out, nothing is written twice. It returns the
+// size of the finished file.
+func SaveResumable(ctx context.Context, u, path string, perm os.FileMode, opts ...URLOption) (int64, error) {
+	if strings.TrimSpace(path) == "" {
+		return 0, ErrEmptyPath
+	}
+	rr, err := newResumableURLSource(u, path+".part", opts).openPart(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n, err := rr.fetch(ctx)
+	if rr.body != nil {
+		err = errors.Join(err, rr.body.Close())
+	}
+	if err != nil {
+		_ = rr.f.Close()
+		return n, err
+	}
+	return n, commitTemp(rr.f, path, perm, nil, nil)
+}
+
+// resume requests the bytes missing from f and positions f for appending.
+func (u resumableURLSource) resume(ctx context.Context, urlStr string, f *os.File) (*resumeReader, error) {
+	have, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	req, err := newURLRequest(ctx, urlStr, u.cfg)
+	if err != nil {
+		return nil, err
+	}
+	if have > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", have))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDownloadFailed, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && have > 0:
+		start, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != have {
+			_ = resp.Body.Close()
+			return nil, fmt.Errorf("%w: Content-Range %q does not resume at %d", ErrDownloadFailed, resp.Header.Get("Content-Range"), have)
+		}
+		return newResumeReader(f, have, total, resp.Body), nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && have > 0:
+		_ = resp.Body.Close()
+		if _, total, ok := parseContentRange(resp.Header.Get("Content-Range")); ok && total == have {
+			return newResumeReader(f, have, have, nil), nil
+		}
+		if err := f.Truncate(0); err != nil {
+			return nil, err
+		}
+		return u.resume(ctx, urlStr, f)
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		if err := f.Truncate(0); err != nil {
+			_ = resp.Body.Close()
+			return nil, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			_ = resp.Body.Close()
+			return nil, err
+		}
+		return newResumeReader(f, 0, resp.ContentLength, resp.Body), nil
+	default:
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrDownloadFailed, resp.Status)
+	}
+}
+
+// parseContentRange parses "bytes start-end/total" and "bytes */total".
+// total is -1 when the server sends "*" for it.
+func parseContentRange(v string) (start, total int64, ok bool) {
+	rng, found := strings.CutPrefix(v, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	span, size, found := strings.Cut(rng, "/")
+	if !found {
+		return 0, 0, false
+	}
+	total = -1
+	if size != "*" {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false
+		}
+		total = n
+	}
+	if span == "*" {
+		return 0, total, total >= 0
+	}
+	first, _, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	return start, total, true
+}
+
+// resumeReader yields the bytes already in f, then body, appending body to f.
+type resumeReader struct {
+	f     *os.File
+	r     io.Reader
+	body  io.ReadCloser
+	have  int64 // bytes in f before body
+	total int64 // -1 when unknown
+	read  int64
+	once  sync.Once
+	err   error
+}
+
+func newResumeReader(f *os.File, have, total int64, body io.ReadCloser) *resumeReader {
+	rr := &resumeReader{f: f, body: body, have: have, total: total}
+	readers := []io.Reader{io.NewSectionReader(f, 0, have)}
+	if body != nil {
+		readers = append(readers, io.TeeReader(body, f))
+	}
+	rr.r = io.MultiReader(readers...)
+	return rr
+}
+
+func (rr *resumeReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.read += int64(n)
+	if errors.Is(err, io.EOF) && rr.total >= 0 && rr.read != rr.total {
+		return n, fmt.Errorf("fio: resumed download has %d of %d bytes: %w", rr.read, rr.total, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
+// fetch appends the rest of body to f without replaying the bytes already
+// there, and returns the size of f after it.
+func (rr *resumeReader) fetch(ctx context.Context) (int64, error) {
+	size := rr.have
+	if rr.body != nil {
+		n, err := io.Copy(cancelWriter(ctx, rr.f), rr.body)
+		size += n
+		if err != nil {
+			return size, err
+		}
+	}
+	if rr.total >= 0 && size != rr.total {
+		return size, fmt.Errorf("fio: resumed download has %d of %d bytes: %w", size, rr.total, io.ErrUnexpectedEOF)
+	}
+	return size, nil
+}
+
+func (rr *resumeReader) Close() error {
+	rr.once.Do(func() {
+		if rr.body != nil {
+			rr.err = rr.body.Close()
+		}
+		rr.err = errors.Join(rr.err, rr.f.Close())
+	})
+	return rr.err
+}
+
 /* -------------------------------------------------------------------------- */
 /*                                   Input                                    */
 /* -------------------------------------------------------------------------- */
@@ -494,6 +914,9 @@ func makeReusableFile(in *Input, f *os.File) (*Input, error) {
 /*                                   Output                                   */
 /* -------------------------------------------------------------------------- */
 
+// Output is data stored in a session by Copy, Process, DoOut and the like:
+// a memory buffer or a temp file, per the storage type chosen. It stays
+// readable, any number of times, until the session is cleaned up.
 type Output struct {
 	mu                  sync.Mutex
 	path                string
@@ -504,20 +927,33 @@ type Output struct {
 	storageType         StorageType
 	maxPreallocateBytes int64
 	cleanupFunc         func() error
+	memAccounted        int64  // len(data) last reported to the session's PeakMemory
+	sum                 []byte // digest of a ChecksumSource, set by Copy and CopyTee
 }
 
+// Path returns the file backing the output, or "" for Memory storage.
 func (o *Output) Path() string {
 	o.mu.Lock()
 	defer o.mu.Unlock()
 	return o.path
 }
 
+// Sum returns the digest of the content when the output was made by Copy
+// or CopyTee from a ChecksumSource, or nil otherwise.
+func (o *Output) Sum() []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.sum
+}
+
 func (o *Output) StorageType() StorageType {
 	o.mu.Lock()
 	defer o.mu.Unlock()
 	return o.storageType
 }
 
+// Size returns the stored size in bytes, or -1 once the output is cleaned
+// up or its file cannot be stat'ed.
 func (o *Output) Size() int64 {
 	o.mu.Lock()
 	defer o.mu.Unlock()
@@ -535,6 +971,9 @@ func (o *Output) Size() int64 {
 	return fi.Size()
 }
 
+// OpenReader returns a new reader over the stored data: over the buffer for
+// Memory storage, or the reopened file for File storage. Each call starts at
+// the beginning. It fails with ErrOutputCleaned after cleanup.
 func (o *Output) OpenReader() (io.ReadCloser, error) {
 	o.mu.Lock()
 	defer o.mu.Unlock()
@@ -645,6 +1084,7 @@ func (o *Output) cleanup() error {
 		return nil
 	}
 	o.closed = true
+	o.accountMemoryLocked()
 
 	if o.storageType == Memory {
 		if o.cleanupFunc != nil {
@@ -690,6 +1130,7 @@ func (h *OutHandle) Finalize() (*Output, error) {
 			return nil, err
 		}
 	}
+	h.session.recordOutput(h.output, -1)
 
 	return h.output, nil
 }
@@ -731,6 +1172,11 @@ type ioSession struct {
 	spillThreshold      int64
 	maxPreallocateBytes int64
 	useMmap             bool
+	mmapAdvice          MmapAdvice
+	bufPool             *bufferPool
+	progress            ProgressFunc
+	stats               statsCounter
+	managerStats        *statsCounter
 }
 
 func resolveStorageType(out OutConfig, ses *ioSession, sizeHint int64) StorageType {
@@ -749,6 +1195,7 @@ func resolveStorageType(out OutConfig, ses *ioSession, sizeHint int64) StorageTy
 	}
 	if sizeHint >= 0 && storageType == Memory && spill > 0 && sizeHint >= spill {
 		storageType = File
+		ses.addStats(func(c *statsCounter) { c.spills.Add(1) })
 	}
 
 	return storageType
@@ -979,6 +1426,9 @@ type managerConfig struct {
 	spillThreshold      *int64
 	maxPreallocateBytes *int64
 	useMmap             *bool
+	mmapAdvice          MmapAdvice
+	bufferSize          *int
+	progress            ProgressFunc
 }
 
 type thresholdOption int64
@@ -1015,6 +1465,166 @@ func (t mmapOption) applyManager(c *managerConfig) { c.useMmap = ptrBool(bool(t)
 // WithMmap enables or disables mmap for file-to-memory fast paths.
 func WithMmap(enabled bool) mmapOption { return mmapOption(enabled) }
 
+// MmapAdvice tells the kernel how mapped files will be read, so it can tune
+// read-ahead. Values combine with |, e.g. MmapSequential|MmapWillNeed.
+type MmapAdvice uint8
+
+const (
+	// MmapSequential expects pages to be read in order: read ahead
+	// aggressively and drop pages soon after use.
+	MmapSequential MmapAdvice = 1 << iota
+	// MmapRandom expects scattered access: read ahead little.
+	MmapRandom
+	// MmapWillNeed starts reading the whole mapping in now.
+	MmapWillNeed
+)
+
+func (t MmapAdvice) applyManager(c *managerConfig) { c.mmapAdvice = t }
+
+// WithMmapAdvice sets the access pattern hint given for files mapped by
+// WithMmap. It is applied with madvise on Linux and ignored elsewhere, and
+// a hint the kernel rejects is ignored too.
+func WithMmapAdvice(advice MmapAdvice) MmapAdvice { return advice }
+
+type bufferPoolOption int
+
+func (t bufferPoolOption) applyManager(c *managerConfig) { c.bufferSize = ptrInt(int(t)) }
+
+// WithBufferPool makes Copy and Read draw copy buffers of size bytes from a
+// pool shared by all sessions of the manager, instead of allocating one per
+// operation. size <= 0 uses 32 KiB.
+func WithBufferPool(size int) bufferPoolOption { return bufferPoolOption(size) }
+
+const defaultPoolBufferSize = 32 << 10
+
+// bufferPool hands out reusable copy buffers. A nil *bufferPool is valid and
+// copies with io.Copy.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = defaultPoolBufferSize
+	}
+	return &bufferPool{pool: sync.Pool{New: func() any {
+		b := make([]byte, size)
+		return &b
+	}}}
+}
+
+// copy is io.Copy using a pooled buffer. Readers that write themselves out
+// (bytes.Reader, bufio.Reader) and *os.File sources, which may use
+// copy_file_range or sendfile, are left to io.Copy since they need no buffer.
+// The destination's ReadFrom is bypassed because it usually allocates its own.
+func (p *bufferPool) copy(w io.Writer, r io.Reader) (int64, error) {
+	if p == nil {
+		return io.Copy(w, r)
+	}
+	if _, ok := r.(*os.File); ok {
+		return io.Copy(w, r)
+	}
+	if wt, ok := r.(io.WriterTo); ok {
+		return wt.WriteTo(w)
+	}
+	bp := p.pool.Get().(*[]byte)
+	defer p.pool.Put(bp)
+	return io.CopyBuffer(struct{ io.Writer }{w}, r, *bp)
+}
+
+// pooledReader gives a reader handed to a Read callback a WriteTo method, so
+// io.Copy in the callback uses the pool rather than allocating. Only plain
+// streams are wrapped (see poolReader): readers that copy themselves out or
+// offer random access are handed over as is, so callers can still assert
+// io.ReaderAt, io.Seeker or *os.File.
+type pooledReader struct {
+	r    io.Reader
+	pool *bufferPool
+}
+
+func (p pooledReader) Read(b []byte) (int, error) { return p.r.Read(b) }
+
+func (p pooledReader) WriteTo(w io.Writer) (int64, error) { return p.pool.copy(w, p.r) }
+
+// poolReader returns r wrapped in a pooledReader when pool is set and r is a
+// plain stream, and r itself otherwise.
+func poolReader(r io.Reader, pool *bufferPool) io.Reader {
+	if pool == nil {
+		return r
+	}
+	switch r.(type) {
+	case io.WriterTo, io.ReaderAt, io.Seeker:
+		return r
+	}
+	return pooledReader{r: r, pool: pool}
+}
+
+type progressOption ProgressFunc
+
+func (t progressOption) applyManager(c *managerConfig) { c.progress = ProgressFunc(t) }
+func (t progressOption) applyOut(o *OutConfig)         { o.progress = ProgressFunc(t) }
+
+// WithProgress reports progress while Copy streams a source, or, as a
+// manager option, for every Copy and Read in its sessions that does not set
+// its own. fn is called about every 1MB and a final time when the operation
+// completes successfully. total comes from the source's size hint (see
+// Sizer), such as a URLSource's Content-Length, and is -1 when unknown.
+// Reporting disables the zero-copy fast paths for the operation.
+func WithProgress(fn func(copied, total int64)) progressOption { return progressOption(fn) }
+
+// progressReader is the reading side of progressWriter, for streams whose
+// consumer is not under fio's control.
+type progressReader struct {
+	r      io.Reader
+	fn     ProgressFunc
+	copied int64
+	total  int64
+	next   int64
+	last   int64 // copied value of the most recent callback
+}
+
+func newProgressReader(r io.Reader, fn ProgressFunc, total int64) *progressReader {
+	return &progressReader{r: r, fn: fn, total: total, next: progressInterval, last: -1}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.copied += int64(n)
+	if p.copied >= p.next {
+		p.fn(p.copied, p.total)
+		p.last = p.copied
+		p.next = p.copied + progressInterval
+	}
+	return n, err
+}
+
+// done makes the final callback, unless the last one already reported it.
+func (p *progressReader) done() {
+	if p.last != p.copied {
+		p.fn(p.copied, p.total)
+	}
+}
+
+// sessionProgress returns fn, or when it is nil the default progress
+// function of the session in ctx.
+func sessionProgress(ctx context.Context, fn ProgressFunc) ProgressFunc {
+	if fn != nil {
+		return fn
+	}
+	if ses, ok := Session(ctx).(*ioSession); ok {
+		return ses.progress
+	}
+	return nil
+}
+
+// sessionBufferPool returns the buffer pool of the session in ctx, or nil.
+func sessionBufferPool(ctx context.Context) *bufferPool {
+	if ses, ok := Session(ctx).(*ioSession); ok {
+		return ses.bufPool
+	}
+	return nil
+}
+
 type manager struct {
 	mu                  sync.Mutex
 	baseDir             string
@@ -1024,6 +1634,10 @@ type manager struct {
 	spillThreshold      int64
 	maxPreallocateBytes int64
 	useMmap             bool
+	mmapAdvice          MmapAdvice
+	bufPool             *bufferPool
+	progress            ProgressFunc
+	stats               statsCounter
 }
 
 func NewIoManager(baseDir string, storageType StorageType, opts ...ManagerOption) (IoManager, error) {
@@ -1045,6 +1659,10 @@ func NewIoManager(baseDir string, storageType StorageType, opts ...ManagerOption
 	if config.useMmap != nil {
 		useMmap = *config.useMmap
 	}
+	var bufPool *bufferPool
+	if config.bufferSize != nil {
+		bufPool = newBufferPool(*config.bufferSize)
+	}
 
 	if strings.TrimSpace(baseDir) == "" {
 		dir, err := os.MkdirTemp("", "fio-")
@@ -1058,6 +1676,9 @@ func NewIoManager(baseDir string, storageType StorageType, opts ...ManagerOption
 			spillThreshold:      spill,
 			maxPreallocateBytes: maxPreallocate,
 			useMmap:             useMmap,
+			mmapAdvice:          config.mmapAdvice,
+			bufPool:             bufPool,
+			progress:            config.progress,
 		}, nil
 	}
 
@@ -1073,6 +1694,9 @@ func NewIoManager(baseDir string, storageType StorageType, opts ...ManagerOption
 		spillThreshold:      spill,
 		maxPreallocateBytes: maxPreallocate,
 		useMmap:             useMmap,
+		mmapAdvice:          config.mmapAdvice,
+		bufPool:             bufPool,
+		progress:            config.progress,
 	}, nil
 }
 
@@ -1097,9 +1721,18 @@ func (m *manager) NewSession() (IoSession, error) {
 		spillThreshold:      m.spillThreshold,
 		maxPreallocateBytes: m.maxPreallocateBytes,
 		useMmap:             m.useMmap,
+		mmapAdvice:          m.mmapAdvice,
+		bufPool:             m.bufPool,
+		progress:            m.progress,
+		managerStats:        &m.stats,
 	}, nil
 }
 
+// Stats returns the totals of every session the manager has created,
+// including ones already cleaned up. PeakMemory is the most held by all of
+// them together.
+func (m *manager) Stats() Stats { return m.stats.snapshot() }
+
 func (m *manager) Cleanup() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -1120,6 +1753,149 @@ func (m *manager) Cleanup() error {
 	return err
 }
 
+/* -------------------------------------------------------------------------- */
+/*                                   Stats                                    */
+/* -------------------------------------------------------------------------- */
+
+// Stats reports how much data a session, or all sessions of a manager, moved
+// and where it was kept.
+type Stats struct {
+	// BytesRead counts bytes streamed from sources by Copy and CopyTee.
+	// Readers handed to Read, Process and Do-family callbacks are passed
+	// through unwrapped, so what those callbacks read is not counted.
+	BytesRead int64
+	// BytesWritten counts bytes stored in outputs, after any GzipOut or
+	// EncryptedOut transform.
+	BytesWritten int64
+	// SpilledToDisk counts outputs that would have been kept in Memory but
+	// went to File because their size hint reached the spill threshold.
+	SpilledToDisk int64
+	// PeakMemory is the most bytes held by Memory outputs at one time.
+	PeakMemory int64
+	// Operations counts Copy, Read, Process and Do-family calls.
+	Operations int64
+}
+
+// StatsProvider is implemented by the sessions and managers this package
+// creates. It is kept out of IoSession and IoManager so other
+// implementations of those need not provide it:
+//
+//	if sp, ok := ses.(fio.StatsProvider); ok {
+//		st := sp.Stats()
+//	}
+type StatsProvider interface {
+	Stats() Stats
+}
+
+type statsCounter struct {
+	read, written, spills, ops atomic.Int64
+	mem, peakMem               atomic.Int64
+}
+
+func (c *statsCounter) addMemory(delta int64) {
+	n := c.mem.Add(delta)
+	for {
+		peak := c.peakMem.Load()
+		if n <= peak || c.peakMem.CompareAndSwap(peak, n) {
+			return
+		}
+	}
+}
+
+func (c *statsCounter) snapshot() Stats {
+	return Stats{
+		BytesRead:     c.read.Load(),
+		BytesWritten:  c.written.Load(),
+		SpilledToDisk: c.spills.Load(),
+		PeakMemory:    c.peakMem.Load(),
+		Operations:    c.ops.Load(),
+	}
+}
+
+// Stats returns what the session has done so far.
+func (s *ioSession) Stats() Stats { return s.stats.snapshot() }
+
+// addStats applies fn to the session's counters and its manager's.
+func (s *ioSession) addStats(fn func(c *statsCounter)) {
+	if s == nil {
+		return
+	}
+	fn(&s.stats)
+	if s.managerStats != nil {
+		fn(s.managerStats)
+	}
+}
+
+func (s *ioSession) countOp() { s.addStats(func(c *statsCounter) { c.ops.Add(1) }) }
+
+func (s *ioSession) countRead(n int64) {
+	if n > 0 {
+		s.addStats(func(c *statsCounter) { c.read.Add(n) })
+	}
+}
+
+// recordOutput counts a completed output as written, n bytes or its Size
+// when n < 0, and updates memory use for Memory outputs.
+func (s *ioSession) recordOutput(o *Output, n int64) {
+	if s == nil || o == nil {
+		return
+	}
+	if n < 0 {
+		n = o.Size()
+	}
+	if n > 0 {
+		s.addStats(func(c *statsCounter) { c.written.Add(n) })
+	}
+	o.mu.Lock()
+	o.accountMemoryLocked()
+	o.mu.Unlock()
+}
+
+// recordCopy counts a Copy fast path that bypassed the Do family, which
+// read and stored exactly o's content.
+func (s *ioSession) recordCopy(o *Output, err error) (*Output, error) {
+	if err != nil {
+		return nil, err
+	}
+	n := o.Size()
+	s.countOp()
+	s.countRead(n)
+	s.recordOutput(o, n)
+	return o, nil
+}
+
+// accountMemoryLocked reports the change in memory held by o since the last
+// call to its session. o.mu must be held.
+func (o *Output) accountMemoryLocked() {
+	ses, ok := o.session.(*ioSession)
+	if !ok {
+		return
+	}
+	var held int64
+	if o.storageType == Memory && !o.closed {
+		held = int64(len(o.data))
+	}
+	if delta := held - o.memAccounted; delta != 0 {
+		o.memAccounted = held
+		ses.addStats(func(c *statsCounter) { c.addMemory(delta) })
+	}
+}
+
+// countOp counts an operation for the session in ctx, if any.
+func countOp(ctx context.Context) {
+	if ses, ok := Session(ctx).(*ioSession); ok {
+		ses.countOp()
+	}
+}
+
+// countReads counts n bytes copied from a source towards the BytesRead of
+// the session in ctx, if any.
+func countReads(ctx context.Context, n int64) {
+	if ses, ok := Session(ctx).(*ioSession); ok {
+		ses.countRead(n)
+	}
+}
+
 /* -------------------------------------------------------------------------- */
 /*                             Context Helpers                                */
 /* -------------------------------------------------------------------------- */
@@ -1150,6 +1926,33 @@ type OutConfig struct {
 	reusePtr            **Output
 	reuseCfg            outReuseConfig
 	reuseEnabled        bool
+	progress            ProgressFunc
+	wrappers            []outWrapper // innermost first, see wrapWriter
+	sink                io.Writer    // replaces storage, see HashOut
+}
+
+// outWrapper transforms the bytes written to an output, as EncryptedOut does.
+// Closing the returned writer must flush it and close w.
+type outWrapper func(w io.WriteCloser) (io.WriteCloser, error)
+
+// withWrapper returns out with wrap applied in front of its existing wrappers.
+func (o OutConfig) withWrapper(wrap outWrapper) OutConfig {
+	o.wrappers = append(slices.Clip(o.wrappers), wrap)
+	return o
+}
+
+// wrapWriter layers the wrappers of o over w, the storage writer, so the
+// last one added is the first to see written bytes. On error w is closed.
+func (o OutConfig) wrapWriter(w io.WriteCloser) (io.WriteCloser, error) {
+	for _, wrap := range o.wrappers {
+		ww, err := wrap(w)
+		if err != nil {
+			_ = w.Close()
+			return nil, err
+		}
+		w = ww
+	}
+	return w, nil
 }
 
 type OutOption interface {
@@ -1288,8 +2091,21 @@ func NewOut(ctx context.Context, out OutConfig, sizeHint ...int64) (*OutHandle,
 		hint = sizeHint[0]
 	}
 
-	storageType := resolveStorageType(out, iSes, hint)
-
+	if out.sink != nil {
+		output, err := iSes.newOutput(out.ext, Memory)
+		if err != nil {
+			return nil, err
+		}
+		w, err := out.wrapWriter(nopWriteCloser{out.sink})
+		if err != nil {
+			_ = output.cleanup()
+			return nil, err
+		}
+		return &OutHandle{Writer: w, output: output, session: iSes}, nil
+	}
+
+	storageType := resolveStorageType(out, iSes, hint)
+
 	output, err := iSes.newOutput(out.ext, storageType)
 	if err != nil {
 		return nil, err
@@ -1301,6 +2117,10 @@ func NewOut(ctx context.Context, out OutConfig, sizeHint ...int64) (*OutHandle,
 		_ = output.cleanup()
 		return nil, err
 	}
+	if w, err = out.wrapWriter(w); err != nil {
+		_ = output.cleanup()
+		return nil, err
+	}
 
 	return &OutHandle{Writer: w, output: output, session: iSes}, nil
 }
@@ -1383,6 +2203,12 @@ func (s *Scope) UseSized(src Source) (io.Reader, int64, error) {
 	} else {
 		s.cleanups = append(s.cleanups, rc.Close)
 	}
+	if sz, ok := src.(Sizer); ok {
+		size = -1
+		if n, ok := sz.Size(); ok {
+			size = n
+		}
+	}
 	return rc, size, nil
 }
 
@@ -1711,7 +2537,10 @@ func (s *OutScope) newOutReuse(cfg OutConfig) (io.Writer, error) {
 			buf = &bytes.Buffer{}
 		}
 
-		wc := &memWriteCloser{buf: buf, output: out, cfg: reuseCfg}
+		wc, err := cfg.wrapWriter(&memWriteCloser{buf: buf, output: out, cfg: reuseCfg})
+		if err != nil {
+			return nil, err
+		}
 		s.outHandle = &OutHandle{Writer: wc, output: out, session: iSes}
 		return wc, nil
 
@@ -1731,6 +2560,10 @@ func (s *OutScope) newOutReuse(cfg OutConfig) (io.Writer, error) {
 			_ = out.cleanup()
 			return nil, err
 		}
+		if w, err = cfg.wrapWriter(w); err != nil {
+			_ = out.cleanup()
+			return nil, err
+		}
 
 		s.outHandle = &OutHandle{Writer: w, output: out, session: iSes}
 		return w, nil
@@ -1751,6 +2584,7 @@ func Do[T any](ctx context.Context, fn func(s *Scope) (*T, error)) (*T, error) {
 		ctx: ctx,
 		// cleanups: nil - lazy allocate only when needed
 	}
+	countOp(ctx)
 
 	res, err := fn(s)
 	finErr := s.finalize(err)
@@ -1773,6 +2607,7 @@ func DoOut(ctx context.Context, outCfg OutConfig, fn func(ctx context.Context, s
 		},
 		outConfig: outCfg,
 	}
+	countOp(ctx)
 
 	w := &lazyOutWriter{scope: s}
 	err := fn(ctx, s, w)
@@ -1796,6 +2631,7 @@ func DoOutResult[T any](ctx context.Context, outCfg OutConfig, fn func(ctx conte
 		},
 		outConfig: outCfg,
 	}
+	countOp(ctx)
 
 	w := &lazyOutWriter{scope: s}
 	res, err := fn(ctx, s, w)
@@ -1810,7 +2646,28 @@ func DoOutResult[T any](ctx context.Context, outCfg OutConfig, fn func(ctx conte
 /*                         One-liner Helpers (typed)                          */
 /* -------------------------------------------------------------------------- */
 
-func Copy(ctx context.Context, src Source, out OutConfig) (*Output, error) {
+// Copy stores src in a new output configured by out and returns it; read
+// it back with Output.OpenReader, Size and Path until the session is cleaned
+// up. With tee targets, src is read once and written to out and every tee
+// target alike, as CopyTee does; the output of out is returned. When src is
+// a ChecksumSource, the output's Sum returns the digest of what was copied.
+func Copy(ctx context.Context, src Source, out OutConfig, tee ...OutConfig) (*Output, error) {
+	output, err := copyOutput(ctx, src, out, tee...)
+	if err != nil {
+		return nil, err
+	}
+	recordSum(src, output)
+	return output, nil
+}
+
+func copyOutput(ctx context.Context, src Source, out OutConfig, tee ...OutConfig) (*Output, error) {
+	if len(tee) > 0 {
+		outputs, err := CopyTee(ctx, src, append([]OutConfig{out}, tee...)...)
+		if err != nil {
+			return nil, err
+		}
+		return outputs[0], nil
+	}
 	if out.reuseEnabled {
 		return copyViaDoOut(ctx, src, out)
 	}
@@ -1826,6 +2683,9 @@ func Copy(ctx context.Context, src Source, out OutConfig) (*Output, error) {
 	if err := iSes.ensureOpen(); err != nil {
 		return nil, err
 	}
+	if out.progress != nil || iSes.progress != nil || len(out.wrappers) > 0 || out.sink != nil {
+		return copyViaDoOut(ctx, src, out)
+	}
 
 	// Fast path: bytesSource to Memory (avoids io.Copy overhead)
 	if b, ok := src.(bytesSource); ok && b != nil {
@@ -1839,9 +2699,12 @@ func Copy(ctx context.Context, src Source, out OutConfig) (*Output, error) {
 			output.mu.Lock()
 			output.data = b
 			output.mu.Unlock()
-			return output, nil
+			return iSes.recordCopy(output, nil)
 		}
 		if storageType == File {
+			if err := copyCancelled(ctx); err != nil {
+				return nil, err
+			}
 			output, f, err := iSes.newOutputWithFile(out.ext, File)
 			if err != nil {
 				return nil, err
@@ -1857,7 +2720,7 @@ func Copy(ctx context.Context, src Source, out OutConfig) (*Output, error) {
 				_ = output.cleanup()
 				return nil, closeErr
 			}
-			return output, nil
+			return iSes.recordCopy(output, nil)
 		}
 	}
 
@@ -1872,7 +2735,7 @@ func Copy(ctx context.Context, src Source, out OutConfig) (*Output, error) {
 		}
 		if sessionStorageType == File && iSes.autoFileThreshold <= 0 && out.autoFileThreshold == nil {
 			// Fast path: file → file (uses sendfile/copy_file_range syscall)
-			return copyFileToFile(iSes, out, srcPath)
+			return iSes.recordCopy(copyFileToFile(ctx, iSes, out, srcPath))
 		}
 
 		// Need size for auto-threshold decisions
@@ -1881,12 +2744,12 @@ func Copy(ctx context.Context, src Source, out OutConfig) (*Output, error) {
 
 		// Fast path: file → memory
 		if storageType == Memory && size > 0 {
-			return copyFileToMemory(iSes, out, srcPath, size)
+			return iSes.recordCopy(copyFileToMemory(iSes, out, srcPath, size))
 		}
 
 		// Fast path: file → file (uses sendfile/copy_file_range syscall)
 		if storageType == File {
-			return copyFileToFile(iSes, out, srcPath)
+			return iSes.recordCopy(copyFileToFile(ctx, iSes, out, srcPath))
 		}
 	}
 
@@ -1929,7 +2792,7 @@ func copyFileToMemory(iSes *ioSession, out OutConfig, srcPath string, size int64
 	defer f.Close()
 
 	if iSes != nil && iSes.useMmap {
-		if data, cleanup, ok := tryMmap(f, size); ok {
+		if data, cleanup, ok := tryMmap(f, size, iSes.mmapAdvice); ok {
 			output.mu.Lock()
 			output.data = data
 			output.cleanupFunc = cleanup
@@ -1973,7 +2836,10 @@ func copyFileToMemory(iSes *ioSession, out OutConfig, srcPath string, size int64
 	return output, nil
 }
 
-func copyFileToFile(iSes *ioSession, out OutConfig, srcPath string) (*Output, error) {
+// copyChunk is how much copyFileToFile copies between context checks.
+const copyChunk = 8 << 20
+
+func copyFileToFile(ctx context.Context, iSes *ioSession, out OutConfig, srcPath string) (*Output, error) {
 	// Open source file first to fail fast if it doesn't exist
 	srcFile, err := os.Open(srcPath)
 	if err != nil {
@@ -1986,8 +2852,22 @@ func copyFileToFile(iSes *ioSession, out OutConfig, srcPath string) (*Output, er
 		return nil, err
 	}
 
-	// Use direct io.Copy to leverage copy_file_range syscall on supported platforms
-	_, err = io.Copy(dstFile, srcFile)
+	// Use direct io.Copy to leverage copy_file_range syscall on supported platforms.
+	// CopyN keeps that path (it unwraps the LimitedReader) while letting ctx
+	// be checked between chunks.
+	if ctx.Done() == nil {
+		_, err = io.Copy(dstFile, srcFile)
+	} else {
+		for err == nil {
+			if err = copyCancelled(ctx); err != nil {
+				break
+			}
+			if _, err = io.CopyN(dstFile, srcFile, copyChunk); err == io.EOF {
+				err = nil
+				break
+			}
+		}
+	}
 	_ = srcFile.Close()
 	closeErr := dstFile.Close()
 	if err != nil {
@@ -2004,15 +2884,149 @@ func copyFileToFile(iSes *ioSession, out OutConfig, srcPath string) (*Output, er
 
 func copyViaDoOut(ctx context.Context, src Source, out OutConfig) (*Output, error) {
 	return DoOut(ctx, out, func(ctx context.Context, s *OutScope, w io.Writer) error {
-		r, _, err := s.UseSized(src)
+		r, size, err := s.UseSized(src)
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(w, r)
+		w = cancelWriter(ctx, w)
+		if fn := sessionProgress(ctx, out.progress); fn != nil {
+			pr := newProgressReader(r, fn, size)
+			n, err := sessionBufferPool(ctx).copy(w, pr)
+			countReads(ctx, n)
+			if err != nil {
+				return err
+			}
+			pr.done()
+		} else {
+			n, err := sessionBufferPool(ctx).copy(w, r)
+			countReads(ctx, n)
+			if err != nil {
+				return err
+			}
+		}
+		// An empty source still yields an (empty, or for EncryptedOut
+		// header-only) output rather than none.
+		_, err = s.ensureOutWriter()
 		return err
 	})
 }
 
+// CopyTee reads src once and writes it to one output per config in outs,
+// like io.MultiWriter, returning the outputs in the same order. If reading
+// or any target fails, the whole copy fails and the outputs already written
+// are cleaned up. Progress is reported once, by the first target that sets
+// WithProgress or else the session default. As with Copy, a ChecksumSource
+// digest is recorded on every output.
+func CopyTee(ctx context.Context, src Source, outs ...OutConfig) ([]*Output, error) {
+	outputs, err := copyTee(ctx, src, outs...)
+	if err != nil {
+		return nil, err
+	}
+	recordSum(src, outputs...)
+	return outputs, nil
+}
+
+func copyTee(ctx context.Context, src Source, outs ...OutConfig) ([]*Output, error) {
+	if len(outs) == 0 {
+		return nil, errors.New("fio: CopyTee: no outputs")
+	}
+	var progress ProgressFunc
+	for _, out := range outs {
+		if out.progress != nil {
+			progress = out.progress
+			break
+		}
+	}
+	progress = sessionProgress(ctx, progress)
+
+	outputs, err := Do(ctx, func(s *Scope) (*[]*Output, error) {
+		r, size, err := s.UseSized(src)
+		if err != nil {
+			return nil, err
+		}
+		scopes := make([]*OutScope, len(outs))
+		writers := make([]io.Writer, len(outs))
+		for i, out := range outs {
+			scopes[i] = &OutScope{Scope: Scope{ctx: ctx}, outConfig: out}
+			scopes[i].setOutSizeHint(size)
+			writers[i] = &lazyOutWriter{scope: scopes[i]}
+		}
+		// Targets are opened up front so an empty source still yields
+		// outputs, and a target that cannot be created fails before any
+		// data is read.
+		for _, sc := range scopes {
+			if _, err = sc.ensureOutWriter(); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			w := cancelWriter(ctx, io.MultiWriter(writers...))
+			var n int64
+			if progress != nil {
+				pr := newProgressReader(r, progress, size)
+				if n, err = sessionBufferPool(ctx).copy(w, pr); err == nil {
+					pr.done()
+				}
+			} else {
+				n, err = sessionBufferPool(ctx).copy(w, r)
+			}
+			countReads(ctx, n)
+		}
+
+		outputs := make([]*Output, 0, len(scopes))
+		for _, sc := range scopes {
+			o, ferr := sc.finalizeOut(err)
+			if err == nil && ferr != nil {
+				err = ferr
+			}
+			if ferr == nil && o != nil {
+				outputs = append(outputs, o)
+			}
+		}
+		if err != nil {
+			for _, o := range outputs {
+				_ = o.cleanup()
+			}
+			return nil, err
+		}
+		return &outputs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return *outputs, nil
+}
+
+// copyCancelled returns ctx's error, wrapped, once ctx is done.
+func copyCancelled(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("fio: copy cancelled: %w", err)
+	}
+	return nil
+}
+
+// cancelWriter makes writes to w fail once ctx is done, so a copy into
+// storage stops at the next buffer flush and its output is cleaned up.
+// Contexts that cannot be cancelled get w back unchanged.
+func cancelWriter(ctx context.Context, w io.Writer) io.Writer {
+	if ctx.Done() == nil {
+		return w
+	}
+	return ctxWriter{ctx: ctx, w: w}
+}
+
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c ctxWriter) Write(p []byte) (int, error) {
+	if err := copyCancelled(c.ctx); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
+
 func Process(ctx context.Context, src Source, out OutConfig, fn func(r io.Reader, w io.Writer) error) (*Output, error) {
 	if fn == nil {
 		return nil, ErrNilFunc
@@ -2122,11 +3136,33 @@ func Read(ctx context.Context, src Source, fn func(r io.Reader) error) error {
 		return ErrNilFunc
 	}
 	_, err := Do(ctx, func(s *Scope) (*Void, error) {
-		r, useErr := s.Use(src)
+		progress := sessionProgress(ctx, nil)
+		var (
+			r      io.Reader
+			size   int64
+			useErr error
+		)
+		if progress != nil {
+			r, size, useErr = s.UseSized(src)
+		} else {
+			r, useErr = s.Use(src)
+		}
 		if useErr != nil {
 			return nil, useErr
 		}
-		return nil, fn(r)
+		var pr *progressReader
+		if progress != nil {
+			pr = newProgressReader(r, progress, size)
+			r = pr
+		}
+		r = poolReader(r, sessionBufferPool(ctx))
+		if err := fn(r); err != nil {
+			return nil, err
+		}
+		if pr != nil {
+			pr.done()
+		}
+		return nil, nil
 	})
 	return err
 }
@@ -2221,6 +3257,67 @@ func ReadListResult[T any](ctx context.Context, srcs []Source, fn func(readers [
 	})
 }
 
+// ReadEach opens each of sources and streams it to fn, running up to workers
+// at a time; workers <= 0 uses GOMAXPROCS. i is the index of the source in
+// sources, and fn may be called concurrently for different indexes. The
+// first error, from opening a source or from fn, cancels the context of the
+// remaining reads, stops new ones from starting, and is returned. If ctx is
+// done before every source has started, ctx.Err() is returned. An empty
+// sources reads nothing and returns nil.
+func ReadEach(ctx context.Context, sources []Source, workers int, fn func(i int, r io.Reader) error) error {
+	if fn == nil {
+		return ErrNilFunc
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, len(sources))
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	jobs := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+				err := Read(ctx, sources[i], func(r io.Reader) error { return fn(i, r) })
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+feed:
+	for i := range sources {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
 /* -------------------------------------------------------------------------- */
 /*                                   Size                                     */
 /* -------------------------------------------------------------------------- */
@@ -2292,6 +3389,12 @@ func SizeFromStream(src Source) int64 {
 	if src == nil {
 		return -1
 	}
+	if sz, ok := src.(Sizer); ok {
+		if n, ok := sz.Size(); ok {
+			return n
+		}
+		return -1
+	}
 
 	switch v := src.(type) {
 	case bytesSource:
@@ -2324,6 +3427,11 @@ func SizeFromStream(src Source) int64 {
 			return -1
 		}
 		return v.in.Size
+	case *HashingSource:
+		if v == nil {
+			return -1
+		}
+		return SizeFromStream(v.src)
 	default:
 		return -1
 	}
@@ -2381,7 +3489,19 @@ func WriteStreamToFile(src Source, path string) (int64, error) {
 
 type LineFunc func(line string) error
 
-func ReadLines(ctx context.Context, src Source, fn LineFunc) error {
+type LineOption func(*lineConfig)
+type lineConfig struct {
+	maxLineSize int
+}
+
+// WithMaxLineSize sets the longest line ReadLines accepts (bytes). Default is 1MB.
+func WithMaxLineSize(n int) LineOption { return func(c *lineConfig) { c.maxLineSize = n } }
+
+// ReadLines calls fn for each line of src.
+// A line longer than the max line size fails with ErrLineTooLong.
+// ctx is checked between lines; on cancellation ctx.Err() is returned and
+// the source is still closed.
+func ReadLines(ctx context.Context, src Source, fn LineFunc, opts ...LineOption) error {
 	if src == nil {
 		return ErrNilSource
 	}
@@ -2389,20 +3509,36 @@ func ReadLines(ctx context.Context, src Source, fn LineFunc) error {
 		return nil
 	}
 
+	cfg := &lineConfig{maxLineSize: defaultMaxLineSize}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(cfg)
+		}
+	}
+	if cfg.maxLineSize <= 0 {
+		cfg.maxLineSize = defaultMaxLineSize
+	}
+
 	_, err := Do(ctx, func(s *Scope) (*Void, error) {
 		r, useErr := s.Use(src)
 		if useErr != nil {
 			return nil, useErr
 		}
 		scanner := bufio.NewScanner(r)
-		buf := make([]byte, 0, 64*1024)
-		scanner.Buffer(buf, 1024*1024)
+		buf := make([]byte, 0, minInt64(64*1024, int64(cfg.maxLineSize)))
+		scanner.Buffer(buf, cfg.maxLineSize)
 		for scanner.Scan() {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
 			if err := fn(scanner.Text()); err != nil {
 				return nil, err
 			}
 		}
 		if err := scanner.Err(); err != nil {
+			if errors.Is(err, bufio.ErrTooLong) {
+				return nil, fmt.Errorf("%w: limit is %d bytes", ErrLineTooLong, cfg.maxLineSize)
+			}
 			return nil, err
 		}
 		return nil, nil
@@ -2410,119 +3546,4958 @@ func ReadLines(ctx context.Context, src Source, fn LineFunc) error {
 	return err
 }
 
-func ReadFileLines(ctx context.Context, path string, fn LineFunc) error {
-	return ReadLines(ctx, PathSource(path), fn)
+// ReadFileLines is ReadLines for a file path. ctx is checked between lines,
+// so a long scan stops promptly with ctx.Err() once ctx is cancelled; errors
+// from fn and the scanner are returned as by ReadLines. The file is closed
+// in every case, including a cancellation mid-scan.
+func ReadFileLines(ctx context.Context, path string, fn LineFunc, opts ...LineOption) error {
+	return ReadLines(ctx, PathSource(path), fn, opts...)
 }
 
-/* -------------------------------------------------------------------------- */
-/*                        DownloadReaderCloser helper                          */
-/* -------------------------------------------------------------------------- */
-
-// DownloadReaderCloser is a convenience interface for a read-only stream
-// that also supports Close.
-type DownloadReaderCloser interface {
-	io.Reader
-	io.Closer
+type DelimitedOption func(*delimitedConfig)
+type delimitedConfig struct {
+	keepDelim     bool
+	maxRecordSize int
 }
 
-type downloadReaderCloser struct {
-	reader            io.ReadCloser
-	cleanup           func() error
-	additionalCleanup func()
-}
+// WithKeepDelimiter passes each record to the ReadDelimited callback with its
+// trailing delimiter. A final record without one is passed as is.
+func WithKeepDelimiter() DelimitedOption { return func(c *delimitedConfig) { c.keepDelim = true } }
 
-func (d *downloadReaderCloser) Read(p []byte) (int, error) {
-	if d.reader == nil {
-		return 0, io.ErrClosedPipe
-	}
-	return d.reader.Read(p)
+// WithMaxRecordSize sets the longest record ReadDelimited accepts (bytes). Default is 1MB.
+func WithMaxRecordSize(n int) DelimitedOption {
+	return func(c *delimitedConfig) { c.maxRecordSize = n }
 }
 
-func (d *downloadReaderCloser) Close() error {
-	var errs error
-
-	if d.reader != nil {
-		errs = errors.Join(errs, d.reader.Close())
-		d.reader = nil
+// ReadDelimited calls fn for each record of the file at path, split on delim
+// (e.g. 0 for find -print0 output). The delimiter is stripped unless
+// WithKeepDelimiter is given. Consecutive delimiters give empty records; a
+// final record without a trailing delimiter is still reported, and a
+// trailing delimiter does not add an empty one. The record slice is only
+// valid until fn returns. A record longer than the max record size fails
+// with ErrLineTooLong; a non-nil error from fn stops the read and is returned.
+func ReadDelimited(path string, delim byte, fn func(record []byte) error, opts ...DelimitedOption) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
 	}
-
-	if d.cleanup != nil {
-		errs = errors.Join(errs, d.cleanup())
-		d.cleanup = nil
+	if fn == nil {
+		return ErrNilFunc
 	}
-
-	if d.additionalCleanup != nil {
-		d.additionalCleanup()
-		d.additionalCleanup = nil
+	cfg := &delimitedConfig{maxRecordSize: defaultMaxLineSize}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(cfg)
+		}
 	}
-
-	return errs
-}
-
-// NewDownloadReaderCloser wraps a Source as a DownloadReaderCloser.
-func NewDownloadReaderCloser(src Source, cleanup ...func()) (DownloadReaderCloser, error) {
-	if src == nil {
-		return nil, ErrNilSource
+	if cfg.maxRecordSize <= 0 {
+		cfg.maxRecordSize = defaultMaxLineSize
 	}
 
-	rc, rcCleanup, _, _, _, err := src.open(context.Background())
+	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer f.Close()
 
-	d := &downloadReaderCloser{
-		reader:  rc,
-		cleanup: rcCleanup,
+	scanner := bufio.NewScanner(f)
+	// The limit counts the delimiter, which the scanner buffers with the record.
+	limit := cfg.maxRecordSize + 1
+	scanner.Buffer(make([]byte, 0, min(64*1024, limit)), limit)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, delim); i >= 0 {
+			if cfg.keepDelim {
+				return i + 1, data[:i+1], nil
+			}
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for scanner.Scan() {
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
 	}
-
-	if len(cleanup) > 0 {
-		d.additionalCleanup = cleanup[0]
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return fmt.Errorf("%w: limit is %d bytes", ErrLineTooLong, cfg.maxRecordSize)
+		}
+		return err
 	}
-
-	return d, nil
+	return nil
 }
 
 /* -------------------------------------------------------------------------- */
-/*                                ToReaderAt                                  */
+/*                               Line Helpers                                 */
 /* -------------------------------------------------------------------------- */
 
-// readerAtReader is any type that implements both io.Reader and io.ReaderAt.
-type readerAtReader struct {
-	io.Reader
-	io.ReaderAt
-}
-
-// readerAtReadCloser preserves ReaderAt while adding a no-op Close.
-type readerAtReadCloser struct {
-	*readerAtReader
-}
+const reverseChunkSize = 32 << 10
 
-func (r readerAtReadCloser) Close() error { return nil }
+var errStopLines = errors.New("fio: stop lines")
 
-// writerToReadCloser preserves WriterTo while adding a no-op Close.
-type writerToReadCloser struct {
-	io.Reader
-	io.WriterTo
-}
+// ReadLastLines returns the last n lines of a file in file order (oldest first).
+// The file is read backwards in chunks, so only the tail is loaded.
+// If the file has fewer than n lines, all lines are returned.
+func ReadLastLines(path string, n int) ([]string, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, ErrEmptyPath
+	}
+	if n <= 0 {
+		return nil, nil
+	}
 
-func (w writerToReadCloser) Close() error { return nil }
+	lines := make([]string, 0, n)
+	err := readFileLinesReverse(path, func(line []byte) error {
+		lines = append(lines, string(line))
+		if len(lines) >= n {
+			return errStopLines
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopLines) {
+		return nil, err
+	}
 
-// readerAtWriterToReadCloser preserves ReaderAt and WriterTo while adding a no-op Close.
-type readerAtWriterToReadCloser struct {
-	*readerAtReader
-	io.WriterTo
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines, nil
 }
 
-func (r readerAtWriterToReadCloser) Close() error { return nil }
-
-type ReaderAtResult struct {
-	readerAt io.ReaderAt
-	size     int64
-	cleanup  func() error
-	source   string // "direct" | "memory" | "tempFile"
+// ReadLinesReverse calls fn for each line of a file, starting from the last line.
+// Like ReadLines, a non-nil error from fn stops the scan and is returned.
+// A missing final newline and "\r\n" endings are handled.
+func ReadLinesReverse(path string, fn LineFunc) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	if fn == nil {
+		return nil
+	}
+	return readFileLinesReverse(path, func(line []byte) error {
+		return fn(string(line))
+	})
 }
 
-const (
+// CountLines returns the number of lines in a file without allocating them.
+// A final line without a trailing newline is counted, so "a\nb" has 2 lines
+// and an empty file has 0.
+func CountLines(path string) (int64, error) {
+	if strings.TrimSpace(path) == "" {
+		return 0, ErrEmptyPath
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 64<<10)
+	buf := make([]byte, 64<<10)
+	var (
+		count int64
+		last  byte
+		seen  bool
+	)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			count += int64(bytes.Count(buf[:n], []byte{'\n'}))
+			last = buf[n-1]
+			seen = true
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if seen && last != '\n' {
+		count++
+	}
+	return count, nil
+}
+
+// readFileLinesReverse calls fn for each line of path, last line first.
+// A trailing newline does not produce an empty last line and "\r\n" endings are stripped.
+// The slice passed to fn is only valid during the call.
+func readFileLinesReverse(path string, fn func(line []byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size := fileSize(f)
+	if size <= 0 {
+		return nil
+	}
+
+	emit := func(line []byte) error {
+		return fn(bytes.TrimSuffix(line, []byte{'\r'}))
+	}
+
+	var carry []byte
+	pos := size
+	first := true
+	for pos > 0 {
+		readSize := minInt64(reverseChunkSize, pos)
+		pos -= readSize
+
+		data := make([]byte, int(readSize), int(readSize)+len(carry))
+		if _, err := f.ReadAt(data, pos); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		data = append(data, carry...)
+
+		if first {
+			data = bytes.TrimSuffix(data, []byte{'\n'})
+			first = false
+		}
+
+		for {
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			if err := emit(data[i+1:]); err != nil {
+				return err
+			}
+			data = data[:i]
+		}
+		carry = data
+	}
+	return emit(carry)
+}
+
+// EOL is a line-ending style.
+type EOL int
+
+const (
+	LF EOL = iota
+	CRLF
+)
+
+func (e EOL) String() string {
+	if e == CRLF {
+		return "crlf"
+	}
+	return "lf"
+}
+
+func (e EOL) terminator() string {
+	if e == CRLF {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+type WriteLinesOption func(*writeLinesConfig)
+type writeLinesConfig struct {
+	eol EOL
+}
+
+// WithEOL sets the line terminator used by WriteLines (LF by default).
+func WithEOL(eol EOL) WriteLinesOption { return func(c *writeLinesConfig) { c.eol = eol } }
+
+// WriteLines writes each line followed by a terminator, creating parent dirs.
+// The file is written to a temp file and renamed over path.
+func WriteLines(path string, lines []string, perm os.FileMode, opts ...WriteLinesOption) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	cfg := &writeLinesConfig{eol: LF}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(cfg)
+		}
+	}
+	eol := cfg.eol.terminator()
+
+	return writeFileFunc(path, perm, true, func(w io.Writer) error {
+		for _, line := range lines {
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, eol); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type NormalizeEOLOption func(*normalizeEOLConfig)
+type normalizeEOLConfig struct {
+	skipBinary bool
+}
+
+// WithSkipBinary makes NormalizeEOL leave files that look binary untouched:
+// like git, a file is binary if its first 8000 bytes contain a NUL byte.
+func WithSkipBinary() NormalizeEOLOption {
+	return func(c *normalizeEOLConfig) { c.skipBinary = true }
+}
+
+// NormalizeEOL rewrites the file at path so every line ends with eol: "\r\n"
+// and "\n" are both converted, while a lone "\r" is left as is. The new
+// content is written atomically with the file's current permission bits; a
+// file that already uses eol throughout is not rewritten.
+func NormalizeEOL(path string, eol EOL, opts ...NormalizeEOLOption) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	cfg := &normalizeEOLConfig{}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(cfg)
+		}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if cfg.skipBinary && bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0 {
+		return nil
+	}
+
+	out := bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	if eol == CRLF {
+		out = bytes.ReplaceAll(out, []byte("\n"), []byte("\r\n"))
+	}
+	if bytes.Equal(out, data) {
+		return nil
+	}
+	return SafeWrite(path, out, fi.Mode().Perm())
+}
+
+// DetectEOL reports the line ending most lines of the file at path use,
+// counting "\r\n" as CRLF and a bare "\n" as LF. A tie, or a file with no
+// line endings, reports LF. The file is streamed, not loaded whole.
+func DetectEOL(path string) (EOL, error) {
+	if strings.TrimSpace(path) == "" {
+		return LF, ErrEmptyPath
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return LF, err
+	}
+	defer f.Close()
+
+	var lf, crlf int
+	var prev byte
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := f.Read(buf)
+		for _, b := range buf[:n] {
+			if b == '\n' {
+				if prev == '\r' {
+					crlf++
+				} else {
+					lf++
+				}
+			}
+			prev = b
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return LF, err
+		}
+	}
+	if crlf > lf {
+		return CRLF, nil
+	}
+	return LF, nil
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                 Byte Ranges                                */
+/* -------------------------------------------------------------------------- */
+
+// ReadAtFull returns exactly length bytes of the file at path starting at
+// offset. If the file ends before offset+length, the error wraps
+// io.ErrUnexpectedEOF, so a truncated file is never mistaken for a short
+// one. The buffer is bounded by the file size, or grows as data arrives
+// when the size is unknown, so a bogus length does not allocate.
+func ReadAtFull(path string, offset, length int64) ([]byte, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, ErrEmptyPath
+	}
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("fio: read %s: negative offset %d or length %d", path, offset, length)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if sizeKnown(fi) && length > fi.Size()-offset {
+		return nil, fmt.Errorf("fio: read %s: %d bytes at %d past size %d: %w", path, length, offset, fi.Size(), io.ErrUnexpectedEOF)
+	}
+
+	buf, err := readAtMost(f, fi, offset, length)
+	if err == nil && int64(len(buf)) == length {
+		return buf, nil
+	}
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, fmt.Errorf("fio: read %s: got %d of %d bytes at %d: %w", path, len(buf), length, offset, err)
+}
+
+// sizeKnown reports whether fi.Size() bounds what a read can return. Devices
+// and pseudo files (e.g. under /proc, which report size 0) do not.
+func sizeKnown(fi os.FileInfo) bool {
+	return fi.Mode().IsRegular() && fi.Size() > 0
+}
+
+// readAtMost reads up to length bytes of f at offset, stopping at EOF. With a
+// known size the buffer is cut to what the file holds; otherwise it grows as
+// data arrives instead of allocating length up front.
+func readAtMost(f *os.File, fi os.FileInfo, offset, length int64) ([]byte, error) {
+	if !sizeKnown(fi) {
+		return io.ReadAll(io.NewSectionReader(f, offset, length))
+	}
+	buf := make([]byte, max(0, min(length, fi.Size()-offset)))
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Range is a span of Length bytes starting at Offset.
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// ReadRanges reads every range from a single open of path and returns the
+// bytes in the order of ranges. Like a plain ReaderAt read, a range running
+// past EOF is cut short at EOF, and one starting at or past EOF yields an
+// empty slice; use ReadAtFull to treat that as an error.
+func ReadRanges(path string, ranges []Range) ([][]byte, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, ErrEmptyPath
+	}
+	for _, r := range ranges {
+		if r.Offset < 0 || r.Length < 0 {
+			return nil, fmt.Errorf("fio: read %s: negative offset %d or length %d", path, r.Offset, r.Length)
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([][]byte, len(ranges))
+	for i, r := range ranges {
+		if out[i], err = readAtMost(f, fi, r.Offset, r.Length); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// ReadChunks reads the file at path chunkSize bytes at a time and calls fn
+// with each chunk; every chunk is full except possibly the last, and an
+// empty file makes no calls. The slice passed to fn shares one buffer that
+// is overwritten by the next read, so copy it to keep it past the call. A
+// non-nil error from fn stops the read and is returned.
+func ReadChunks(path string, chunkSize int, fn func(chunk []byte) error) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	if fn == nil {
+		return ErrNilFunc
+	}
+	if chunkSize <= 0 {
+		return fmt.Errorf("fio: read %s: chunk size %d must be positive", path, chunkSize)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			if ferr := fn(buf[:n]); ferr != nil {
+				return ferr
+			}
+		}
+		switch {
+		case err == nil:
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                Byte Order Mark                             */
+/* -------------------------------------------------------------------------- */
+
+// BOM identifies the byte-order mark at the start of a text file.
+type BOM int
+
+const (
+	BOMNone    BOM = iota
+	BOMUTF8        // EF BB BF
+	BOMUTF16LE     // FF FE
+	BOMUTF16BE     // FE FF
+)
+
+// Len returns the size of the mark in bytes.
+func (b BOM) Len() int {
+	switch b {
+	case BOMUTF8:
+		return 3
+	case BOMUTF16LE, BOMUTF16BE:
+		return 2
+	}
+	return 0
+}
+
+// DetectBOM reports the UTF-8 or UTF-16 byte-order mark that data starts
+// with, or BOMNone. UTF-32 marks are not recognized; FF FE 00 00 is taken as
+// UTF-16 LE.
+func DetectBOM(data []byte) BOM {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		return BOMUTF8
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		return BOMUTF16LE
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		return BOMUTF16BE
+	}
+	return BOMNone
+}
+
+type BOMOption func(*bomConfig)
+type bomConfig struct {
+	transcode bool
+}
+
+// WithUTF16ToUTF8 makes ReadNoBOM and ReadStringNoBOM decode UTF-16 content
+// (after a UTF-16 BOM) to UTF-8. Unpaired surrogates and a dangling odd byte
+// become U+FFFD.
+func WithUTF16ToUTF8() BOMOption { return func(c *bomConfig) { c.transcode = true } }
+
+// ReadNoBOM reads the file at path and strips a leading UTF-8, UTF-16 LE or
+// UTF-16 BE byte-order mark. The rest is returned as is, so UTF-16 content
+// stays UTF-16 unless WithUTF16ToUTF8 is given. Files without a BOM pass
+// through unchanged.
+func ReadNoBOM(path string, opts ...BOMOption) ([]byte, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, ErrEmptyPath
+	}
+	var cfg bomConfig
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&cfg)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	bom := DetectBOM(data)
+	data = data[bom.Len():]
+	if cfg.transcode && (bom == BOMUTF16LE || bom == BOMUTF16BE) {
+		return utf16ToUTF8(data, bom == BOMUTF16BE), nil
+	}
+	return data, nil
+}
+
+// ReadStringNoBOM is ReadNoBOM returning a string. Pass WithUTF16ToUTF8 to
+// get valid Go text from UTF-16 files.
+func ReadStringNoBOM(path string, opts ...BOMOption) (string, error) {
+	data, err := ReadNoBOM(path, opts...)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func utf16ToUTF8(data []byte, bigEndian bool) []byte {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		lo, hi := data[2*i], data[2*i+1]
+		if bigEndian {
+			lo, hi = hi, lo
+		}
+		units[i] = uint16(lo) | uint16(hi)<<8
+	}
+	s := string(utf16.Decode(units))
+	if len(data)%2 != 0 {
+		s += "\uFFFD"
+	}
+	return []byte(s)
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                    CSV                                     */
+/* -------------------------------------------------------------------------- */
+
+type CSVOption func(*csvConfig)
+type csvConfig struct {
+	comma           rune
+	comment         rune
+	fieldsPerRecord int
+	useCRLF         bool
+	atomic          bool
+}
+
+// WithComma sets the field delimiter (default ',').
+func WithComma(r rune) CSVOption { return func(c *csvConfig) { c.comma = r } }
+
+// WithComment sets the comment character; lines starting with it are skipped.
+func WithComment(r rune) CSVOption { return func(c *csvConfig) { c.comment = r } }
+
+// WithFieldsPerRecord follows csv.Reader.FieldsPerRecord:
+// > 0 requires that many fields, 0 uses the first record's count, < 0 disables the check.
+func WithFieldsPerRecord(n int) CSVOption { return func(c *csvConfig) { c.fieldsPerRecord = n } }
+
+// WithCRLF ends written records with "\r\n" instead of "\n".
+func WithCRLF(v bool) CSVOption { return func(c *csvConfig) { c.useCRLF = v } }
+
+// WithAtomicWrite writes CSV output to a temp file and renames it over the target.
+func WithAtomicWrite() CSVOption { return func(c *csvConfig) { c.atomic = true } }
+
+func newCSVConfig(opts []CSVOption) *csvConfig {
+	cfg := &csvConfig{comma: ','}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(cfg)
+		}
+	}
+	return cfg
+}
+
+// ReadCSV streams the records of a CSV file to fn, one at a time.
+// A leading UTF-8 BOM is skipped and quoted fields may span lines.
+// Parse errors are *csv.ParseError, which carry the line number.
+func ReadCSV(path string, fn func(record []string) error, opts ...CSVOption) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	if fn == nil {
+		return ErrNilFunc
+	}
+	cfg := newCSVConfig(opts)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	if err := skipUTF8BOM(br); err != nil {
+		return err
+	}
+
+	cr := csv.NewReader(br)
+	cr.Comma = cfg.comma
+	cr.Comment = cfg.comment
+	cr.FieldsPerRecord = cfg.fieldsPerRecord
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+// WriteCSV writes records to path, creating parent dirs.
+// The file is synced before returning.
+func WriteCSV(path string, records [][]string, perm os.FileMode, opts ...CSVOption) error {
+	return WriteCSVStream(path, perm, func(write func([]string) error) error {
+		for _, record := range records {
+			if err := write(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, opts...)
+}
+
+// WriteCSVStream writes records emitted by fn to path without holding them in memory.
+// Output is flushed and synced before returning; with WithAtomicWrite a failed
+// write leaves any existing file untouched.
+func WriteCSVStream(path string, perm os.FileMode, fn func(write func([]string) error) error, opts ...CSVOption) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	if fn == nil {
+		return ErrNilFunc
+	}
+	cfg := newCSVConfig(opts)
+
+	return writeFileFunc(path, perm, cfg.atomic, func(w io.Writer) error {
+		cw := csv.NewWriter(w)
+		cw.Comma = cfg.comma
+		cw.UseCRLF = cfg.useCRLF
+		if err := fn(cw.Write); err != nil {
+			return err
+		}
+		cw.Flush()
+		return cw.Error()
+	})
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                Compression                                 */
+/* -------------------------------------------------------------------------- */
+
+type GzipOption func(*gzipConfig)
+type gzipConfig struct {
+	level int
+}
+
+// WithGzipLevel sets the compression level (gzip.DefaultCompression by default).
+func WithGzipLevel(level int) GzipOption { return func(c *gzipConfig) { c.level = level } }
+
+// ReadGzip reads and decompresses a gzip file.
+// It returns ErrNotGzip if the file does not start with a gzip header.
+func ReadGzip(path string) ([]byte, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, ErrEmptyPath
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := newGzipReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// WriteGzip compresses data into a gzip file at path, creating parent dirs.
+func WriteGzip(path string, data []byte, perm os.FileMode, opts ...GzipOption) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	cfg := &gzipConfig{level: gzip.DefaultCompression}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(cfg)
+		}
+	}
+	if cfg.level < gzip.HuffmanOnly || cfg.level > gzip.BestCompression {
+		return fmt.Errorf("fio: invalid gzip level %d", cfg.level)
+	}
+
+	return writeFileFunc(path, perm, false, func(w io.Writer) error {
+		zw, err := gzip.NewWriterLevel(w, cfg.level)
+		if err != nil {
+			return err
+		}
+		if _, err := zw.Write(data); err != nil {
+			_ = zw.Close()
+			return err
+		}
+		return zw.Close()
+	})
+}
+
+// Codec builds compressing/decompressing streams for ReadAuto and WriteAuto.
+// A nil NewReader or NewWriter marks that direction as unavailable.
+type Codec struct {
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+// Built-in codecs: .gz (read/write) and .bz2 (read only) from the standard
+// library. .zst and .xz are recognized but have no codec until one is
+// registered with RegisterCodec.
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		".gz": {
+			NewReader: func(r io.Reader) (io.ReadCloser, error) { return newGzipReader(r) },
+			NewWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		},
+		".bz2": {
+			NewReader: func(r io.Reader) (io.ReadCloser, error) { return io.NopCloser(bzip2.NewReader(r)), nil },
+		},
+		".zst": {},
+		".xz":  {},
+	}
+)
+
+// RegisterCodec adds or replaces the codec used for a file suffix (e.g. ".zst").
+func RegisterCodec(ext string, c Codec) {
+	codecsMu.Lock()
+	codecs[strings.ToLower(ext)] = c
+	codecsMu.Unlock()
+}
+
+func lookupCodec(path string) (Codec, string, bool) {
+	ext := strings.ToLower(filepath.Ext(path))
+	codecsMu.RLock()
+	c, ok := codecs[ext]
+	codecsMu.RUnlock()
+	return c, ext, ok
+}
+
+// ReadAuto reads path, decompressing it based on its suffix.
+// Unknown suffixes are read as plain files. A known suffix without a
+// decompressor returns ErrUnsupportedCompression.
+func ReadAuto(path string) ([]byte, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, ErrEmptyPath
+	}
+	c, ext, ok := lookupCodec(path)
+	if !ok {
+		return os.ReadFile(path)
+	}
+	if c.NewReader == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedCompression, ext)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := c.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(zr)
+	return data, errors.Join(err, zr.Close())
+}
+
+// WriteAuto writes data to path, compressing it based on its suffix and
+// creating parent dirs. Unknown suffixes are written as plain files. A known
+// suffix without a compressor returns ErrUnsupportedCompression.
+func WriteAuto(path string, data []byte, perm os.FileMode) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	c, ext, ok := lookupCodec(path)
+	if ok && c.NewWriter == nil {
+		return fmt.Errorf("%w: %s", ErrUnsupportedCompression, ext)
+	}
+
+	return writeFileFunc(path, perm, false, func(w io.Writer) error {
+		if !ok {
+			_, err := w.Write(data)
+			return err
+		}
+		zw, err := c.NewWriter(w)
+		if err != nil {
+			return err
+		}
+		if _, err := zw.Write(data); err != nil {
+			_ = zw.Close()
+			return err
+		}
+		return zw.Close()
+	})
+}
+
+func newGzipReader(r io.Reader) (*gzip.Reader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		if errors.Is(err, gzip.ErrHeader) || err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: %v", ErrNotGzip, err)
+		}
+		return nil, err
+	}
+	return zr, nil
+}
+
+// GzipSource wraps src and gunzips its stream, so Read, Copy and Process see
+// the decompressed bytes; the size is reported as unknown. Reads fail with
+// ctx.Err() once the scope's context is done, and closing the reader also
+// closes src. A stream without a gzip header fails with ErrNotGzip.
+func GzipSource(src Source) Source { return gzipSource{src: src} }
+
+type gzipSource struct{ src Source }
+
+func (s gzipSource) open(ctx context.Context) (io.ReadCloser, func() error, int64, string, string, error) {
+	if s.src == nil {
+		return nil, nil, -1, "", "", ErrNilSource
+	}
+	rc, cleanup, _, kind, path, err := s.src.open(ctx)
+	if err != nil {
+		return nil, nil, -1, "", "", err
+	}
+	if cleanup == nil {
+		cleanup = rc.Close
+	}
+	zr, err := newGzipReader(rc)
+	if err != nil {
+		return nil, nil, -1, "", "", errors.Join(err, cleanup())
+	}
+	g := &gzipReadCloser{ctx: ctx, zr: zr, closeInner: cleanup}
+	return g, g.Close, -1, kind, path, nil
+}
+
+// gzipReadCloser reads from zr while ctx is live. Close is idempotent, as
+// both Input.Reader and the cleanup func may call it.
+type gzipReadCloser struct {
+	ctx        context.Context
+	zr         *gzip.Reader
+	closeInner func() error
+	once       sync.Once
+	closeErr   error
+}
+
+func (g *gzipReadCloser) Read(p []byte) (int, error) {
+	if err := g.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return g.zr.Read(p)
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.once.Do(func() {
+		g.closeErr = errors.Join(g.zr.Close(), g.closeInner())
+	})
+	return g.closeErr
+}
+
+// GzipOut returns out with its content gzip-compressed at level (see
+// compress/gzip; gzip.DefaultCompression if unsure) as it is written, for
+// Copy, Process and the DoOut family. The gzip footer is written before the
+// output is finalized. An invalid level makes the write fail.
+//
+// Out combinators nest like function calls: the outermost sees the written
+// bytes first and hands its result inward. GzipOut(level, EncryptedOut(key,
+// out)) therefore compresses, then encrypts, which is the useful order, as
+// encrypted data does not compress. Read it back by undoing the steps from
+// the storage side: GzipSource(DecryptedSource(key, OutputSource(output))).
+func GzipOut(level int, out OutConfig) OutConfig {
+	return out.withWrapper(func(w io.WriteCloser) (io.WriteCloser, error) {
+		zw, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, fmt.Errorf("fio: invalid gzip level %d", level)
+		}
+		return &gzipWriteCloser{zw: zw, w: w}, nil
+	})
+}
+
+// HashOut returns an Out config that feeds every byte written to h instead
+// of storing it, for Copy, Process and the DoOut family. After the call
+// returns, h.Sum(nil) is the digest of exactly the bytes written; the Output
+// produced holds no data. Pass it to Copy as a tee target to hash content
+// while storing it, without a second pass. Reset h before reusing it.
+func HashOut(h hash.Hash) OutConfig {
+	if h == nil {
+		return OutConfig{sink: io.Discard}.withWrapper(func(io.WriteCloser) (io.WriteCloser, error) {
+			return nil, ErrNilHash
+		})
+	}
+	return OutConfig{sink: h}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// gzipWriteCloser closes zw, writing the footer, and then w.
+type gzipWriteCloser struct {
+	zw     *gzip.Writer
+	w      io.WriteCloser
+	closed bool
+}
+
+func (g *gzipWriteCloser) Write(p []byte) (int, error) { return g.zw.Write(p) }
+
+func (g *gzipWriteCloser) Close() error {
+	if g.closed {
+		return nil
+	}
+	g.closed = true
+	return errors.Join(g.zw.Close(), g.w.Close())
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                 Encryption                                 */
+/* -------------------------------------------------------------------------- */
+
+// Encrypted stream layout: a header of magic, version, chunk size and a
+// random 12-byte nonce, then AES-GCM sealed chunks of encChunkSize plaintext
+// bytes (the last may be shorter or empty). Chunk i is sealed with the nonce
+// XOR i and with the header plus a last-chunk flag as additional data, so
+// reordered, truncated or extended streams fail to decrypt.
+const (
+	encMagic      = "FIOE"
+	encVersion    = 1
+	encChunkSize  = 64 << 10
+	encMaxChunk   = 16 << 20
+	encHeaderSize = len(encMagic) + 1 + 4 + 12
+)
+
+// EncryptedOut returns out with its content encrypted with AES-GCM as it is
+// written, for Copy, Process and the DoOut family. key must be 16, 24 or 32
+// bytes, selecting AES-128, AES-192 or AES-256; any other length makes the
+// write fail. The data is sealed in 64KB chunks, so only one chunk is held
+// in memory however large the stream, and each output gets a fresh random
+// nonce. Read it back with DecryptedSource(key, OutputSource(output)). See
+// GzipOut for combining the two.
+func EncryptedOut(key []byte, out OutConfig) OutConfig {
+	key = bytes.Clone(key)
+	return out.withWrapper(func(w io.WriteCloser) (io.WriteCloser, error) {
+		return newEncryptWriter(w, key)
+	})
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("fio: encryption key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns base with the chunk counter i XORed into its tail.
+func chunkNonce(dst, base []byte, i uint64) []byte {
+	dst = append(dst[:0], base...)
+	var ctr [8]byte
+	binary.BigEndian.PutUint64(ctr[:], i)
+	for j := range ctr {
+		dst[len(dst)-8+j] ^= ctr[j]
+	}
+	return dst
+}
+
+// chunkAD is the additional data for a chunk: the stream header and whether
+// the chunk is the last one.
+func chunkAD(dst, header []byte, last bool) []byte {
+	dst = append(dst[:0], header...)
+	if last {
+		return append(dst, 1)
+	}
+	return append(dst, 0)
+}
+
+type encryptWriter struct {
+	w      io.WriteCloser
+	aead   cipher.AEAD
+	header []byte
+	nonce  []byte // base nonce
+	buf    []byte // pending plaintext, up to encChunkSize
+	sealed []byte
+	n, ad  []byte
+	chunk  uint64
+	err    error
+	closed bool
+}
+
+func newEncryptWriter(w io.WriteCloser, key []byte) (*encryptWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encHeaderSize)
+	copy(header, encMagic)
+	header[len(encMagic)] = encVersion
+	binary.BigEndian.PutUint32(header[len(encMagic)+1:], encChunkSize)
+	nonce := header[len(encMagic)+5:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		header: header,
+		nonce:  nonce,
+		buf:    make([]byte, 0, encChunkSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, so the last
+		// chunk is always the one sealed by Close.
+		if len(e.buf) == encChunkSize {
+			if e.err = e.seal(false); e.err != nil {
+				return n, e.err
+			}
+		}
+		c := copy(e.buf[len(e.buf):encChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	e.n = chunkNonce(e.n, e.nonce, e.chunk)
+	e.ad = chunkAD(e.ad, e.header, last)
+	e.sealed = e.aead.Seal(e.sealed[:0], e.n, e.buf, e.ad)
+	e.buf = e.buf[:0]
+	e.chunk++
+	_, err := e.w.Write(e.sealed)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return e.err
+	}
+	e.closed = true
+	if e.err == nil {
+		e.err = e.seal(true)
+	}
+	return errors.Join(e.err, e.w.Close())
+}
+
+// DecryptedSource wraps src, a stream written through EncryptedOut with the
+// same key, and decrypts it, so Read, Copy and Process see the plaintext;
+// the size is reported as unknown. Each chunk is authenticated before any
+// of it is returned; tampered, truncated or wrongly keyed data fails with
+// ErrDecrypt. Closing the reader also closes src.
+func DecryptedSource(key []byte, src Source) Source {
+	return decryptSource{key: bytes.Clone(key), src: src}
+}
+
+type decryptSource struct {
+	key []byte
+	src Source
+}
+
+func (s decryptSource) open(ctx context.Context) (io.ReadCloser, func() error, int64, string, string, error) {
+	if s.src == nil {
+		return nil, nil, -1, "", "", ErrNilSource
+	}
+	aead, err := newGCM(s.key)
+	if err != nil {
+		return nil, nil, -1, "", "", err
+	}
+	rc, cleanup, _, kind, path, err := s.src.open(ctx)
+	if err != nil {
+		return nil, nil, -1, "", "", err
+	}
+	if cleanup == nil {
+		cleanup = rc.Close
+	}
+	d, err := newDecryptReader(rc, aead)
+	if err != nil {
+		return nil, nil, -1, "", "", errors.Join(err, cleanup())
+	}
+	d.ctx, d.closeInner = ctx, cleanup
+	return d, d.Close, -1, kind, path, nil
+}
+
+type decryptReader struct {
+	ctx        context.Context
+	r          *bufio.Reader
+	aead       cipher.AEAD
+	header     []byte
+	nonce      []byte
+	chunkSize  int
+	sealed     []byte
+	plain      []byte // decrypted, not yet returned
+	n, ad      []byte
+	chunk      uint64
+	done       bool
+	closeInner func() error
+	once       sync.Once
+	closeErr   error
+}
+
+func newDecryptReader(r io.Reader, aead cipher.AEAD) (*decryptReader, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("%w: short header", ErrDecrypt)
+	}
+	if string(header[:len(encMagic)]) != encMagic || header[len(encMagic)] != encVersion {
+		return nil, fmt.Errorf("%w: not an encrypted stream", ErrDecrypt)
+	}
+	size := binary.BigEndian.Uint32(header[len(encMagic)+1:])
+	if size == 0 || size > encMaxChunk {
+		return nil, fmt.Errorf("%w: bad chunk size %d", ErrDecrypt, size)
+	}
+	return &decryptReader{
+		r:         br,
+		aead:      aead,
+		header:    header,
+		nonce:     header[len(encMagic)+5:],
+		chunkSize: int(size),
+		sealed:    make([]byte, int(size)+aead.Overhead()),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.ctx != nil {
+		if err := d.ctx.Err(); err != nil {
+			return 0, err
+		}
+	}
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// next reads and opens one chunk. A chunk is the last one when it is short
+// or nothing follows it.
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	last := false
+	switch {
+	case err == io.ErrUnexpectedEOF, err == io.EOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, perr := d.r.Peek(1); perr == io.EOF {
+			last = true
+		} else if perr != nil {
+			return perr
+		}
+	}
+	d.n = chunkNonce(d.n, d.nonce, d.chunk)
+	d.ad = chunkAD(d.ad, d.header, last)
+	plain, err := d.aead.Open(d.sealed[:0], d.n, d.sealed[:n], d.ad)
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d", ErrDecrypt, d.chunk)
+	}
+	d.chunk++
+	d.plain = plain
+	d.done = last
+	return nil
+}
+
+func (d *decryptReader) Close() error {
+	d.once.Do(func() {
+		if d.closeInner != nil {
+			d.closeErr = d.closeInner()
+		}
+	})
+	return d.closeErr
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                    JSON                                    */
+/* -------------------------------------------------------------------------- */
+
+// WriteJSONOptions controls how WriteJSONWith formats its output. Compact, or
+// leaving both Prefix and Indent empty, writes everything on one line.
+type WriteJSONOptions struct {
+	Prefix  string
+	Indent  string
+	Compact bool
+}
+
+// WriteJSON encodes v as JSON indented with two spaces and writes it to path
+// with a trailing newline, creating parent dirs.
+func WriteJSON(path string, v any, perm os.FileMode) error {
+	return WriteJSONWith(path, v, perm, WriteJSONOptions{Indent: "  "})
+}
+
+// WriteJSONWith is WriteJSON with the formatting in opts, e.g. Indent "\t"
+// for hand-edited files or Compact for machine-read ones. v is encoded before
+// path is opened, so an encoding error leaves an existing file untouched.
+func WriteJSONWith(path string, v any, perm os.FileMode, opts WriteJSONOptions) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if !opts.Compact {
+		enc.SetIndent(opts.Prefix, opts.Indent)
+	}
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	return writeFileFunc(path, perm, false, func(w io.Writer) error {
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+}
+
+// WriteJSONStream is WriteJSON encoding v into a buffered writer on the
+// file. A top-level slice, array or string-keyed map is written one element
+// at a time, so only one element is held marshaled in memory; the output is
+// the same single indented document WriteJSON produces. Other values,
+// including ones with their own MarshalJSON or MarshalText, are marshaled
+// whole before being written. For a stream of separate documents use
+// WriteJSONLines. If encoding or writing fails, the partial file is removed
+// so it never passes for a complete one.
+func WriteJSONStream(path string, v any, perm os.FileMode) error {
+	return writeJSONStream(path, v, perm, false)
+}
+
+// SafeWriteJSON is WriteJSONStream through a temp file renamed over path, so
+// a failed write keeps the previous file.
+func SafeWriteJSON(path string, v any, perm os.FileMode) error {
+	return writeJSONStream(path, v, perm, true)
+}
+
+func writeJSONStream(path string, v any, perm os.FileMode, atomic bool) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	err := writeFileFunc(path, perm, atomic, func(w io.Writer) error {
+		return encodeJSONStream(w, v)
+	})
+	if err != nil && !atomic {
+		_ = os.Remove(path)
+	}
+	return err
+}
+
+var (
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// encodeJSONStream writes v as json.Encoder does with a two-space indent,
+// marshaling the elements of a top-level slice, array or string-keyed map
+// one at a time.
+func encodeJSONStream(w io.Writer, v any) error {
+	rv := reflect.ValueOf(v)
+	if !jsonStreamable(rv) {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	if rv.Kind() != reflect.Array && rv.IsNil() {
+		_, err := io.WriteString(w, "null\n")
+		return err
+	}
+
+	open, end := "[", "]"
+	n := rv.Len()
+	var keys []reflect.Value
+	if rv.Kind() == reflect.Map {
+		open, end = "{", "}"
+		keys = rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	}
+	if n == 0 {
+		_, err := io.WriteString(w, open+end+"\n")
+		return err
+	}
+	if _, err := io.WriteString(w, open+"\n"); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		sep := "  "
+		if i > 0 {
+			sep = ",\n  "
+		}
+		if _, err := io.WriteString(w, sep); err != nil {
+			return err
+		}
+		var elem reflect.Value
+		if keys != nil {
+			key, err := json.Marshal(keys[i].String())
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(append(key, ": "...)); err != nil {
+				return err
+			}
+			elem = rv.MapIndex(keys[i])
+		} else {
+			elem = rv.Index(i)
+		}
+		// Slice elements are addressable, and encoding/json then uses
+		// pointer-receiver marshal methods; keep that.
+		if elem.CanAddr() {
+			elem = elem.Addr()
+		}
+		b, err := json.MarshalIndent(elem.Interface(), "  ", "  ")
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n"+end+"\n")
+	return err
+}
+
+// jsonStreamable reports whether encodeJSONStream can write rv element by
+// element with the same result as encoding/json: a slice or array (not of
+// bytes, which encode as base64) or a map with string keys, without its own
+// marshaling methods.
+func jsonStreamable(rv reflect.Value) bool {
+	if !rv.IsValid() {
+		return false
+	}
+	t := rv.Type()
+	for _, m := range []reflect.Type{jsonMarshalerType, textMarshalerType} {
+		if t.Implements(m) || reflect.PointerTo(t).Implements(m) {
+			return false
+		}
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		return t.Elem().Kind() != reflect.Uint8
+	case reflect.Map:
+		return t.Key().Kind() == reflect.String
+	}
+	return false
+}
+
+// WriteJSONLines writes one compact JSON value per line (NDJSON) for each
+// value passed to emit, creating parent dirs. Output is flushed and synced
+// before returning.
+func WriteJSONLines(path string, perm os.FileMode, fn func(emit func(v any) error) error) error {
+	return writeJSONLines(path, perm, false, fn)
+}
+
+// SafeWriteJSONLines is WriteJSONLines through a temp file renamed over path,
+// so a failed export never replaces the previous file.
+func SafeWriteJSONLines(path string, perm os.FileMode, fn func(emit func(v any) error) error) error {
+	return writeJSONLines(path, perm, true, fn)
+}
+
+func writeJSONLines(path string, perm os.FileMode, atomic bool, fn func(emit func(v any) error) error) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	if fn == nil {
+		return ErrNilFunc
+	}
+	return writeFileFunc(path, perm, atomic, func(w io.Writer) error {
+		// Encoder output is compact and newline-terminated.
+		return fn(json.NewEncoder(w).Encode)
+	})
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                 Safe Write                                 */
+/* -------------------------------------------------------------------------- */
+
+// SafeWrite atomically replaces path with data, creating parent dirs.
+// Data is written to a uniquely named temp file in the same directory (so the
+// rename stays on one filesystem), synced, and renamed over path. Concurrent
+// SafeWrite calls to the same path never share a temp file; the last rename
+// wins. The temp file is removed on any failure. As with os.WriteFile, the
+// new file gets perm less the process umask.
+//
+// With PreserveExisting, an existing target's mode (including setuid, setgid
+// and sticky bits) and owner are applied to the new file exactly, instead of
+// perm. If the owner cannot be restored (e.g. EPERM when not privileged), SafeWrite
+// fails and the target is left untouched rather than silently changing owner.
+func SafeWrite(path string, data []byte, perm os.FileMode, opts ...SafeWriteOption) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	cfg := &safeWriteConfig{}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(cfg)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	var prepare func(f *os.File) error
+	if cfg.preserveExisting {
+		if fi, err := os.Stat(path); err == nil {
+			prepare = func(f *os.File) error { return applyFileMeta(f, fi) }
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return writeFileAtomic(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}, prepare)
+}
+
+// SafeWriteReader is SafeWrite streaming from r instead of a byte slice, so
+// a large download or generated stream is persisted atomically without
+// holding it in memory. It returns the number of bytes copied from r. If
+// reading r or writing fails, the temp file is removed and path keeps its
+// previous content.
+func SafeWriteReader(path string, r io.Reader, perm os.FileMode) (int64, error) {
+	if strings.TrimSpace(path) == "" {
+		return 0, ErrEmptyPath
+	}
+	if r == nil {
+		return 0, ErrNilReader
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+	var n int64
+	err := writeFileAtomic(path, perm, func(w io.Writer) error {
+		var err error
+		n, err = io.Copy(w, r)
+		return err
+	}, nil)
+	return n, err
+}
+
+// Save streams src into path atomically, like SafeWriteReader: through a
+// temp file in the same directory that is synced and renamed over path, with
+// the directory synced after. It works with any Source, e.g. to download a
+// URLSource safely to disk, and returns the bytes written. When src knows
+// its size, disk space for it is reserved up front where the platform
+// supports it. If ctx is done, or reading or writing fails, the temp file
+// is removed, path keeps its previous content, and for cancellation the
+// error wraps ctx.Err().
+func Save(ctx context.Context, src Source, path string, perm os.FileMode) (int64, error) {
+	if strings.TrimSpace(path) == "" {
+		return 0, ErrEmptyPath
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+	var n int64
+	_, err := Do(ctx, func(s *Scope) (*Void, error) {
+		r, size, err := s.UseSized(src)
+		if err != nil {
+			return nil, err
+		}
+		return nil, writeFileAtomicTo(path, perm, func(f *os.File) error {
+			extended := size > 0 && preallocate(f, size) == nil // best effort
+			var err error
+			n, err = sessionBufferPool(ctx).copy(cancelWriter(ctx, f), r)
+			if err == nil && extended && n < size {
+				err = f.Truncate(n)
+			}
+			return err
+		}, nil)
+	})
+	return n, err
+}
+
+// WriteIfChanged writes data to path with SafeWrite only if the current
+// content differs, so unchanged files keep their mtime. It reports whether a
+// write happened. The existing file is compared in chunks, so it is never
+// loaded fully into memory.
+func WriteIfChanged(path string, data []byte, perm os.FileMode) (bool, error) {
+	if strings.TrimSpace(path) == "" {
+		return false, ErrEmptyPath
+	}
+	same, err := fileEquals(path, data)
+	if err != nil {
+		return false, err
+	}
+	if same {
+		return false, nil
+	}
+	if err := SafeWrite(path, data, perm); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// fileEquals reports whether the file at path holds exactly data.
+// A missing file is reported as not equal.
+func fileEquals(path string, data []byte) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	if size := fileSize(f); size != int64(len(data)) {
+		return false, nil
+	}
+
+	buf := make([]byte, 64<<10)
+	for off := 0; ; {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if off+n > len(data) || !bytes.Equal(buf[:n], data[off:off+n]) {
+				return false, nil
+			}
+			off += n
+		}
+		if err == io.EOF {
+			return off == len(data), nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// WriteWithBackup keeps the current content of path at path+backupSuffix
+// (".bak" if empty), replacing any older backup, then writes data with
+// SafeWrite. If path does not exist the backup step is skipped.
+//
+// The backup is made with a hard link (or a copy where links are not
+// supported) rather than a rename, so path always holds either the original
+// or the new content, even if the process dies midway.
+func WriteWithBackup(path string, data []byte, perm os.FileMode, backupSuffix string) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	if backupSuffix == "" {
+		backupSuffix = ".bak"
+	}
+	backup := path + backupSuffix
+
+	fi, err := os.Stat(path)
+	switch {
+	case err == nil:
+		if err := backupFile(path, backup, fi); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	return SafeWrite(path, data, perm)
+}
+
+func backupFile(path, backup string, fi os.FileInfo) error {
+	if err := os.Remove(backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(path, backup); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return writeFileAtomic(backup, fi.Mode().Perm(), func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	}, nil)
+}
+
+type SafeWriteOption func(*safeWriteConfig)
+type safeWriteConfig struct {
+	preserveExisting bool
+}
+
+// PreserveExisting keeps an existing target's mode and owner on SafeWrite.
+func PreserveExisting() SafeWriteOption {
+	return func(c *safeWriteConfig) { c.preserveExisting = true }
+}
+
+// applyFileMeta copies owner then mode from fi onto f.
+// Owner goes first because chown may clear setuid/setgid bits.
+func applyFileMeta(f *os.File, fi os.FileInfo) error {
+	if uid, gid, ok := fileOwner(fi); ok {
+		if err := f.Chown(uid, gid); err != nil {
+			return err
+		}
+	}
+	return f.Chmod(fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky))
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                 Temp Files                                 */
+/* -------------------------------------------------------------------------- */
+
+// DoTempDir creates a fresh directory under os.TempDir, passes it to fn and
+// removes it with everything inside once fn returns, also on error or panic.
+// fn's error is returned, joined with any error from the removal.
+func DoTempDir(fn func(dir string) error) (err error) {
+	if fn == nil {
+		return ErrNilFunc
+	}
+	dir, cleanup, err := TempDir("", "fio-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, cleanup())
+	}()
+	return fn(dir)
+}
+
+// TempDir creates a directory in dir (os.TempDir if empty) named after
+// pattern, as os.MkdirTemp does, and returns it with a cleanup func that
+// removes it and everything inside. Only the first cleanup call removes;
+// later calls are no-ops returning nil, so it is safe to both defer it and
+// call it early.
+func TempDir(dir, pattern string) (path string, cleanup func() error, err error) {
+	path, err = os.MkdirTemp(dir, pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	var once sync.Once
+	cleanup = func() error {
+		var rerr error
+		once.Do(func() { rerr = os.RemoveAll(path) })
+		return rerr
+	}
+	return path, cleanup, nil
+}
+
+// DoTempFile creates a temp file under os.TempDir named after pattern (as in
+// os.CreateTemp), passes it open to fn, then closes and removes it, also on
+// error or panic. fn may close the file itself. fn's error is returned,
+// joined with any error from the cleanup.
+func DoTempFile(pattern string, fn func(f *os.File) error) (err error) {
+	if fn == nil {
+		return ErrNilFunc
+	}
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := f.Close()
+		if errors.Is(cerr, os.ErrClosed) {
+			cerr = nil
+		}
+		err = errors.Join(err, cerr, os.Remove(f.Name()))
+	}()
+	return fn(f)
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                  Checksum                                  */
+/* -------------------------------------------------------------------------- */
+
+// Checksum streams the file at path through h and returns h.Sum(nil).
+// The caller owns h: it is not reset, so pass a fresh or Reset hash.
+func Checksum(path string, h hash.Hash) ([]byte, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, ErrEmptyPath
+	}
+	if h == nil {
+		return nil, ErrNilHash
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 64<<10)
+	if _, err := io.CopyBuffer(h, struct{ io.Reader }{f}, buf); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// SHA256 returns the hex-encoded SHA-256 digest of the file at path.
+func SHA256(path string) (string, error) {
+	sum, err := Checksum(path, sha256.New())
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// VerifyChecksum hashes the file at path with h and compares the digest
+// against expectedHex in constant time. A mismatch, including a malformed
+// expectedHex, returns (false, ErrChecksumMismatch); I/O errors are returned as is.
+func VerifyChecksum(path, expectedHex string, h hash.Hash) (bool, error) {
+	sum, err := Checksum(path, h)
+	if err != nil {
+		return false, err
+	}
+	want, err := hex.DecodeString(strings.TrimSpace(expectedHex))
+	if err != nil {
+		return false, fmt.Errorf("%w: invalid expected digest: %v", ErrChecksumMismatch, err)
+	}
+	if subtle.ConstantTimeCompare(sum, want) != 1 {
+		return false, fmt.Errorf("%w: got %x, want %x", ErrChecksumMismatch, sum, want)
+	}
+	return true, nil
+}
+
+// HashDirOption configures HashDir.
+type HashDirOption func(*hashDirConfig)
+
+type hashDirConfig struct {
+	execBit bool
+}
+
+// WithExecBit makes HashDir also change when a file's executable bit does,
+// like git's 100644/100755 modes. Windows reports no executable bits, so
+// with it the digest of a tree containing executables differs between
+// Windows and Unix.
+func WithExecBit() HashDirOption {
+	return func(c *hashDirConfig) {
+		c.execBit = true
+	}
+}
+
+// HashDir returns a hex digest of the tree under root that changes when any
+// file's content, any entry's relative path or kind, or a symlink's target
+// changes, e.g. to tell whether a cache is still valid. Timestamps,
+// ownership and permission bits are left out, so the same tree hashes the
+// same on every platform and umask; WithExecBit adds the executable bit.
+//
+// Entries are visited in sorted order. For each, newHash's hash gets a kind
+// ('f' file, 'x' executable file with WithExecBit, 'd' directory, 'l'
+// symlink, 'o' other), a space, the slash-separated path relative to root
+// and a NUL, then for a file the digest of its content by a fresh newHash,
+// and for a symlink its target and a NUL. Symlinks are not followed, so
+// links out of the tree or to missing targets are fine; a root that is
+// itself a symlink is resolved.
+func HashDir(root string, newHash func() hash.Hash, opts ...HashDirOption) (string, error) {
+	if strings.TrimSpace(root) == "" {
+		return "", ErrEmptyPath
+	}
+	if newHash == nil {
+		return "", ErrNilHash
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("fio: hash %s: not a directory", root)
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return "", err
+	}
+	var cfg hashDirConfig
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&cfg)
+		}
+	}
+
+	sum := newHash()
+	buf := make([]byte, 64<<10)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := info.Mode()
+		kind := byte('o')
+		switch {
+		case mode.IsRegular() && cfg.execBit && mode&0o111 != 0:
+			kind = 'x'
+		case mode.IsRegular():
+			kind = 'f'
+		case mode.IsDir():
+			kind = 'd'
+		case mode&fs.ModeSymlink != 0:
+			kind = 'l'
+		}
+		_, _ = fmt.Fprintf(sum, "%c %s\x00", kind, filepath.ToSlash(rel))
+
+		switch kind {
+		case 'f', 'x':
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			h := newHash()
+			_, err = io.CopyBuffer(h, struct{ io.Reader }{f}, buf)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+			_, _ = sum.Write(h.Sum(nil))
+		case 'l':
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(sum, "%s\x00", filepath.ToSlash(target))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// HashingSource is a Source that feeds every byte read through it into a hash.
+type HashingSource struct {
+	src Source
+	h   hash.Hash
+
+	mu   sync.Mutex
+	done bool // the last read consumed the whole source
+}
+
+// ChecksumSource wraps src so the stream is hashed while it is read by
+// Read, Copy or Process, avoiding a second pass. Call Sum after the read;
+// the outputs of Copy and CopyTee also carry the digest in Output.Sum.
+func ChecksumSource(src Source, h hash.Hash) *HashingSource {
+	return &HashingSource{src: src, h: h}
+}
+
+// Sum returns the digest of the source's content. It fails with
+// ErrSumIncomplete until a read has consumed the source, to EOF or to its
+// known size, so a digest is never taken before Copy or of a read that
+// failed or stopped early. Each read of the source starts the hash over.
+func (s *HashingSource) Sum() ([]byte, error) {
+	if s == nil || s.h == nil {
+		return nil, ErrNilHash
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.done {
+		return nil, ErrSumIncomplete
+	}
+	return s.h.Sum(nil), nil
+}
+
+// recordSum stores src's digest on outputs when src is a ChecksumSource that
+// was read to the end.
+func recordSum(src Source, outputs ...*Output) {
+	hs, ok := src.(*HashingSource)
+	if !ok {
+		return
+	}
+	sum, err := hs.Sum()
+	if err != nil {
+		return
+	}
+	for _, o := range outputs {
+		o.mu.Lock()
+		o.sum = sum
+		o.mu.Unlock()
+	}
+}
+
+// hashingReader hashes what is read from r and marks s done at EOF or once
+// size bytes (when known, >= 0) have been read.
+type hashingReader struct {
+	r    io.Reader
+	s    *HashingSource
+	size int64
+	read int64
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.read += int64(n)
+	h.s.mu.Lock()
+	_, _ = h.s.h.Write(p[:n])
+	if err == io.EOF || (h.size >= 0 && h.read >= h.size) {
+		h.s.done = true
+	}
+	h.s.mu.Unlock()
+	return n, err
+}
+
+func (s *HashingSource) open(ctx context.Context) (io.ReadCloser, func() error, int64, string, string, error) {
+	if s == nil || s.src == nil {
+		return nil, nil, -1, "", "", ErrNilSource
+	}
+	if s.h == nil {
+		return nil, nil, -1, "", "", ErrNilHash
+	}
+	rc, cleanup, size, kind, path, err := s.src.open(ctx)
+	if err != nil {
+		return nil, nil, -1, "", "", err
+	}
+	s.mu.Lock()
+	s.h.Reset()
+	s.done = false
+	s.mu.Unlock()
+	return readCloser{Reader: &hashingReader{r: rc, s: s, size: size}, Closer: rc}, cleanup, size, kind, path, nil
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                    MIME                                    */
+/* -------------------------------------------------------------------------- */
+
+const (
+	mimeSniffLen    = 512
+	mimeOctetStream = "application/octet-stream"
+)
+
+// MIMEInfo holds the content-sniffed and extension-derived types of a file.
+// Either field may be empty when that method yields nothing useful.
+type MIMEInfo struct {
+	Sniffed     string // from http.DetectContentType; empty for empty files
+	ByExtension string // from mime.TypeByExtension; empty if unknown
+}
+
+// Type returns the best guess: the sniffed type unless it is generic
+// (application/octet-stream or empty), then the extension type, then
+// application/octet-stream.
+func (m MIMEInfo) Type() string {
+	if m.Sniffed != "" && m.Sniffed != mimeOctetStream {
+		return m.Sniffed
+	}
+	if m.ByExtension != "" {
+		return m.ByExtension
+	}
+	return mimeOctetStream
+}
+
+// DetectMIME returns the content type of the file at path, sniffed from its
+// first 512 bytes with a fallback to the extension. Empty files with an
+// unknown extension report application/octet-stream.
+func DetectMIME(path string) (string, error) {
+	info, err := DetectMIMEInfo(path)
+	if err != nil {
+		return "", err
+	}
+	return info.Type(), nil
+}
+
+// DetectMIMEInfo reports both the sniffed and extension-derived types.
+func DetectMIMEInfo(path string) (MIMEInfo, error) {
+	if strings.TrimSpace(path) == "" {
+		return MIMEInfo{}, ErrEmptyPath
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return MIMEInfo{}, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, mimeSniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return MIMEInfo{}, err
+	}
+
+	info := MIMEInfo{ByExtension: mime.TypeByExtension(filepath.Ext(path))}
+	if n > 0 {
+		info.Sniffed = http.DetectContentType(buf[:n])
+	}
+	return info, nil
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                Permissions                                 */
+/* -------------------------------------------------------------------------- */
+
+// WalkErrorFunc decides what happens when a recursive operation fails on one
+// entry. Return nil to skip the entry and continue, or an error to stop.
+// A nil WalkErrorFunc stops on the first error.
+type WalkErrorFunc func(path string, err error) error
+
+// Chmod changes the mode of path.
+func Chmod(path string, perm os.FileMode) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	return os.Chmod(path, perm)
+}
+
+// Chown changes the numeric uid and gid of path. A value of -1 leaves that id
+// unchanged. On Windows it returns errors.ErrUnsupported.
+func Chown(path string, uid, gid int) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	if runtime.GOOS == "windows" {
+		return errors.ErrUnsupported
+	}
+	return os.Chown(path, uid, gid)
+}
+
+// ChmodRecursive sets dirPerm on every directory and filePerm on every other
+// entry under root, root included. Symlinks are not followed or changed.
+// Directories are changed before their contents, so dirPerm must keep the
+// owner search bit for the walk to descend.
+func ChmodRecursive(root string, dirPerm, filePerm os.FileMode, onErr WalkErrorFunc) error {
+	return walkApply(root, onErr, func(path string, d fs.DirEntry) error {
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			return nil
+		case d.IsDir():
+			return os.Chmod(path, dirPerm)
+		default:
+			return os.Chmod(path, filePerm)
+		}
+	})
+}
+
+// ChownRecursive changes the owner of root and everything beneath it.
+// Symlinks themselves are changed (lchown), not their targets.
+// On Windows it returns errors.ErrUnsupported.
+func ChownRecursive(root string, uid, gid int, onErr WalkErrorFunc) error {
+	if runtime.GOOS == "windows" {
+		if strings.TrimSpace(root) == "" {
+			return ErrEmptyPath
+		}
+		return errors.ErrUnsupported
+	}
+	return walkApply(root, onErr, func(path string, _ fs.DirEntry) error {
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+// walkApply runs fn on each entry under root, routing both walk and fn
+// errors through onErr.
+func walkApply(root string, onErr WalkErrorFunc, fn func(path string, d fs.DirEntry) error) error {
+	if strings.TrimSpace(root) == "" {
+		return ErrEmptyPath
+	}
+	handle := func(path string, err error) error {
+		if onErr == nil {
+			return err
+		}
+		return onErr(path, err)
+	}
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if herr := handle(path, err); herr != nil {
+				return herr
+			}
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if err := fn(path, d); err != nil {
+			return handle(path, err)
+		}
+		return nil
+	})
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                 File Info                                  */
+/* -------------------------------------------------------------------------- */
+
+// SameFile reports whether a and b refer to the same file, following
+// symlinks and detecting hardlinks. A missing path yields (false, nil);
+// other stat errors are returned.
+func SameFile(a, b string) (bool, error) {
+	if strings.TrimSpace(a) == "" || strings.TrimSpace(b) == "" {
+		return false, ErrEmptyPath
+	}
+	fa, err := os.Stat(a)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return os.SameFile(fa, fb), nil
+}
+
+// IsExecutable reports whether path is a regular file that can be executed:
+// any execute bit on Unix, or an extension listed in PATHEXT on Windows
+// (.com, .exe, .bat and .cmd when PATHEXT is unset). Missing paths and
+// directories report false without an error.
+func IsExecutable(path string) (bool, error) {
+	if strings.TrimSpace(path) == "" {
+		return false, ErrEmptyPath
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !fi.Mode().IsRegular() {
+		return false, nil
+	}
+	if runtime.GOOS == "windows" {
+		return hasExecExt(path, os.Getenv("PATHEXT")), nil
+	}
+	return fi.Mode().Perm()&0o111 != 0, nil
+}
+
+func hasExecExt(path, pathext string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == "" {
+		return false
+	}
+	if pathext == "" {
+		pathext = ".com;.exe;.bat;.cmd"
+	}
+	for _, e := range strings.Split(strings.ToLower(pathext), ";") {
+		if strings.TrimSpace(e) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// DirSizeOption configures DirSize and DirSizeOnDisk.
+type DirSizeOption func(*dirSizeConfig)
+
+type dirSizeConfig struct {
+	followSymlinks bool
+}
+
+// WithFollowSymlinks counts the targets of symlinks, descending into linked
+// directories. Each directory is visited once, so link cycles terminate.
+// By default symlinks are skipped.
+func WithFollowSymlinks() DirSizeOption {
+	return func(c *dirSizeConfig) {
+		c.followSymlinks = true
+	}
+}
+
+// DirSize returns the total apparent size of the regular files under root.
+// Directories themselves do not count; hardlinked files count once per link.
+func DirSize(root string, opts ...DirSizeOption) (int64, error) {
+	return dirSize(root, false, opts)
+}
+
+// DirSizeOnDisk is like DirSize but sums allocated blocks (st_blocks*512),
+// so sparse files count only what they occupy. Platforms without block
+// counts fall back to the apparent size.
+func DirSizeOnDisk(root string, opts ...DirSizeOption) (int64, error) {
+	return dirSize(root, true, opts)
+}
+
+func dirSize(root string, onDisk bool, opts []DirSizeOption) (int64, error) {
+	if strings.TrimSpace(root) == "" {
+		return 0, ErrEmptyPath
+	}
+	cfg := dirSizeConfig{}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&cfg)
+		}
+	}
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	add := func(fi os.FileInfo) {
+		if onDisk {
+			if n, ok := fileBlocks(fi); ok {
+				total += n
+				return
+			}
+		}
+		total += fi.Size()
+	}
+
+	visited := make(map[string]bool)
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			switch {
+			case d.IsDir():
+				if !cfg.followSymlinks {
+					return nil
+				}
+				real, err := filepath.EvalSymlinks(path)
+				if err != nil {
+					return err
+				}
+				if visited[real] {
+					return filepath.SkipDir
+				}
+				visited[real] = true
+				return nil
+			case d.Type()&fs.ModeSymlink != 0:
+				if !cfg.followSymlinks {
+					return nil
+				}
+				target, err := filepath.EvalSymlinks(path)
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil // dangling link
+				}
+				if err != nil {
+					return err
+				}
+				fi, err := os.Stat(target)
+				if err != nil {
+					return err
+				}
+				if fi.IsDir() {
+					return walk(target)
+				}
+				if fi.Mode().IsRegular() {
+					add(fi)
+				}
+				return nil
+			case d.Type().IsRegular():
+				fi, err := d.Info()
+				if err != nil {
+					return err
+				}
+				add(fi)
+			}
+			return nil
+		})
+	}
+	if err := walk(root); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                 Timestamps                                 */
+/* -------------------------------------------------------------------------- */
+
+// Touch creates path if it is missing and sets its access and modification
+// times to now.
+func Touch(path string) error {
+	return TouchTime(path, time.Now())
+}
+
+// TouchTime is Touch with an explicit time, used for both access and
+// modification time.
+func TouchTime(path string, mtime time.Time) error {
+	return TouchTimes(path, mtime, mtime)
+}
+
+// TouchTimes creates path if it is missing (mode 0644; parent directories
+// must exist) and sets its times with os.Chtimes. Existing files and
+// directories are not opened, so read-only files can be touched too. A zero time leaves that
+// timestamp unchanged. Times before the Unix epoch work on most Unix
+// filesystems, but some filesystems and Windows (before 1601) reject
+// them; the os.Chtimes error is returned as is.
+func TouchTimes(path string, atime, mtime time.Time) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return os.Chtimes(path, atime, mtime)
+}
+
+// SetModTime sets the modification time of an existing file or directory
+// without opening it. The access time is read with Stat first and written
+// back unchanged; where the platform does not expose it, os.Chtimes is
+// asked to leave it alone.
+func SetModTime(path string, t time.Time) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	atime, _ := fileAccessTime(fi) // zero leaves it unchanged
+	return os.Chtimes(path, atime, t)
+}
+
+// SetAccessTime sets the access time of an existing file or directory
+// without opening it, keeping its current modification time.
+func SetAccessTime(path string, t time.Time) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, t, fi.ModTime())
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                 File Copy                                  */
+/* -------------------------------------------------------------------------- */
+
+// CopyDir copies the directory tree src to dst, creating dst as needed.
+// Regular files go through the same path as CopyPreserve, so opts apply to
+// every file; directories get their source permissions (and, when
+// requested, owner and times) after their contents are written. If src
+// itself is a symlink, the directory it points to is copied. Symlinks below
+// it follow opts.Symlinks. Sockets, devices and pipes are skipped.
+func CopyDir(dst, src string, opts CopyOptions) error {
+	if strings.TrimSpace(dst) == "" || strings.TrimSpace(src) == "" {
+		return ErrEmptyPath
+	}
+	src, err := checkCopyDirPaths(dst, src)
+	if err != nil {
+		return err
+	}
+	c := &dirCopier{opts: opts, root: dst, visited: make(map[string]bool)}
+	if err := c.copyTree(dst, src); err != nil {
+		return err
+	}
+	return c.finishDirs()
+}
+
+// CopyDirParallel copies the tree src to dst like CopyDir with default
+// options, but copies regular files on a pool of workers after the whole
+// directory structure has been created. workers <= 0 uses GOMAXPROCS. The
+// order in which independent files are written is unspecified. The first
+// error stops the remaining work and is returned.
+func CopyDirParallel(dst, src string, workers int) error {
+	if strings.TrimSpace(dst) == "" || strings.TrimSpace(src) == "" {
+		return ErrEmptyPath
+	}
+	src, err := checkCopyDirPaths(dst, src)
+	if err != nil {
+		return err
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	c := &dirCopier{root: dst, visited: make(map[string]bool), deferFiles: true}
+	if err := c.copyTree(dst, src); err != nil {
+		return err
+	}
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	jobs := make(chan copyJob)
+	stop := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				select {
+				case <-stop:
+					continue
+				default:
+				}
+				if err := c.copyFile(job.dst, job.src); err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(stop)
+					})
+				}
+			}
+		}()
+	}
+feed:
+	for _, job := range c.files {
+		select {
+		case jobs <- job:
+		case <-stop:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return c.finishDirs()
+}
+
+// checkCopyDirPaths returns src with symlinks resolved, since WalkDir does
+// not follow a root symlink, and refuses a destination inside the source
+// tree, which would otherwise be copied into itself.
+func checkCopyDirPaths(dst, src string) (string, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("fio: copy dir %s: not a directory", src)
+	}
+	if src, err = filepath.EvalSymlinks(src); err != nil {
+		return "", err
+	}
+	absSrc, err := filepath.Abs(src)
+	if err != nil {
+		return "", err
+	}
+	absDst, err := filepath.Abs(dst)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absSrc, absDst)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("fio: copy dir: destination %s is inside source %s", dst, src)
+	}
+	return src, nil
+}
+
+type copiedDir struct {
+	path string
+	fi   os.FileInfo
+}
+
+type copyJob struct {
+	dst, src string
+}
+
+// dirCopier carries state across a CopyDir call.
+type dirCopier struct {
+	opts    CopyOptions
+	root    string          // destination root, for logical relative paths
+	visited map[string]bool // resolved source dirs, for SymlinkDereference
+	dirs    []copiedDir     // in creation order
+
+	deferFiles bool      // queue regular files in files instead of copying
+	files      []copyJob // queued when deferFiles is set
+}
+
+func (c *dirCopier) copyTree(dst, src string) error {
+	if real, err := filepath.EvalSymlinks(src); err == nil {
+		if c.visited[real] {
+			return nil
+		}
+		c.visited[real] = true
+	}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if c.opts.Filter != nil && path != src {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			logical, err := filepath.Rel(c.root, target)
+			if err != nil {
+				return err
+			}
+			keep, skipDir := c.opts.Filter(logical, fi)
+			if d.IsDir() && skipDir {
+				return filepath.SkipDir
+			}
+			if !d.IsDir() && !keep {
+				return nil
+			}
+		}
+
+		switch {
+		case d.IsDir():
+			if path != src && c.opts.Symlinks == SymlinkDereference {
+				real, err := filepath.EvalSymlinks(path)
+				if err != nil {
+					return err
+				}
+				if c.visited[real] {
+					return filepath.SkipDir
+				}
+				c.visited[real] = true
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+			c.dirs = append(c.dirs, copiedDir{path: target, fi: fi})
+			return nil
+		case d.Type()&fs.ModeSymlink != 0:
+			return c.copySymlink(target, path)
+		case d.Type().IsRegular():
+			if c.deferFiles {
+				c.files = append(c.files, copyJob{dst: target, src: path})
+				return nil
+			}
+			return c.copyFile(target, path)
+		default:
+			return nil
+		}
+	})
+}
+
+func (c *dirCopier) copySymlink(dst, src string) error {
+	switch c.opts.Symlinks {
+	case SymlinkCopy:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := os.Symlink(link, dst); err != nil {
+			return err
+		}
+		if c.opts.PreserveOwner {
+			fi, err := os.Lstat(src)
+			if err != nil {
+				return err
+			}
+			return copyOwner(func(uid, gid int) error { return os.Lchown(dst, uid, gid) }, fi, c.opts.StrictOwner)
+		}
+		return nil
+	case SymlinkDereference:
+		fi, err := os.Stat(src)
+		if err != nil {
+			return fmt.Errorf("fio: copy dir: dereference %s: %w", src, err)
+		}
+		if fi.IsDir() {
+			real, err := filepath.EvalSymlinks(src)
+			if err != nil {
+				return err
+			}
+			return c.copyTree(dst, real)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		return c.copyFile(dst, src)
+	default:
+		return nil
+	}
+}
+
+// copyFile copies one regular file of the tree. Each file is fsynced, but
+// its directory is synced once in finishDirs rather than after every file.
+func (c *dirCopier) copyFile(dst, src string) error {
+	sync := syncFile
+	if c.opts.NoSync {
+		sync = syncNone
+	}
+	_, err := copyFileSync(dst, src, c.opts, nil, sync)
+	return err
+}
+
+// finishDirs applies directory metadata deepest-first, after all contents
+// are in place, so read-only modes and preserved times are not disturbed.
+// Unless NoSync is set, each directory is first fsynced once so the entries
+// of the files copied into it are durable.
+func (c *dirCopier) finishDirs() error {
+	for i := len(c.dirs) - 1; i >= 0; i-- {
+		dir := c.dirs[i]
+		if !c.opts.NoSync {
+			if err := syncDir(dir.path); err != nil {
+				return err
+			}
+		}
+		if c.opts.PreserveOwner {
+			chown := func(uid, gid int) error { return os.Chown(dir.path, uid, gid) }
+			if err := copyOwner(chown, dir.fi, c.opts.StrictOwner); err != nil {
+				return err
+			}
+		}
+		if err := os.Chmod(dir.path, dir.fi.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := applyCopyTimes(dir.path, dir.fi, c.opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// progressInterval is how many bytes CopyProgress copies between callbacks.
+const progressInterval = 1 << 20 // 1MB
+
+// ProgressFunc receives the bytes copied so far and the expected total.
+type ProgressFunc func(copied, total int64)
+
+// CopyOptions controls what CopyPreserve carries over from the source
+// besides its contents and permission bits.
+type CopyOptions struct {
+	// PreserveModTime copies the source modification time.
+	PreserveModTime bool
+	// PreserveAccessTime copies the source access time where the platform
+	// exposes it; elsewhere the destination access time is left alone.
+	PreserveAccessTime bool
+	// PreserveOwner chowns the destination to the source uid/gid on Unix.
+	// Permission errors are ignored unless StrictOwner is set.
+	PreserveOwner bool
+	// StrictOwner makes PreserveOwner fail on EPERM, and on platforms
+	// without file ownership, instead of skipping silently.
+	StrictOwner bool
+	// NoSync skips the fsync of the destination file and its directory.
+	// By default a copy is durable once it returns; CopyDir fsyncs each
+	// file and then each directory once, not once per file.
+	NoSync bool
+	// Symlinks selects how CopyDir treats symbolic links. The default,
+	// SymlinkSkip, leaves them out of the copy.
+	Symlinks SymlinkMode
+	// Filter, if set, is asked about every entry below the CopyDir source.
+	// See CopyFilter.
+	Filter CopyFilter
+	// Reflink tries a copy-on-write clone first and falls back to a byte
+	// copy when the filesystem cannot clone. See CopyReflink.
+	Reflink bool
+}
+
+// CopyFilter decides which entries CopyDir copies. path is relative to the
+// source root and info describes the entry itself (symlinks are not
+// followed). For files and symlinks, returning copy=false drops the entry.
+// For directories copy is ignored; returning skipDir prunes the directory
+// and everything beneath it, like filepath.SkipDir.
+type CopyFilter func(path string, info fs.FileInfo) (copy bool, skipDir bool)
+
+// GlobFilter builds a CopyFilter from filepath.Match patterns. Each pattern
+// is tried against both the entry's relative path and its base name, so
+// "node_modules" and "*.iso" match at any depth. Directories matching an
+// exclude pattern are pruned. When include is non-empty, files (and
+// symlinks) must also match one of its patterns; directories are always
+// descended into unless excluded. Malformed patterns never match.
+func GlobFilter(include, exclude []string) CopyFilter {
+	match := func(patterns []string, path string) bool {
+		base := filepath.Base(path)
+		for _, p := range patterns {
+			if ok, _ := filepath.Match(p, path); ok {
+				return true
+			}
+			if ok, _ := filepath.Match(p, base); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return func(path string, info fs.FileInfo) (bool, bool) {
+		if match(exclude, path) {
+			return false, info.IsDir()
+		}
+		if info.IsDir() || len(include) == 0 {
+			return true, false
+		}
+		return match(include, path), false
+	}
+}
+
+// SymlinkMode selects how CopyDir handles symbolic links in the source tree.
+type SymlinkMode int
+
+const (
+	// SymlinkSkip omits symlinks from the copy.
+	SymlinkSkip SymlinkMode = iota
+	// SymlinkCopy recreates each link with its original target text, so
+	// relative links stay relative and absolute links stay absolute.
+	// Dangling links are copied as is.
+	SymlinkCopy
+	// SymlinkDereference copies what each link points to. Linked directories
+	// are copied recursively, each at most once; a dangling link is an error.
+	SymlinkDereference
+)
+
+// String returns the mode name.
+func (m SymlinkMode) String() string {
+	switch m {
+	case SymlinkSkip:
+		return "skip"
+	case SymlinkCopy:
+		return "copy"
+	case SymlinkDereference:
+		return "dereference"
+	default:
+		return fmt.Sprintf("SymlinkMode(%d)", int(m))
+	}
+}
+
+// CopyPreserve copies the file src to dst and applies the metadata selected by
+// opts once the contents are written. Timestamps are set with os.Chtimes, so
+// a destination filesystem with coarser resolution (e.g. 2s on FAT, 1s on
+// some network mounts) stores them truncated; compare with that tolerance.
+func CopyPreserve(dst, src string, opts CopyOptions) (int64, error) {
+	return copyFile(dst, src, opts, nil)
+}
+
+// errNotCloned reports that cloneTemp could not clone on this platform or
+// filesystem.
+var errNotCloned = errors.New("fio: reflink not supported")
+
+// cloneTemp creates a temp file in dir, named from pattern like
+// os.CreateTemp, that is a copy-on-write clone of src, and returns it open
+// for writing. It fails with errNotCloned when src cannot be cloned there.
+func cloneTemp(dir, pattern string, src *os.File) (*os.File, error) {
+	tmp, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	name := tmp.Name()
+	f, err := cloneInto(tmp, src)
+	if err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(name)
+		return nil, fmt.Errorf("%w: %v", errNotCloned, err)
+	}
+	return f, nil
+}
+
+// CopyReflink clones src to dst with a copy-on-write reflink (FICLONE on
+// Linux: Btrfs, XFS, bcachefs; clonefile on macOS: APFS), which is
+// near-instant and shares storage until either file changes. It never falls
+// back to a byte copy: when the platform or filesystem cannot clone
+// (including across filesystems) it returns (false, nil) and leaves dst
+// untouched. Use CopyOptions.Reflink
+// for clone-or-copy. On success dst is replaced atomically with src's mode.
+func CopyReflink(dst, src string) (cloned bool, err error) {
+	if strings.TrimSpace(dst) == "" || strings.TrimSpace(src) == "" {
+		return false, ErrEmptyPath
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !fi.Mode().IsRegular() {
+		return false, fmt.Errorf("fio: copy %s: not a regular file", src)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return false, err
+	}
+	tmp, err := cloneTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp", in)
+	if errors.Is(err, errNotCloned) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := commitTemp(tmp, dst, fi.Mode().Perm(), nil, nil); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// CopyN copies length bytes of src starting at offset into dst, or everything
+// from offset to EOF when length <= 0. An offset at or past EOF produces an
+// empty dst. Parent dirs are created and dst gets src's permission bits; it
+// is written via a temp file and rename, so dst may be src itself. It
+// returns the number of bytes written.
+func CopyN(dst, src string, offset, length int64) (int64, error) {
+	if strings.TrimSpace(dst) == "" || strings.TrimSpace(src) == "" {
+		return 0, ErrEmptyPath
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("fio: copy %s: negative offset %d", src, offset)
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if length <= 0 {
+		length = math.MaxInt64 - offset
+	}
+
+	var n int64
+	err = writeFileFunc(dst, fi.Mode().Perm(), true, func(w io.Writer) error {
+		var err error
+		n, err = io.Copy(w, io.NewSectionReader(in, offset, length))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// CopySparse copies the regular file src to dst without filling in holes,
+// so a sparse VM image or database file stays sparse. It returns the
+// logical size copied, holes included. Parent dirs are created and dst gets
+// src's permission bits; it is written via a temp file and rename.
+//
+// On Linux the data regions are found with SEEK_DATA/SEEK_HOLE and copied
+// as is, so only allocated extents are read. Elsewhere, or where the
+// filesystem does not report holes, the whole file is read and every
+// all-zero 4KB block is skipped in dst instead; that reads holes too, and
+// also makes zero blocks that were allocated in src sparse in dst, which
+// trades the space reservation for disk savings (writes into them later
+// may fragment or hit ENOSPC). Holes are only kept if dst's filesystem
+// supports sparse files.
+func CopySparse(dst, src string) (int64, error) {
+	if strings.TrimSpace(dst) == "" || strings.TrimSpace(src) == "" {
+		return 0, ErrEmptyPath
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		return 0, fmt.Errorf("fio: copy %s: not a regular file", src)
+	}
+	if same, err := SameFile(dst, src); err != nil {
+		return 0, err
+	} else if same {
+		return fi.Size(), nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return 0, err
+	}
+
+	size := fi.Size()
+	err = writeFileAtomicTo(dst, fi.Mode().Perm(), func(f *os.File) error {
+		buf := make([]byte, 64<<10)
+		if err := copyDataRegions(f, in, size, buf); err != nil {
+			if !errors.Is(err, errors.ErrUnsupported) {
+				return err
+			}
+			if err := copyNonZero(f, in, size, buf); err != nil {
+				return err
+			}
+		}
+		return f.Truncate(size) // trailing hole
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// copyDataRegions copies the data regions of in below size to the same
+// offsets in f. It fails with errors.ErrUnsupported when holes cannot be
+// found; what it wrote by then is rewritten by copyNonZero.
+func copyDataRegions(f, in *os.File, size int64, buf []byte) error {
+	for off := int64(0); off < size; {
+		start, end, err := nextDataRegion(in, off)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		end = min(end, size)
+		if start >= end {
+			return nil
+		}
+		if _, err := io.CopyBuffer(io.NewOffsetWriter(f, start), io.NewSectionReader(in, start, end-start), buf); err != nil {
+			return err
+		}
+		off = end
+	}
+	return nil
+}
+
+// sparseBlock is the granularity at which copyNonZero detects zeros.
+const sparseBlock = 4 << 10
+
+// copyNonZero reads in up to size and writes each run of blocks that are
+// not all zero to the same offsets in f, leaving the rest as holes.
+func copyNonZero(f, in *os.File, size int64, buf []byte) error {
+	zero := make([]byte, sparseBlock)
+	for off := int64(0); off < size; {
+		n, err := in.ReadAt(buf[:min(int64(len(buf)), size-off)], off)
+		if n == 0 && err != nil {
+			if err == io.EOF {
+				return nil // shrank while copying
+			}
+			return err
+		}
+		chunk := buf[:n]
+		for i := 0; i < len(chunk); {
+			j := i
+			for j < len(chunk) {
+				b := chunk[j:min(j+sparseBlock, len(chunk))]
+				if bytes.Equal(b, zero[:len(b)]) {
+					break
+				}
+				j += len(b)
+			}
+			if j > i {
+				if _, err := f.WriteAt(chunk[i:j], off+int64(i)); err != nil {
+					return err
+				}
+				i = j
+				continue
+			}
+			i = min(i+sparseBlock, len(chunk))
+		}
+		off += int64(n)
+	}
+	return nil
+}
+
+// CopyProgress copies the file src to dst like a plain file copy, calling fn
+// about every 1MB and once more with copied == total on success. The
+// destination gets the source's permission bits and parent directories are
+// created. Copying a file onto itself is a no-op.
+func CopyProgress(dst, src string, fn ProgressFunc) (int64, error) {
+	return copyFile(dst, src, CopyOptions{}, fn)
+}
+
+// progressWriter reports throughput to fn while forwarding writes to w.
+type progressWriter struct {
+	w      io.Writer
+	fn     ProgressFunc
+	copied int64
+	total  int64
+	next   int64
+	last   int64 // copied value of the most recent callback
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.copied += int64(n)
+	if p.copied >= p.next {
+		p.fn(p.copied, p.total)
+		p.last = p.copied
+		p.next = p.copied + progressInterval
+	}
+	return n, err
+}
+
+// copyFile copies the regular file src to dst. progress may be nil.
+// The data (or a Reflink clone) goes to a temp file next to dst. Order:
+// write, chown, chmod, set times, fsync, close, rename over dst, fsync
+// parent dir, so a crash cannot leave a short or missing file and a failed
+// copy leaves an existing dst untouched.
+func copyFile(dst, src string, opts CopyOptions, progress ProgressFunc) (int64, error) {
+	sync := syncAll
+	if opts.NoSync {
+		sync = syncNone
+	}
+	return copyFileSync(dst, src, opts, progress, sync)
+}
+
+// copyFileSync is copyFile with the fsyncs chosen by sync.
+func copyFileSync(dst, src string, opts CopyOptions, progress ProgressFunc, sync syncMode) (int64, error) {
+	if strings.TrimSpace(dst) == "" || strings.TrimSpace(src) == "" {
+		return 0, ErrEmptyPath
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		return 0, fmt.Errorf("fio: copy %s: not a regular file", src)
+	}
+	if same, err := SameFile(dst, src); err != nil {
+		return 0, err
+	} else if same {
+		if progress != nil {
+			progress(fi.Size(), fi.Size())
+		}
+		return fi.Size(), nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return 0, err
+	}
+	// meta applies owner, mode and times to the copy before it is synced.
+	meta := func(f *os.File) error {
+		if opts.PreserveOwner {
+			if err := copyOwner(f.Chown, fi, opts.StrictOwner); err != nil {
+				return err
+			}
+		}
+		if err := f.Chmod(fi.Mode().Perm()); err != nil {
+			return err
+		}
+		return applyCopyTimes(f.Name(), fi, opts)
+	}
+
+	dir, pattern := filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp"
+	var tmp *os.File
+	if opts.Reflink {
+		tmp, _ = cloneTemp(dir, pattern, in) // nil when src cannot be cloned
+	}
+	n := fi.Size()
+	var (
+		write func(f *os.File) error
+		pw    *progressWriter
+	)
+	if tmp == nil {
+		if tmp, err = os.CreateTemp(dir, pattern); err != nil {
+			return 0, err
+		}
+		write = func(f *os.File) error {
+			var w io.Writer = f
+			if progress != nil {
+				pw = &progressWriter{w: f, fn: progress, total: fi.Size(), next: progressInterval, last: -1}
+				w = pw
+			}
+			// struct wrappers keep io.CopyBuffer on the buffer path so progress is seen
+			var err error
+			n, err = io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{in}, make([]byte, 64<<10))
+			return err
+		}
+	}
+	if err := commitTempSync(tmp, dst, fi.Mode().Perm(), write, meta, sync); err != nil {
+		return n, err
+	}
+	if pw != nil && (pw.last != n || n != fi.Size()) {
+		progress(n, max(n, fi.Size()))
+	}
+	return n, nil
+}
+
+// copyOwner passes the owner of fi to chown. Without strict, a lack of
+// privilege or platform support is not an error.
+func copyOwner(chown func(uid, gid int) error, fi os.FileInfo, strict bool) error {
+	uid, gid, ok := fileOwner(fi)
+	if !ok {
+		if strict {
+			return fmt.Errorf("fio: preserve owner: %w", errors.ErrUnsupported)
+		}
+		return nil
+	}
+	err := chown(uid, gid)
+	if err != nil && !strict && errors.Is(err, fs.ErrPermission) {
+		return nil
+	}
+	return err
+}
+
+// applyCopyTimes sets the timestamps requested by opts on dst from src's info.
+func applyCopyTimes(dst string, fi os.FileInfo, opts CopyOptions) error {
+	if !opts.PreserveModTime && !opts.PreserveAccessTime {
+		return nil
+	}
+	var atime, mtime time.Time // zero values leave that time unchanged
+	if opts.PreserveModTime {
+		mtime = fi.ModTime()
+	}
+	if opts.PreserveAccessTime {
+		if t, ok := fileAccessTime(fi); ok {
+			atime = t
+		}
+	}
+	if atime.IsZero() && mtime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(dst, atime, mtime)
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                    Move                                    */
+/* -------------------------------------------------------------------------- */
+
+// rename is os.Rename; tests swap it to force the cross-device path.
+var rename = os.Rename
+
+// Move renames the file src to dst, creating dst's parent dirs. When the
+// rename fails because src and dst are on different filesystems it copies
+// instead, keeping mode, times and (when permitted) owner, and removes src
+// only after the copy and its directory entry are fsynced. The copy replaces
+// dst by rename, so if it fails an existing dst is left as it was.
+func Move(dst, src string) error {
+	if strings.TrimSpace(dst) == "" || strings.TrimSpace(src) == "" {
+		return ErrEmptyPath
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	err := rename(src, dst)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+	if fi, serr := os.Lstat(src); serr != nil || !fi.Mode().IsRegular() {
+		return err
+	}
+
+	opts := CopyOptions{PreserveModTime: true, PreserveAccessTime: true, PreserveOwner: true}
+	if _, err := copyFile(dst, src, opts, nil); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// MoveDir renames the directory src to dst, creating dst's parent dirs. When
+// the rename fails because src and dst are on different filesystems it runs
+// CopyDir into a dst that must not yet exist, verifies that every source
+// entry arrived (same type, same size for files), and only then removes src.
+// opts controls what metadata the copy preserves; symlinks are always
+// recreated as links and opts.Filter is ignored so nothing is left behind.
+// If the copy or verification fails, the partial dst is removed and src is
+// kept intact.
+func MoveDir(dst, src string, opts CopyOptions) error {
+	if strings.TrimSpace(dst) == "" || strings.TrimSpace(src) == "" {
+		return ErrEmptyPath
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	err := rename(src, dst)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+	if _, serr := os.Lstat(dst); serr == nil {
+		return fmt.Errorf("fio: move dir %s: %w", dst, fs.ErrExist)
+	}
+
+	opts.Symlinks = SymlinkCopy
+	opts.Filter = nil
+	if err := CopyDir(dst, src, opts); err != nil {
+		_ = os.RemoveAll(dst)
+		return err
+	}
+	if err := verifyCopiedTree(dst, src); err != nil {
+		_ = os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// verifyCopiedTree checks that every entry under src has a counterpart of the
+// same type (and size, for regular files) under dst.
+func verifyCopiedTree(dst, src string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		want, err := d.Info()
+		if err != nil {
+			return err
+		}
+		got, err := os.Lstat(filepath.Join(dst, rel))
+		if err != nil {
+			return fmt.Errorf("fio: move dir: %s not copied: %w", rel, err)
+		}
+		if got.Mode().Type() != want.Mode().Type() {
+			return fmt.Errorf("fio: move dir: %s: type %v not copied", rel, want.Mode().Type())
+		}
+		if want.Mode().IsRegular() && got.Size() != want.Size() {
+			return fmt.Errorf("fio: move dir: %s: copied %d of %d bytes", rel, got.Size(), want.Size())
+		}
+		return nil
+	})
+}
+
+func isCrossDevice(err error) bool {
+	return errors.Is(err, errCrossDevice)
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                   Remove                                   */
+/* -------------------------------------------------------------------------- */
+
+// RemoveMatchingOption configures RemoveMatching.
+type RemoveMatchingOption func(*removeMatchingConfig)
+
+type removeMatchingConfig struct {
+	removeAll bool
+}
+
+// WithRemoveAll lets RemoveMatching delete non-empty directories with all
+// their contents, like os.RemoveAll. Without it such matches fail and are
+// reported.
+func WithRemoveAll() RemoveMatchingOption {
+	return func(c *removeMatchingConfig) {
+		c.removeAll = true
+	}
+}
+
+// RemoveEmptyDirsOption configures RemoveEmptyDirs.
+type RemoveEmptyDirsOption func(*removeEmptyDirsConfig)
+
+type removeEmptyDirsConfig struct {
+	removeRoot bool
+}
+
+// WithRemoveRoot lets RemoveEmptyDirs also remove root once it is empty.
+// By default root is kept.
+func WithRemoveRoot() RemoveEmptyDirsOption {
+	return func(c *removeEmptyDirsConfig) {
+		c.removeRoot = true
+	}
+}
+
+// RemoveOlderThanOption configures RemoveOlderThan.
+type RemoveOlderThanOption func(*removeOlderThanConfig)
+
+type removeOlderThanConfig struct {
+	recursive  bool
+	pattern    string
+	pruneEmpty bool
+}
+
+// WithRecursive makes RemoveOlderThan descend into subdirectories.
+func WithRecursive() RemoveOlderThanOption {
+	return func(c *removeOlderThanConfig) {
+		c.recursive = true
+	}
+}
+
+// WithPattern limits RemoveOlderThan to files whose base name matches the
+// filepath.Match pattern, e.g. "*.log".
+func WithPattern(pattern string) RemoveOlderThanOption {
+	return func(c *removeOlderThanConfig) {
+		c.pattern = pattern
+	}
+}
+
+// WithPruneEmpty makes RemoveOlderThan remove directories left empty by the
+// sweep. The swept directory itself and directories that were already
+// empty are kept.
+func WithPruneEmpty() RemoveOlderThanOption {
+	return func(c *removeOlderThanConfig) {
+		c.pruneEmpty = true
+	}
+}
+
+// RemoveMatching removes every path matching the filepath.Glob pattern and
+// returns how many were removed. Files and empty directories are removed
+// directly; non-empty directories need WithRemoveAll. A failure on one match
+// does not stop the others: all failures are returned joined.
+func RemoveMatching(pattern string, opts ...RemoveMatchingOption) (removed int, err error) {
+	if strings.TrimSpace(pattern) == "" {
+		return 0, ErrEmptyPath
+	}
+	var cfg removeMatchingConfig
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&cfg)
+		}
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return 0, err
+	}
+	var errs []error
+	for _, m := range matches {
+		var rerr error
+		if cfg.removeAll {
+			rerr = os.RemoveAll(m)
+		} else {
+			rerr = os.Remove(m)
+		}
+		if rerr != nil {
+			errs = append(errs, rerr)
+			continue
+		}
+		removed++
+	}
+	return removed, errors.Join(errs...)
+}
+
+// RemoveEmptyDirs removes every directory under root that is empty or
+// becomes empty once its empty subdirectories are gone, and returns how many
+// it removed. Children are handled before parents. Symlinks are not followed
+// and count as content. Root is kept unless WithRemoveRoot is given.
+// Failures are joined and do not stop the walk.
+func RemoveEmptyDirs(root string, opts ...RemoveEmptyDirsOption) (removed int, err error) {
+	if strings.TrimSpace(root) == "" {
+		return 0, ErrEmptyPath
+	}
+	var cfg removeEmptyDirsConfig
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&cfg)
+		}
+	}
+
+	var (
+		dirs []string
+		errs []error
+	)
+	werr := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			errs = append(errs, err)
+			return nil
+		}
+		if d.IsDir() && (path != root || cfg.removeRoot) {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if werr != nil {
+		return 0, werr
+	}
+
+	// WalkDir lists parents before children, so walk the list backwards
+	for i := len(dirs) - 1; i >= 0; i-- {
+		empty, err := isEmptyDir(dirs[i])
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !empty {
+			continue
+		}
+		if err := os.Remove(dirs[i]); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed++
+	}
+	return removed, errors.Join(errs...)
+}
+
+func isEmptyDir(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	if errors.Is(err, io.EOF) {
+		return true, nil
+	}
+	return false, err
+}
+
+// EmptyDir removes everything inside dir but keeps dir itself, so its mode
+// and owner survive. A missing dir is created with mode 0755 (so the result
+// is always an empty directory). Children that cannot be removed do not
+// stop the others; their errors are returned joined.
+func EmptyDir(dir string) error {
+	if strings.TrimSpace(dir) == "" {
+		return ErrEmptyPath
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.MkdirAll(dir, 0o755)
+	}
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RemoveOlderThan removes the regular files in dir whose modification time is
+// more than age ago and returns how many it removed. WithRecursive includes
+// subdirectories, WithPattern filters by base name and WithPruneEmpty removes
+// directories the sweep emptied (they are not counted). Failures, such as a
+// locked file, are joined and do not stop the sweep.
+func RemoveOlderThan(dir string, age time.Duration, opts ...RemoveOlderThanOption) (removed int, err error) {
+	if strings.TrimSpace(dir) == "" {
+		return 0, ErrEmptyPath
+	}
+	var cfg removeOlderThanConfig
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&cfg)
+		}
+	}
+	if cfg.pattern != "" {
+		if _, err := filepath.Match(cfg.pattern, ""); err != nil {
+			return 0, err
+		}
+	}
+	cutoff := time.Now().Add(-age)
+
+	var errs []error
+	touched := make(map[string]bool)
+	werr := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			errs = append(errs, err)
+			return nil
+		}
+		if d.IsDir() {
+			if path != dir && !cfg.recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if cfg.pattern != "" {
+			if ok, _ := filepath.Match(cfg.pattern, d.Name()); !ok {
+				return nil
+			}
+		}
+		fi, err := d.Info()
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		if !fi.ModTime().Before(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		removed++
+		touched[filepath.Dir(path)] = true
+		return nil
+	})
+	if werr != nil {
+		return 0, werr
+	}
+
+	if cfg.pruneEmpty {
+		dirs := make([]string, 0, len(touched))
+		for d := range touched {
+			dirs = append(dirs, d)
+		}
+		// deepest first, so parents see their children already gone
+		sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+		root := filepath.Clean(dir)
+		for _, d := range dirs {
+			for d != root && len(d) > len(root) {
+				empty, err := isEmptyDir(d)
+				if err != nil {
+					if !errors.Is(err, fs.ErrNotExist) {
+						errs = append(errs, err)
+					}
+					break
+				}
+				if !empty {
+					break
+				}
+				if err := os.Remove(d); err != nil {
+					errs = append(errs, err)
+					break
+				}
+				d = filepath.Dir(d)
+			}
+		}
+	}
+	return removed, errors.Join(errs...)
+}
+
+// Shred overwrites the regular file at path with random data passes times
+// (at least once) and then with zeros, fsyncing after every pass, truncates
+// it and removes it. Symlinks are refused so a link's target is never
+// shredded by accident.
+//
+// This is best-effort: on copy-on-write filesystems (Btrfs, ZFS, APFS),
+// journaling data modes, snapshots and flash storage with wear levelling,
+// the old blocks may survive. Use full-disk encryption for real guarantees.
+func Shred(path string, passes int) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	if passes < 1 {
+		passes = 1
+	}
+	lfi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if lfi.Mode()&fs.ModeSymlink != 0 {
+		return fmt.Errorf("fio: shred %s: refusing to shred through a symlink", path)
+	}
+	if !lfi.Mode().IsRegular() {
+		return fmt.Errorf("fio: shred %s: not a regular file", path)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err == nil && !os.SameFile(lfi, fi) {
+		err = fmt.Errorf("fio: shred %s: file changed while opening", path)
+	}
+	if err == nil {
+		err = shredPasses(f, fi.Size(), passes)
+	}
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err := errors.Join(err, f.Close()); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// shredPasses writes passes rounds of random data and one of zeros over the
+// first size bytes of f.
+func shredPasses(f *os.File, size int64, passes int) error {
+	buf := make([]byte, 64<<10)
+	for pass := 0; pass <= passes; pass++ {
+		random := pass < passes
+		if !random {
+			clear(buf)
+		}
+		for off := int64(0); off < size; {
+			chunk := buf[:minInt64(int64(len(buf)), size-off)]
+			if random {
+				if _, err := rand.Read(chunk); err != nil {
+					return err
+				}
+			}
+			n, err := f.WriteAt(chunk, off)
+			if err != nil {
+				return err
+			}
+			off += int64(n)
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                    Walk                                    */
+/* -------------------------------------------------------------------------- */
+
+// WalkFileFunc is called for each file visited by the WalkFiles family.
+// info comes from Lstat, so symlinks are reported, not followed.
+// Returning filepath.SkipAll stops the walk without error.
+type WalkFileFunc func(path string, info fs.FileInfo) error
+
+// WalkFiles calls fn for every non-directory entry under root in lexical
+// order. Directories are traversed but not reported; use WalkDir to see or
+// prune them. Errors reading the tree stop the walk and are returned.
+func WalkFiles(root string, fn WalkFileFunc) error {
+	return WalkFilesContext(context.Background(), root, fn)
+}
+
+// WalkFilesContext is WalkFiles that checks ctx before every entry and stops
+// promptly once it is done. The returned error wraps ctx.Err(), so
+// errors.Is(err, context.Canceled) works at the call site.
+func WalkFilesContext(ctx context.Context, root string, fn WalkFileFunc) error {
+	if strings.TrimSpace(root) == "" {
+		return ErrEmptyPath
+	}
+	if fn == nil {
+		return ErrNilFunc
+	}
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if cerr := ctx.Err(); cerr != nil {
+			return fmt.Errorf("fio: walk cancelled: %w", cerr)
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(path, info)
+	})
+}
+
+// WalkFilesParallel is WalkFiles with fn run on a pool of workers while a
+// single goroutine enumerates the tree; workers <= 0 uses GOMAXPROCS. fn
+// must be safe for concurrent use and files are not reported in any
+// particular order. The first error from fn or the walk stops enumeration,
+// skips queued files and is returned; filepath.SkipAll from fn stops the
+// same way without an error.
+func WalkFilesParallel(root string, workers int, fn WalkFileFunc) error {
+	if strings.TrimSpace(root) == "" {
+		return ErrEmptyPath
+	}
+	if fn == nil {
+		return ErrNilFunc
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	type walkJob struct {
+		path string
+		info fs.FileInfo
+	}
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	jobs := make(chan walkJob, workers)
+	stop := make(chan struct{})
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				select {
+				case <-stop:
+					continue
+				default:
+				}
+				if err := fn(job.path, job.info); err != nil {
+					if errors.Is(err, filepath.SkipAll) {
+						err = nil
+					}
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	werr := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		select {
+		case jobs <- walkJob{path: path, info: info}:
+			return nil
+		case <-stop:
+			return filepath.SkipAll
+		}
+	})
+	if werr != nil {
+		fail(werr)
+	}
+	close(jobs)
+	wg.Wait()
+	return firstErr
+}
+
+// WalkFilesDepth is WalkFiles limited to maxDepth levels below root:
+// 0 visits only root's direct entries, 1 also their children, and so on.
+// A negative maxDepth means unlimited. Directories at the limit are pruned
+// rather than read. Like filepath.WalkDir, a root that is a file is visited
+// itself.
+func WalkFilesDepth(root string, maxDepth int, fn WalkFileFunc) error {
+	if strings.TrimSpace(root) == "" {
+		return ErrEmptyPath
+	}
+	if fn == nil {
+		return ErrNilFunc
+	}
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root && d.IsDir() {
+			return nil
+		}
+		depth, err := walkDepth(root, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if maxDepth >= 0 && depth >= maxDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(path, info)
+	})
+}
+
+// walkDepth returns how many directories separate path from root's direct
+// entries (which are at depth 0).
+func walkDepth(root, path string) (int, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return 0, err
+	}
+	return strings.Count(rel, string(filepath.Separator)), nil
+}
+
+// WalkOption configures the option-taking walk helpers.
+type WalkOption func(*walkConfig)
+
+type walkConfig struct {
+	ignorePatterns []string
+	skipRoot       bool
+	matchPath      bool
+	includeDirs    bool
+}
+
+// WithIgnorePatterns adds gitignore-style patterns that apply from the walk
+// root down, like a global excludes file. .gitignore files found in the tree
+// take precedence over them.
+func WithIgnorePatterns(patterns ...string) WalkOption {
+	return func(c *walkConfig) {
+		c.ignorePatterns = append(c.ignorePatterns, patterns...)
+	}
+}
+
+// WithSkipRoot keeps WalkDirs from reporting root itself.
+func WithSkipRoot() WalkOption {
+	return func(c *walkConfig) {
+		c.skipRoot = true
+	}
+}
+
+// WithMatchPath makes FindFiles match the pattern against the path relative
+// to root (slash-separated, "**" allowed) instead of the base name.
+func WithMatchPath() WalkOption {
+	return func(c *walkConfig) {
+		c.matchPath = true
+	}
+}
+
+// WithIncludeDirs makes FindFiles return matching directories as well.
+func WithIncludeDirs() WalkOption {
+	return func(c *walkConfig) {
+		c.includeDirs = true
+	}
+}
+
+func newWalkConfig(opts []WalkOption) walkConfig {
+	cfg := walkConfig{}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&cfg)
+		}
+	}
+	return cfg
+}
+
+// WalkFilesIgnore is WalkFiles that honours .gitignore files. Each .gitignore
+// applies to its own directory and below, deeper files and later lines win,
+// and "!" negates. Patterns follow gitignore(5): a trailing "/" matches only
+// directories, a pattern with an inner or leading "/" is anchored to its
+// .gitignore's directory, otherwise it matches the name at any depth, and
+// "**" spans directories. As in git, a file inside an ignored directory
+// cannot be re-included, and .git directories are always skipped.
+func WalkFilesIgnore(root string, fn WalkFileFunc, opts ...WalkOption) error {
+	if strings.TrimSpace(root) == "" {
+		return ErrEmptyPath
+	}
+	if fn == nil {
+		return ErrNilFunc
+	}
+	cfg := newWalkConfig(opts)
+	m := &ignoreMatcher{rules: make(map[string][]ignoreRule)}
+	for _, line := range cfg.ignorePatterns {
+		if r, ok := parseIgnoreLine(line, ""); ok {
+			m.global = append(m.global, r)
+		}
+	}
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = ""
+		}
+
+		if rel != "" && m.ignored(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" && rel != "" {
+				return filepath.SkipDir
+			}
+			return m.load(filepath.Join(path, ".gitignore"), rel)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(path, info)
+	})
+}
+
+// ignoreRule is one parsed gitignore line.
+type ignoreRule struct {
+	base    string   // slash path of the .gitignore's dir relative to the walk root
+	segs    []string // pattern split on "/"; unanchored patterns start with "**"
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreMatcher holds the rules of every .gitignore seen so far, by directory.
+type ignoreMatcher struct {
+	global []ignoreRule
+	rules  map[string][]ignoreRule
+}
+
+func (m *ignoreMatcher) load(file, base string) error {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if r, ok := parseIgnoreLine(line, base); ok {
+			m.rules[base] = append(m.rules[base], r)
+		}
+	}
+	return nil
+}
+
+// ignored applies global rules, then each ancestor's .gitignore from the root
+// down; the last matching rule decides.
+func (m *ignoreMatcher) ignored(rel string, isDir bool) bool {
+	ignored := false
+	apply := func(rules []ignoreRule) {
+		for _, r := range rules {
+			if r.match(rel, isDir) {
+				ignored = !r.negate
+			}
+		}
+	}
+	apply(m.global)
+	apply(m.rules[""])
+	for i := 0; i < len(rel); i++ {
+		if rel[i] == '/' {
+			apply(m.rules[rel[:i]])
+		}
+	}
+	return ignored
+}
+
+func (r ignoreRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+	return matchSegments(r.segs, strings.Split(rel, "/"))
+}
+
+// parseIgnoreLine turns one gitignore line into a rule; ok is false for
+// blanks and comments.
+func parseIgnoreLine(line, base string) (ignoreRule, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || line[0] == '#' {
+		return ignoreRule{}, false
+	}
+	r := ignoreRule{base: base}
+	switch {
+	case line[0] == '!':
+		r.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, "\\#"), strings.HasPrefix(line, "\\!"):
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	r.segs = strings.Split(line, "/")
+	if !anchored {
+		r.segs = append([]string{"**"}, r.segs...)
+	}
+	return r, true
+}
+
+// GlobRecursive is filepath.Glob with "**". The pattern is split on "/"
+// (and the OS separator); each segment is matched with path.Match rules
+// ("*" and "?" never cross a separator, "[...]" classes, backslash escapes),
+// and a segment that is exactly "**" matches zero or more directories, so
+// "src/**/*.go" finds src/a.go and src/x/y/b.go. "**" inside a longer
+// segment acts like "*". Leading segments without metacharacters pick the
+// directory to walk; symlinks are not followed and unreadable directories
+// are skipped, as filepath.Glob ignores I/O errors. Results are sorted,
+// deduplicated and use the OS separator. Only malformed patterns error.
+func GlobRecursive(pattern string) ([]string, error) {
+	if strings.TrimSpace(pattern) == "" {
+		return nil, ErrEmptyPath
+	}
+	segs := strings.Split(filepath.ToSlash(pattern), "/")
+	for _, seg := range segs {
+		if _, err := path.Match(seg, ""); err != nil {
+			return nil, filepath.ErrBadPattern
+		}
+	}
+
+	i := 0
+	for i < len(segs) && !strings.ContainsAny(segs[i], "*?[\\") {
+		i++
+	}
+	if i == len(segs) {
+		if _, err := os.Lstat(pattern); err != nil {
+			return nil, nil
+		}
+		return []string{pattern}, nil
+	}
+	base := strings.Join(segs[:i], "/")
+	switch {
+	case i == 0:
+		base = "."
+	case base == "":
+		base = "/"
+	}
+	base = filepath.FromSlash(base)
+	rest := segs[i:]
+	maxDepth := -1
+	if !slices.Contains(rest, "**") {
+		maxDepth = len(rest)
+	}
+
+	var matches []string
+	_ = filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if d != nil && d.IsDir() && p != base {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if p == base {
+			return nil
+		}
+		rel, err := filepath.Rel(base, p)
+		if err != nil {
+			return nil
+		}
+		name := strings.Split(filepath.ToSlash(rel), "/")
+		if matchSegments(rest, name) {
+			matches = append(matches, p)
+		}
+		if d.IsDir() && maxDepth >= 0 && len(name) >= maxDepth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	slices.Sort(matches)
+	return slices.Compact(matches), nil
+}
+
+// matchSegments matches slash-split name against slash-split pat, where each
+// segment is a path.Match pattern and a "**" segment matches zero or more
+// whole segments.
+func matchSegments(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for len(pat) > 1 && pat[1] == "**" {
+				pat = pat[1:]
+			}
+			if len(pat) == 1 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pat[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// WalkDirs is the inverse of WalkFiles: fn is called for every directory
+// under root, root first unless WithSkipRoot is given. Returning
+// filepath.SkipDir prunes that directory; filepath.SkipAll ends the walk.
+func WalkDirs(root string, fn WalkFileFunc, opts ...WalkOption) error {
+	if strings.TrimSpace(root) == "" {
+		return ErrEmptyPath
+	}
+	if fn == nil {
+		return ErrNilFunc
+	}
+	cfg := newWalkConfig(opts)
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || (cfg.skipRoot && path == root) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(path, info)
+	})
+}
+
+// FindFiles walks root and returns every file whose base name matches the
+// path.Match pattern, like find root -name pattern. WithMatchPath matches
+// the relative path instead and WithIncludeDirs also returns directories;
+// root itself is never returned. Results are in lexical walk order.
+func FindFiles(root, pattern string, opts ...WalkOption) ([]string, error) {
+	if strings.TrimSpace(root) == "" {
+		return nil, ErrEmptyPath
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, filepath.ErrBadPattern
+	}
+	cfg := newWalkConfig(opts)
+	segs := strings.Split(pattern, "/")
+
+	var found []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root || (d.IsDir() && !cfg.includeDirs) {
+			return nil
+		}
+		var ok bool
+		if cfg.matchPath {
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			ok = matchSegments(segs, strings.Split(filepath.ToSlash(rel), "/"))
+		} else {
+			ok, _ = path.Match(pattern, d.Name())
+		}
+		if ok {
+			found = append(found, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// WalkDir calls fn for every entry under root, directories included and root
+// first, in lexical order. It is built on filepath.WalkDir, so entries are
+// not stat'ed unless fn asks d.Info(). Returning filepath.SkipDir from a
+// directory prunes it; from a file it skips the rest of that file's
+// directory. filepath.SkipAll stops the walk without error.
+func WalkDir(root string, fn func(path string, d fs.DirEntry) error) error {
+	if strings.TrimSpace(root) == "" {
+		return ErrEmptyPath
+	}
+	if fn == nil {
+		return ErrNilFunc
+	}
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return fn(path, d)
+	})
+}
+
+/* -------------------------------------------------------------------------- */
+/*                             Directory Listing                              */
+/* -------------------------------------------------------------------------- */
+
+// DirEntryLess orders directory entries for ListDirSorted.
+type DirEntryLess func(a, b fs.DirEntry) bool
+
+var (
+	// SortByName orders entries by name, byte-wise.
+	SortByName DirEntryLess = func(a, b fs.DirEntry) bool {
+		return a.Name() < b.Name()
+	}
+	// SortBySize orders entries by size, smallest first, then by name.
+	SortBySize DirEntryLess = func(a, b fs.DirEntry) bool {
+		sa, sb := entrySize(a), entrySize(b)
+		if sa != sb {
+			return sa < sb
+		}
+		return a.Name() < b.Name()
+	}
+	// SortByModTime orders entries by modification time, oldest first, then by name.
+	SortByModTime DirEntryLess = func(a, b fs.DirEntry) bool {
+		ta, tb := entryModTime(a), entryModTime(b)
+		if !ta.Equal(tb) {
+			return ta.Before(tb)
+		}
+		return a.Name() < b.Name()
+	}
+)
+
+// ListDirSorted reads the entries of dir (not recursively) and sorts them
+// with less, keeping the read order for ties. The returned entries cache
+// their Info, so size and time comparisons stat each entry only once.
+func ListDirSorted(dir string, less DirEntryLess) ([]fs.DirEntry, error) {
+	if strings.TrimSpace(dir) == "" {
+		return nil, ErrEmptyPath
+	}
+	if less == nil {
+		return nil, ErrNilFunc
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	list, err := f.ReadDir(-1)
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, len(list))
+	for i, e := range list {
+		entries[i] = &cachedDirEntry{DirEntry: e}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return less(entries[i], entries[j]) })
+	return entries, nil
+}
+
+// ListDirSortedByName is ListDirSorted with SortByName.
+func ListDirSortedByName(dir string) ([]fs.DirEntry, error) {
+	return ListDirSorted(dir, SortByName)
+}
+
+// ListDirFiltered returns the entries of dir (not recursively), sorted by
+// name, for which keep returns true.
+func ListDirFiltered(dir string, keep func(fs.DirEntry) bool) ([]fs.DirEntry, error) {
+	if strings.TrimSpace(dir) == "" {
+		return nil, ErrEmptyPath
+	}
+	if keep == nil {
+		return nil, ErrNilFunc
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	out := entries[:0]
+	for _, e := range entries {
+		if keep(e) {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// ListFiles returns the non-directory entries of dir, sorted by name.
+// Symlinks are included and not followed, matching WalkFiles.
+func ListFiles(dir string) ([]fs.DirEntry, error) {
+	return ListDirFiltered(dir, func(e fs.DirEntry) bool { return !e.IsDir() })
+}
+
+// ListSubdirs returns the directory entries of dir, sorted by name.
+func ListSubdirs(dir string) ([]fs.DirEntry, error) {
+	return ListDirFiltered(dir, fs.DirEntry.IsDir)
+}
+
+// cachedDirEntry memoizes Info so sorting does not stat repeatedly.
+type cachedDirEntry struct {
+	fs.DirEntry
+	once sync.Once
+	info fs.FileInfo
+	err  error
+}
+
+func (e *cachedDirEntry) Info() (fs.FileInfo, error) {
+	e.once.Do(func() {
+		e.info, e.err = e.DirEntry.Info()
+	})
+	return e.info, e.err
+}
+
+// entrySize returns the entry's size, or 0 if it cannot be stat'ed.
+func entrySize(e fs.DirEntry) int64 {
+	fi, err := e.Info()
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// entryModTime returns the entry's mtime, or the zero time if it cannot be stat'ed.
+func entryModTime(e fs.DirEntry) time.Time {
+	fi, err := e.Info()
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                   Paths                                    */
+/* -------------------------------------------------------------------------- */
+
+// ExpandHome replaces a leading "~" with the current user's home directory
+// (os.UserHomeDir) and a leading "~name" with that user's home when the
+// account can be looked up; unknown users are left as is. Only "~" at the
+// very start followed by the end of the path or a separator is expanded, so
+// "a/~/b" and "~foo.txt" for a missing user are unchanged.
+func ExpandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~") {
+		return path, nil
+	}
+	name, rest := path[1:], ""
+	if i := strings.IndexAny(name, `/`+string(filepath.Separator)); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
+
+	var home string
+	if name == "" {
+		h, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		home = h
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return path, nil
+		}
+		home = u.HomeDir
+	}
+	if rest == "" {
+		return home, nil
+	}
+	return strings.TrimSuffix(home, string(filepath.Separator)) + rest, nil
+}
+
+// ExpandPath prepares a user-supplied path in three steps: os.ExpandEnv
+// replaces $VAR and ${VAR} (undefined variables become empty), then
+// ExpandHome expands a leading "~" (so a variable may itself yield "~/..."),
+// then filepath.Clean tidies the result. A path that is or expands to the
+// empty string returns ErrEmptyPath.
+func ExpandPath(path string) (string, error) {
+	if strings.TrimSpace(path) == "" {
+		return "", ErrEmptyPath
+	}
+	expanded, err := ExpandHome(os.ExpandEnv(path))
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(expanded) == "" {
+		return "", ErrEmptyPath
+	}
+	return filepath.Clean(expanded), nil
+}
+
+// ChangeExt replaces the final extension of path, as reported by
+// filepath.Ext, with newExt; a missing leading dot is added, and an empty
+// newExt removes the extension. "archive.tar.gz" only has ".gz" replaced.
+// A path without an extension gets newExt appended; a dotfile such as
+// ".bashrc" counts as having no extension.
+func ChangeExt(path, newExt string) string {
+	if newExt != "" && !strings.HasPrefix(newExt, ".") {
+		newExt = "." + newExt
+	}
+	ext := filepath.Ext(path)
+	if ext == filepath.Base(path) {
+		ext = "" // dotfile
+	}
+	return path[:len(path)-len(ext)] + newExt
+}
+
+// CompoundExts lists the multi-part extensions SplitExt keeps together.
+// Matching is case-insensitive. Change it at init time, not concurrently
+// with SplitExt.
+var CompoundExts = []string{".tar.gz", ".tar.bz2", ".tar.xz", ".tar.zst"}
+
+// SplitExt splits path into stem and extension, treating the longest
+// matching suffix in CompoundExts as one extension: "dir/file.tar.gz" gives ("dir/file",
+// ".tar.gz"). Other paths split at filepath.Ext, and dotfiles like ".bashrc"
+// have no extension. stem+ext always equals path.
+func SplitExt(path string) (stem, ext string) {
+	base := filepath.Base(path)
+	lower := strings.ToLower(base)
+	longest := 0
+	for _, c := range CompoundExts {
+		if len(c) > longest && len(base) > len(c) && strings.HasSuffix(lower, strings.ToLower(c)) {
+			longest = len(c)
+		}
+	}
+	if longest > 0 {
+		n := len(path) - longest
+		return path[:n], path[n:]
+	}
+	ext = filepath.Ext(path)
+	if ext == base {
+		ext = "" // dotfile
+	}
+	return path[:len(path)-len(ext)], ext
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                   Links                                    */
+/* -------------------------------------------------------------------------- */
+
+// SymlinkForce points link at target, replacing whatever link is now
+// without a moment where it is missing: the new link is created under a
+// temporary name next to link and renamed over it. An existing symlink or
+// regular file at link is replaced; an existing directory is not, and the
+// rename error is returned. Useful for blue/green "current" pointers.
+func SymlinkForce(target, link string) error {
+	if strings.TrimSpace(target) == "" || strings.TrimSpace(link) == "" {
+		return ErrEmptyPath
+	}
+	dir, base := filepath.Split(link)
+	var tmp string
+	for attempt := 0; ; attempt++ {
+		var rnd [6]byte
+		if _, err := rand.Read(rnd[:]); err != nil {
+			return err
+		}
+		tmp = filepath.Join(dir, "."+base+"."+hex.EncodeToString(rnd[:])+".tmp")
+		err := os.Symlink(target, tmp)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) || attempt >= 10 {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// EvalSymlinks resolves every symlink in path, hop after hop, and returns
+// the cleaned real path; it wraps filepath.EvalSymlinks. A relative path
+// gives a relative result. On Windows, directory junctions (mount points)
+// are not symlinks and are left unresolved, as filepath.EvalSymlinks does
+// since Go 1.23.
+func EvalSymlinks(path string) (string, error) {
+	if strings.TrimSpace(path) == "" {
+		return "", ErrEmptyPath
+	}
+	return filepath.EvalSymlinks(path)
+}
+
+// IsSymlinkChainBroken reports whether path is a symlink whose chain does not
+// end at an existing file: a dangling target, or a loop. Paths that are not
+// symlinks report false; a missing path returns its Lstat error. A chain
+// that cannot be followed for lack of permission is not treated as broken
+// and the error is returned. On Windows, junctions are not symlinks and
+// report false.
+func IsSymlinkChainBroken(path string) (bool, error) {
+	if strings.TrimSpace(path) == "" {
+		return false, ErrEmptyPath
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return false, err
+	}
+	if fi.Mode()&fs.ModeSymlink == 0 {
+		return false, nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                   Append                                   */
+/* -------------------------------------------------------------------------- */
+
+var errLockWouldBlock = errors.New("fio: lock would block")
+
+// AppendLocked appends data to path under an exclusive advisory lock so
+// concurrent appenders (including other processes) don't interleave.
+// The file and parent dirs are created if missing.
+//
+// The lock is flock on Unix and LockFileEx on Windows. It is advisory on Unix:
+// only writers that also lock are serialized. Where locking is unsupported
+// (e.g. some network filesystems), the append proceeds without a lock.
+func AppendLocked(path string, data []byte, perm os.FileMode) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f, true, true); err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	} else {
+		defer unlockFile(f)
+	}
+
+	_, err = f.Write(data)
+	return err
+}
+
+// AppendLines appends lines to path with a single open, adding "\n" to any
+// line that does not already end with one. The file and parent dirs are
+// created if missing.
+func AppendLines(path string, lines []string, perm os.FileMode) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, perm)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(f)
+	for _, line := range lines {
+		if _, err = bw.WriteString(line); err != nil {
+			break
+		}
+		if !strings.HasSuffix(line, "\n") {
+			if err = bw.WriteByte('\n'); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	return errors.Join(err, f.Close())
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                  Truncate                                  */
+/* -------------------------------------------------------------------------- */
+
+// TruncateOption configures Truncate and Grow.
+type TruncateOption func(*truncateConfig)
+
+type truncateConfig struct {
+	create bool
+	perm   os.FileMode
+}
+
+// WithCreate makes Truncate and Grow create path, and its parent dirs, with
+// perm when it is missing, instead of failing with fs.ErrNotExist.
+func WithCreate(perm os.FileMode) TruncateOption {
+	return func(c *truncateConfig) {
+		c.create = true
+		c.perm = perm
+	}
+}
+
+// Truncate sets the size of the file at path to size, dropping any bytes
+// past it. Growing a file zero-extends it: reads of the new range return
+// zeros, and on most filesystems it is a sparse hole that takes no disk
+// space until written. A negative size fails with ErrInvalidSize.
+func Truncate(path string, size int64, opts ...TruncateOption) error {
+	return truncateFile(path, size, false, opts)
+}
+
+// Grow is Truncate that only extends: if the file is already size bytes or
+// larger it is left untouched, so a wrong size can never cut data off.
+func Grow(path string, size int64, opts ...TruncateOption) error {
+	return truncateFile(path, size, true, opts)
+}
+
+func truncateFile(path string, size int64, growOnly bool, opts []TruncateOption) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	if size < 0 {
+		return ErrInvalidSize
+	}
+	var cfg truncateConfig
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&cfg)
+		}
+	}
+
+	flag := os.O_WRONLY
+	if cfg.create {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(path, flag, cfg.perm)
+	if err != nil {
+		return err
+	}
+	if growOnly {
+		fi, err := f.Stat()
+		if err != nil || fi.Size() >= size {
+			return errors.Join(err, f.Close())
+		}
+	}
+	return errors.Join(f.Truncate(size), f.Close())
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                Preallocate                                 */
+/* -------------------------------------------------------------------------- */
+
+// Preallocate reserves disk space for the first size bytes of the file at
+// path, creating it (mode 0644; parent dirs must exist) if missing, so later
+// writes into that range cannot fail with ENOSPC and the file is laid out
+// with little fragmentation. The file is extended to size if shorter; the
+// new range reads as zeros and existing data is kept. A file that is already
+// size bytes or larger is left as is.
+//
+// It uses fallocate on Linux, F_PREALLOCATE on macOS, and on Windows sets
+// the end of file, which allocates clusters on NTFS. Elsewhere, or on a
+// filesystem without support, it fails with an error matching
+// errors.ErrUnsupported; use Grow there if only the size matters. Save
+// already preallocates from the source's size hint, so it is not needed
+// before saving a download.
+func Preallocate(path string, size int64) error {
+	if strings.TrimSpace(path) == "" {
+		return ErrEmptyPath
+	}
+	if size < 0 {
+		return ErrInvalidSize
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.Size() >= size {
+		return errors.Join(err, f.Close())
+	}
+	return errors.Join(preallocate(f, size), f.Close())
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                 File Locks                                 */
+/* -------------------------------------------------------------------------- */
+
+// ErrLocked is returned by the TryFileLock variants when the lock is held
+// elsewhere.
+var ErrLocked = errors.New("fio: file is locked")
+
+// Lock is an advisory lock on a file, held through an open handle until
+// Unlock. It is not safe for concurrent use.
+//
+// On Unix the lock is flock: it is advisory (only processes that also lock
+// are excluded; plain reads and writes go through), belongs to the open
+// file, and is released by the kernel when the process exits. On Windows it
+// is LockFileEx over the whole file: it is mandatory, so while an exclusive
+// lock is held other handles cannot read or write the file either, and a
+// shared lock blocks writes. Put the lock on a dedicated lock file rather
+// than the data itself for the same behavior everywhere. Where locking is
+// unsupported, acquiring returns errors.ErrUnsupported.
+type Lock struct {
+	f    *os.File
+	path string
+}
+
+// FileLock opens path (creating it with mode 0644 if missing; parent
+// directories must exist) and blocks until it holds an exclusive lock.
+func FileLock(path string) (*Lock, error) {
+	return openLock(path, true, true)
+}
+
+// TryFileLock is FileLock without waiting: it returns ErrLocked if another
+// lock is held on path.
+func TryFileLock(path string) (*Lock, error) {
+	return openLock(path, true, false)
+}
+
+// FileLockShared blocks until it holds a shared (read) lock on path. Any
+// number of shared locks can be held at once; they exclude exclusive locks.
+func FileLockShared(path string) (*Lock, error) {
+	return openLock(path, false, true)
+}
+
+// TryFileLockShared is FileLockShared without waiting: it returns ErrLocked
+// if an exclusive lock is held on path.
+func TryFileLockShared(path string) (*Lock, error) {
+	return openLock(path, false, false)
+}
+
+func openLock(path string, exclusive, block bool) (*Lock, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, ErrEmptyPath
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f, exclusive, block); err != nil {
+		_ = f.Close()
+		if errors.Is(err, errLockWouldBlock) {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	return &Lock{f: f, path: path}, nil
+}
+
+// Path returns the locked file's path.
+func (l *Lock) Path() string {
+	return l.path
+}
+
+// Unlock releases the lock and closes the file handle. The lock file itself
+// is left in place. Calling Unlock again is a no-op.
+func (l *Lock) Unlock() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	f := l.f
+	l.f = nil
+	return errors.Join(unlockFile(f), f.Close())
+}
+
+// WithFileLock holds an exclusive lock on path while fn runs and releases it
+// afterwards, also when fn returns an error or panics. fn's error is
+// returned, joined with any error from releasing the lock.
+func WithFileLock(path string, fn func() error) error {
+	return WithFileLockContext(context.Background(), path, fn)
+}
+
+// WithFileLockContext is WithFileLock that gives up waiting for the lock
+// once ctx is done; the returned error then wraps ctx.Err(). The lock is
+// polled with a backoff capped at lockPollMax, so a release is noticed
+// within that interval. ctx is not consulted once fn is running.
+func WithFileLockContext(ctx context.Context, path string, fn func() error) (err error) {
+	if fn == nil {
+		return ErrNilFunc
+	}
+	lock, err := waitFileLock(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, lock.Unlock())
+	}()
+	return fn()
+}
+
+const (
+	lockPollMin = 5 * time.Millisecond
+	lockPollMax = 200 * time.Millisecond
+)
+
+func waitFileLock(ctx context.Context, path string) (*Lock, error) {
+	if ctx.Done() == nil {
+		return FileLock(path)
+	}
+	delay := lockPollMin
+	for {
+		if cerr := ctx.Err(); cerr != nil {
+			return nil, fmt.Errorf("fio: waiting for lock: %w", cerr)
+		}
+		lock, err := TryFileLock(path)
+		if !errors.Is(err, ErrLocked) {
+			return lock, err
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, fmt.Errorf("fio: waiting for lock: %w", ctx.Err())
+		case <-t.C:
+		}
+		delay = min(delay*2, lockPollMax)
+	}
+}
+
+/* -------------------------------------------------------------------------- */
+/*                        DownloadReaderCloser helper                          */
+/* -------------------------------------------------------------------------- */
+
+// DownloadReaderCloser is a convenience interface for a read-only stream
+// that also supports Close.
+type DownloadReaderCloser interface {
+	io.Reader
+	io.Closer
+}
+
+type downloadReaderCloser struct {
+	reader            io.ReadCloser
+	cleanup           func() error
+	additionalCleanup func()
+}
+
+func (d *downloadReaderCloser) Read(p []byte) (int, error) {
+	if d.reader == nil {
+		return 0, io.ErrClosedPipe
+	}
+	return d.reader.Read(p)
+}
+
+func (d *downloadReaderCloser) Close() error {
+	var errs error
+
+	if d.reader != nil {
+		errs = errors.Join(errs, d.reader.Close())
+		d.reader = nil
+	}
+
+	if d.cleanup != nil {
+		errs = errors.Join(errs, d.cleanup())
+		d.cleanup = nil
+	}
+
+	if d.additionalCleanup != nil {
+		d.additionalCleanup()
+		d.additionalCleanup = nil
+	}
+
+	return errs
+}
+
+// NewDownloadReaderCloser wraps a Source as a DownloadReaderCloser.
+func NewDownloadReaderCloser(src Source, cleanup ...func()) (DownloadReaderCloser, error) {
+	if src == nil {
+		return nil, ErrNilSource
+	}
+
+	rc, rcCleanup, _, _, _, err := src.open(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	d := &downloadReaderCloser{
+		reader:  rc,
+		cleanup: rcCleanup,
+	}
+
+	if len(cleanup) > 0 {
+		d.additionalCleanup = cleanup[0]
+	}
+
+	return d, nil
+}
+
+/* -------------------------------------------------------------------------- */
+/*                                ToReaderAt                                  */
+/* -------------------------------------------------------------------------- */
+
+// readCloser pairs a wrapping Reader with the Closer of the underlying stream.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// readerAtReader is any type that implements both io.Reader and io.ReaderAt.
+type readerAtReader struct {
+	io.Reader
+	io.ReaderAt
+}
+
+// readerAtReadCloser preserves ReaderAt while adding a no-op Close.
+type readerAtReadCloser struct {
+	*readerAtReader
+}
+
+func (r readerAtReadCloser) Close() error { return nil }
+
+// writerToReadCloser preserves WriterTo while adding a no-op Close.
+type writerToReadCloser struct {
+	io.Reader
+	io.WriterTo
+}
+
+func (w writerToReadCloser) Close() error { return nil }
+
+// readerAtWriterToReadCloser preserves ReaderAt and WriterTo while adding a no-op Close.
+type readerAtWriterToReadCloser struct {
+	*readerAtReader
+	io.WriterTo
+}
+
+func (r readerAtWriterToReadCloser) Close() error { return nil }
+
+type ReaderAtResult struct {
+	readerAt io.ReaderAt
+	size     int64
+	cleanup  func() error
+	source   string // "direct" | "memory" | "tempFile"
+}
+
+const (
 	readerAtSourceDirect   = "direct"
 	readerAtSourceMemory   = "memory"
 	readerAtSourceTempFile = "tempFile"
@@ -2808,8 +8783,10 @@ func openFileDirect(path string) (io.ReadCloser, func() error, int64, error) {
 	return f, f.Close, fileSize(f), nil
 }
 
-func openURLDirect(ctx context.Context, urlStr string) (io.ReadCloser, func() error, int64, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+// openURLDirect sends a request for urlStr as described by cfg (a plain GET
+// when nil) and returns the body of a 2xx response.
+func openURLDirect(ctx context.Context, urlStr string, cfg *urlConfig) (io.ReadCloser, func() error, int64, error) {
+	req, err := newURLRequest(ctx, urlStr, cfg)
 	if err != nil {
 		return nil, nil, -1, err
 	}
@@ -2827,6 +8804,32 @@ func openURLDirect(ctx context.Context, urlStr string) (io.ReadCloser, func() er
 	return resp.Body, resp.Body.Close, resp.ContentLength, nil
 }
 
+func newURLRequest(ctx context.Context, urlStr string, cfg *urlConfig) (*http.Request, error) {
+	method := http.MethodGet
+	var body io.Reader
+	if cfg != nil {
+		if cfg.method != "" {
+			method = cfg.method
+		}
+		if cfg.body != nil {
+			body = bytes.NewReader(cfg.body)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, urlStr, body)
+	if err != nil {
+		return nil, err
+	}
+	if cfg != nil {
+		for k, vs := range cfg.header {
+			req.Header[k] = append(req.Header[k], vs...)
+		}
+		if h := cfg.header.Get("Host"); h != "" {
+			req.Host = h
+		}
+	}
+	return req, nil
+}
+
 func copyToFile(src io.Reader, dstPath string) error {
 	if err := os.MkdirAll(filepath.Dir(dstPath), 0o755); err != nil {
 		return err
@@ -2840,6 +8843,145 @@ func copyToFile(src io.Reader, dstPath string) error {
 	return err
 }
 
+// writeFileFunc creates path (and parent dirs) and streams fn's output into it
+// through a buffered writer, then flushes and syncs. With atomic, output goes
+// to a unique temp file in the same directory which is renamed over path, so
+// readers never see a partial file.
+func writeFileFunc(path string, perm os.FileMode, atomic bool, fn func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	if !atomic {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			return err
+		}
+		bw := bufio.NewWriter(f)
+		err = fn(bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err == nil {
+			err = f.Sync()
+		}
+		return errors.Join(err, f.Close())
+	}
+
+	return writeFileAtomic(path, perm, fn, nil)
+}
+
+// writeFileAtomic streams fn's output into a unique temp file next to path,
+// applies perm less the process umask (then prepare, if set), syncs, and
+// renames it over path. Parent dirs must already exist.
+func writeFileAtomic(path string, perm os.FileMode, fn func(w io.Writer) error, prepare func(f *os.File) error) error {
+	return writeFileAtomicTo(path, perm, func(f *os.File) error {
+		bw := bufio.NewWriter(f)
+		if err := fn(bw); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}, prepare)
+}
+
+// writeFileAtomicTo is writeFileAtomic with write given the temp file itself.
+func writeFileAtomicTo(path string, perm os.FileMode, write func(f *os.File) error, prepare func(f *os.File) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	return commitTemp(tmp, path, perm, write, prepare)
+}
+
+// commitTemp runs write (if set) on tmp, a temp file in path's directory,
+// then applies perm and prepare, syncs, and renames it over path. perm is
+// masked by the umask, as os.OpenFile would do; prepare may set an exact
+// mode. tmp is closed, and removed on failure.
+func commitTemp(tmp *os.File, path string, perm os.FileMode, write func(f *os.File) error, prepare func(f *os.File) error) error {
+	return commitTempSync(tmp, path, perm, write, prepare, syncAll)
+}
+
+// syncMode selects which fsyncs commitTempSync performs.
+type syncMode int
+
+const (
+	syncAll  syncMode = iota // the file, then its directory after the rename
+	syncFile                 // the file only; the caller syncs the directory later
+	syncNone                 // neither; the caller accepts losing the file on a crash
+)
+
+// commitTempSync is commitTemp with the fsyncs chosen by sync.
+func commitTempSync(tmp *os.File, path string, perm os.FileMode, write func(f *os.File) error, prepare func(f *os.File) error, sync syncMode) error {
+	dir := filepath.Dir(path)
+	tmpName := tmp.Name()
+	fail := func(err error) error {
+		_ = tmp.Close()
+		_ = os.Remove(tmpName)
+		return err
+	}
+
+	if write != nil {
+		if err := write(tmp); err != nil {
+			return fail(err)
+		}
+	}
+	if err := tmp.Chmod(perm &^ umask()); err != nil {
+		return fail(err)
+	}
+	if prepare != nil {
+		if err := prepare(tmp); err != nil {
+			return fail(err)
+		}
+	}
+	if sync != syncNone {
+		if err := tmp.Sync(); err != nil {
+			return fail(err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	if sync != syncAll {
+		return nil
+	}
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory so a new or renamed entry is durable.
+// Directories cannot be synced on Windows; it is a no-op there.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	return errors.Join(err, d.Close())
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// skipUTF8BOM discards a leading UTF-8 byte-order mark, if present.
+func skipUTF8BOM(br *bufio.Reader) error {
+	b, err := br.Peek(len(utf8BOM))
+	if err != nil && err != io.EOF && !errors.Is(err, bufio.ErrBufferFull) {
+		return err
+	}
+	if bytes.Equal(b, utf8BOM) {
+		_, err = br.Discard(len(utf8BOM))
+		return err
+	}
+	return nil
+}
+
 func JoinCleanup(fns ...func() error) func() error {
 	return func() error {
 		var errs error
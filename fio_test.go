@@ -2,16 +2,32 @@ package fio
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/user"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 type noSizeReader struct{}
@@ -364,100 +380,4509 @@ func TestReadLinesHelpers(t *testing.T) {
 	}
 }
 
+func TestReadLinesMaxLineSize(t *testing.T) {
+	ctx, _ := newTestSession(t, Memory)
+	long := strings.Repeat("x", 128<<10)
+
+	var got string
+	if err := ReadLines(ctx, BytesSource([]byte(long+"\nshort")), func(line string) error {
+		if got == "" {
+			got = line
+		}
+		return nil
+	}, WithMaxLineSize(256<<10)); err != nil {
+		t.Fatalf("ReadLines: %v", err)
+	}
+	if got != long {
+		t.Fatalf("ReadLines first line len = %d, want %d", len(got), len(long))
+	}
+
+	err := ReadLines(ctx, BytesSource([]byte(long)), func(string) error { return nil }, WithMaxLineSize(1024))
+	if !errors.Is(err, ErrLineTooLong) {
+		t.Fatalf("expected ErrLineTooLong, got %v", err)
+	}
+}
+
+func TestReadLinesContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "lines.txt")
+	if err := os.WriteFile(path, []byte("a\nb\nc\nd"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	var all []string
+	if err := ReadFileLines(ctx, path, func(line string) error {
+		all = append(all, line)
+		return nil
+	}); err != nil || strings.Join(all, ",") != "a,b,c,d" {
+		t.Fatalf("ReadFileLines = %v, %v", all, err)
+	}
+
+	errStop := errors.New("stop")
+	if err := ReadFileLines(ctx, path, func(line string) error { return errStop }); !errors.Is(err, errStop) {
+		t.Fatalf("callback error: got %v", err)
+	}
+
+	var n int
+	err := ReadFileLines(ctx, path, func(line string) error {
+		n++
+		if n == 2 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("lines read after cancel = %d, want 2", n)
+	}
+}
+
+func TestReadDelimited(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "files.txt")
+	if err := os.WriteFile(path, []byte("a\x00bc\x00\x00last"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(path string, opts ...DelimitedOption) []string {
+		t.Helper()
+		var recs []string
+		err := ReadDelimited(path, 0, func(rec []byte) error {
+			recs = append(recs, string(rec))
+			return nil
+		}, opts...)
+		if err != nil {
+			t.Fatalf("ReadDelimited: %v", err)
+		}
+		return recs
+	}
+
+	if got := read(path); strings.Join(got, "|") != "a|bc||last" || len(got) != 4 {
+		t.Fatalf("stripped = %q", got)
+	}
+	if got := read(path, WithKeepDelimiter()); strings.Join(got, "|") != "a\x00|bc\x00|\x00|last" {
+		t.Fatalf("kept = %q", got)
+	}
+
+	trailing := filepath.Join(dir, "trailing")
+	if err := os.WriteFile(trailing, []byte("x;y;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var recs []string
+	if err := ReadDelimited(trailing, ';', func(rec []byte) error {
+		recs = append(recs, string(rec))
+		return nil
+	}); err != nil || strings.Join(recs, "|") != "x|y" {
+		t.Fatalf("trailing delimiter = %q, %v", recs, err)
+	}
+
+	err := ReadDelimited(path, 0, func([]byte) error { return nil }, WithMaxRecordSize(2))
+	if !errors.Is(err, ErrLineTooLong) {
+		t.Fatalf("max record size: err = %v", err)
+	}
+	if err := ReadDelimited(path, 0, func([]byte) error { return nil }, WithMaxRecordSize(4)); err != nil {
+		t.Fatalf("record at limit: %v", err)
+	}
+
+	boom := errors.New("boom")
+	if err := ReadDelimited(path, 0, func([]byte) error { return boom }); !errors.Is(err, boom) {
+		t.Fatalf("fn error: %v", err)
+	}
+}
+
+func TestReadLastLines(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		return path
+	}
+
+	var big strings.Builder
+	for i := 0; i < 20000; i++ {
+		big.WriteString("line-")
+		big.WriteString(strings.Repeat("x", i%7))
+		big.WriteString("\n")
+	}
+	big.WriteString("last")
+
+	tests := []struct {
+		name    string
+		content string
+		n       int
+		want    []string
+	}{
+		{"trailing newline", "a\nb\nc\n", 2, []string{"b", "c"}},
+		{"no trailing newline", "a\nb\nc", 2, []string{"b", "c"}},
+		{"n larger than file", "a\nb\n", 5, []string{"a", "b"}},
+		{"crlf", "a\r\nb\r\n", 1, []string{"b"}},
+		{"empty", "", 3, []string{}},
+		{"multi chunk", big.String(), 2, []string{"line-" + strings.Repeat("x", 19999%7), "last"}},
+	}
+	for _, tt := range tests {
+		got, err := ReadLastLines(write(strings.ReplaceAll(tt.name, " ", "_"), tt.content), tt.n)
+		if err != nil {
+			t.Fatalf("%s: ReadLastLines: %v", tt.name, err)
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Fatalf("%s: ReadLastLines = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadLinesReverse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lines.txt")
+	if err := os.WriteFile(path, []byte("a\r\nb\r\nc"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	var got []string
+	if err := ReadLinesReverse(path, func(line string) error {
+		got = append(got, line)
+		return nil
+	}); err != nil {
+		t.Fatalf("ReadLinesReverse: %v", err)
+	}
+	if strings.Join(got, ",") != "c,b,a" {
+		t.Fatalf("ReadLinesReverse = %q", got)
+	}
+
+	stop := errors.New("stop")
+	got = nil
+	err := ReadLinesReverse(path, func(line string) error {
+		got = append(got, line)
+		return stop
+	})
+	if !errors.Is(err, stop) || len(got) != 1 {
+		t.Fatalf("ReadLinesReverse early stop = %q, %v", got, err)
+	}
+}
+
+func TestCountLines(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		want    int64
+	}{
+		{"", 0},
+		{"a", 1},
+		{"a\n", 1},
+		{"a\nb", 2},
+		{"a\n\nb\n", 3},
+		{"a\nb\x00", 2},
+		{"\x00", 1},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, strconv.Itoa(i)+".txt")
+		if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		got, err := CountLines(path)
+		if err != nil || got != tt.want {
+			t.Fatalf("CountLines(%q) = %d, %v; want %d", tt.content, got, err, tt.want)
+		}
+	}
+}
+
+func TestReadCSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.csv")
+	content := "\xEF\xBB\xBFname;note\n# comment\nbob;\"multi\nline\"\nann;plain\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	var records [][]string
+	err := ReadCSV(path, func(record []string) error {
+		records = append(records, record)
+		return nil
+	}, WithComma(';'), WithComment('#'))
+	if err != nil {
+		t.Fatalf("ReadCSV: %v", err)
+	}
+	if len(records) != 3 || records[0][0] != "name" || records[1][1] != "multi\nline" || records[2][0] != "ann" {
+		t.Fatalf("ReadCSV records = %q", records)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.csv")
+	if err := os.WriteFile(bad, []byte("a,b\nc\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	err = ReadCSV(bad, func([]string) error { return nil })
+	var perr *csv.ParseError
+	if !errors.As(err, &perr) || perr.Line != 2 {
+		t.Fatalf("expected ParseError on line 2, got %v", err)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nested", "out.csv")
+
+	records := [][]string{{"a", "b"}, {"c", "d,e"}}
+	if err := WriteCSV(path, records, 0o644, WithAtomicWrite()); err != nil {
+		t.Fatalf("WriteCSV: %v", err)
+	}
+	b, _ := os.ReadFile(path)
+	if string(b) != "a,b\nc,\"d,e\"\n" {
+		t.Fatalf("WriteCSV content = %q", string(b))
+	}
+
+	err := WriteCSVStream(path, 0o644, func(write func([]string) error) error {
+		for i := 0; i < 3; i++ {
+			if err := write([]string{strconv.Itoa(i), "x"}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, WithComma('\t'), WithCRLF(true))
+	if err != nil {
+		t.Fatalf("WriteCSVStream: %v", err)
+	}
+	b, _ = os.ReadFile(path)
+	if string(b) != "0\tx\r\n1\tx\r\n2\tx\r\n" {
+		t.Fatalf("WriteCSVStream content = %q", string(b))
+	}
+
+	boom := errors.New("boom")
+	err = WriteCSVStream(path, 0o644, func(write func([]string) error) error {
+		_ = write([]string{"partial"})
+		return boom
+	}, WithAtomicWrite())
+	if !errors.Is(err, boom) {
+		t.Fatalf("expected boom, got %v", err)
+	}
+	b, _ = os.ReadFile(path)
+	if string(b) != "0\tx\r\n1\tx\r\n2\tx\r\n" {
+		t.Fatalf("atomic failure changed file: %q", string(b))
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Fatalf("temp file left behind: %d entries", len(entries))
+	}
+}
+
+func TestGzipHelpers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nested", "data.gz")
+	data := bytes.Repeat([]byte("hello gzip "), 100)
+
+	if err := WriteGzip(path, data, 0o644, WithGzipLevel(gzip.BestCompression)); err != nil {
+		t.Fatalf("WriteGzip: %v", err)
+	}
+	got, err := ReadGzip(path)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("ReadGzip = %d bytes, %v", len(got), err)
+	}
+
+	plain := filepath.Join(dir, "plain.gz")
+	if err := os.WriteFile(plain, []byte("not gzip at all"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := ReadGzip(plain); !errors.Is(err, ErrNotGzip) {
+		t.Fatalf("expected ErrNotGzip, got %v", err)
+	}
+	if err := WriteGzip(path, data, 0o644, WithGzipLevel(42)); err == nil {
+		t.Fatalf("expected error for invalid level")
+	}
+	if got, _ := ReadGzip(path); !bytes.Equal(got, data) {
+		t.Fatalf("invalid level clobbered existing file")
+	}
+}
+
+type closeCounter struct {
+	io.Reader
+	closes int
+}
+
+func (c *closeCounter) Close() error { c.closes++; return nil }
+
+func TestGzipSource(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.gz")
+	data := bytes.Repeat([]byte("hello gzip "), 100)
+	if err := WriteGzip(path, data, 0o644); err != nil {
+		t.Fatalf("WriteGzip: %v", err)
+	}
+	readAll := func(ctx context.Context, src Source) ([]byte, error) {
+		var b []byte
+		err := Read(ctx, src, func(r io.Reader) error {
+			var err error
+			b, err = io.ReadAll(r)
+			return err
+		})
+		return b, err
+	}
+
+	ctx, _ := newTestSession(t, Memory)
+	got, err := readAll(ctx, GzipSource(PathSource(path)))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("GzipSource(PathSource) = %d bytes, %v", len(got), err)
+	}
+
+	gz, _ := os.ReadFile(path)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(gz)
+	}))
+	t.Cleanup(srv.Close)
+	if got, err := readAll(ctx, GzipSource(URLSource(srv.URL))); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("GzipSource(URLSource) = %v", err)
+	}
+
+	cc := &closeCounter{Reader: bytes.NewReader(gz)}
+	in, err := OpenIn(ctx, GzipSource(ReadCloserSource(cc)))
+	if err != nil {
+		t.Fatalf("OpenIn: %v", err)
+	}
+	if in.Size != -1 {
+		t.Fatalf("Size = %d, want -1", in.Size)
+	}
+	if err := in.Close(); err != nil || cc.closes != 1 {
+		t.Fatalf("Close: err = %v, inner closes = %d", err, cc.closes)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	err = Read(cctx, GzipSource(PathSource(path)), func(r io.Reader) error {
+		cancel()
+		_, err := io.ReadAll(r)
+		return err
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled read: err = %v", err)
+	}
+
+	cc = &closeCounter{Reader: strings.NewReader("not gzip at all")}
+	if _, err := readAll(ctx, GzipSource(ReadCloserSource(cc))); !errors.Is(err, ErrNotGzip) || cc.closes != 1 {
+		t.Fatalf("plain data: err = %v, inner closes = %d", err, cc.closes)
+	}
+}
+
+func TestEncryptedOut(t *testing.T) {
+	ctx, _ := newTestSession(t, Memory)
+	key := bytes.Repeat([]byte{7}, 32)
+	readAll := func(src Source) ([]byte, error) {
+		var b []byte
+		err := Read(ctx, src, func(r io.Reader) error {
+			var err error
+			b, err = io.ReadAll(r)
+			return err
+		})
+		return b, err
+	}
+	encrypt := func(data []byte, st StorageType) []byte {
+		t.Helper()
+		out, err := Copy(ctx, BytesSource(data), EncryptedOut(key, Out(".enc", st)))
+		if err != nil {
+			t.Fatalf("Copy: %v", err)
+		}
+		got, err := readAll(DecryptedSource(key, OutputSource(out)))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("decrypt %d bytes (%v): got %d bytes, %v", len(data), st, len(got), err)
+		}
+		enc, _ := out.Bytes()
+		return enc
+	}
+
+	for _, n := range []int{0, 100, encChunkSize, 3*encChunkSize + 17} {
+		data := bytes.Repeat([]byte("secret!"), n/7+1)[:n]
+		for _, st := range []StorageType{Memory, File} {
+			enc := encrypt(data, st)
+			if n > 0 && bytes.Contains(enc, data[:min(n, 64)]) {
+				t.Fatalf("%d bytes: plaintext visible in output", n)
+			}
+		}
+	}
+
+	data := bytes.Repeat([]byte("x"), 2*encChunkSize+5)
+	enc := encrypt(data, Memory)
+	if bytes.Equal(enc, encrypt(data, Memory)) {
+		t.Fatal("two encryptions are identical; nonce not random")
+	}
+
+	wrongKey := bytes.Repeat([]byte{8}, 32)
+	chunk := encChunkSize + 16
+	tampered := bytes.Clone(enc)
+	tampered[encHeaderSize+chunk+3] ^= 1
+	swapped := bytes.Clone(enc)
+	copy(swapped[encHeaderSize:], enc[encHeaderSize+chunk:encHeaderSize+2*chunk])
+	copy(swapped[encHeaderSize+chunk:], enc[encHeaderSize:encHeaderSize+chunk])
+	for name, src := range map[string]Source{
+		"wrong key": DecryptedSource(wrongKey, BytesSource(enc)),
+		"tampered":  DecryptedSource(key, BytesSource(tampered)),
+		"reordered": DecryptedSource(key, BytesSource(swapped)),
+		"truncated": DecryptedSource(key, BytesSource(enc[:encHeaderSize+2*chunk])),
+		"extended":  DecryptedSource(key, BytesSource(append(bytes.Clone(enc), enc[encHeaderSize:encHeaderSize+chunk]...))),
+		"plain":     DecryptedSource(key, BytesSource(data)),
+	} {
+		if _, err := readAll(src); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("%s: err = %v, want ErrDecrypt", name, err)
+		}
+	}
+
+	if _, err := Copy(ctx, BytesSource(data), EncryptedOut([]byte("short"), Out(".enc"))); err == nil {
+		t.Fatal("bad key length: want error")
+	}
+	if _, err := readAll(DecryptedSource([]byte("short"), BytesSource(enc))); err == nil {
+		t.Fatal("bad key length on read: want error")
+	}
+
+	out, err := Process(ctx, BytesSource([]byte("abc")), EncryptedOut(key, Out(".enc")), func(r io.Reader, w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if got, err := readAll(DecryptedSource(key, OutputSource(out))); err != nil || string(got) != "abc" {
+		t.Fatalf("Process round trip = %q, %v", got, err)
+	}
+}
+
+func TestGzipOut(t *testing.T) {
+	ctx, _ := newTestSession(t, Memory)
+	key := bytes.Repeat([]byte{7}, 16)
+	data := bytes.Repeat([]byte("compress me please "), 20000)
+	readAll := func(src Source) ([]byte, error) {
+		var b []byte
+		err := Read(ctx, src, func(r io.Reader) error {
+			var err error
+			b, err = io.ReadAll(r)
+			return err
+		})
+		return b, err
+	}
+
+	for _, st := range []StorageType{Memory, File} {
+		out, err := Copy(ctx, ReaderSource(bytes.NewReader(data)), GzipOut(gzip.BestSpeed, Out(".gz", st)))
+		if err != nil {
+			t.Fatalf("Copy %v: %v", st, err)
+		}
+		raw, _ := out.Bytes()
+		if len(raw) >= len(data)/10 {
+			t.Fatalf("%v: %d compressed bytes for %d", st, len(raw), len(data))
+		}
+		// gzip.Reader checks the CRC and size in the footer at EOF.
+		if got, err := readAll(GzipSource(BytesSource(raw))); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%v: gunzip = %d bytes, %v", st, len(got), err)
+		}
+	}
+
+	// Compress, then encrypt.
+	out, err := Copy(ctx, BytesSource(data), GzipOut(gzip.DefaultCompression, EncryptedOut(key, Out(".gz.enc"))))
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if raw, _ := out.Bytes(); len(raw) >= len(data)/10 {
+		t.Fatalf("compress-then-encrypt: %d bytes, data was not compressed first", len(raw))
+	}
+	if got, err := readAll(GzipSource(DecryptedSource(key, OutputSource(out)))); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("compress-then-encrypt round trip: %d bytes, %v", len(got), err)
+	}
+
+	// Encrypt, then compress.
+	out, err = Copy(ctx, BytesSource(data), EncryptedOut(key, GzipOut(gzip.DefaultCompression, Out(".enc.gz"))))
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if got, err := readAll(DecryptedSource(key, GzipSource(OutputSource(out)))); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("encrypt-then-compress round trip: %d bytes, %v", len(got), err)
+	}
+
+	if _, err := Copy(ctx, BytesSource(data), GzipOut(42, Out(".gz"))); err == nil {
+		t.Fatal("invalid level: want error")
+	}
+}
+
+func TestReadWriteAuto(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("auto codec")
+
+	for _, name := range []string{"a.gz", "a.GZ", "a.txt"} {
+		path := filepath.Join(dir, name)
+		if err := WriteAuto(path, data, 0o644); err != nil {
+			t.Fatalf("WriteAuto(%s): %v", name, err)
+		}
+		got, err := ReadAuto(path)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("ReadAuto(%s) = %q, %v", name, got, err)
+		}
+	}
+
+	raw, _ := os.ReadFile(filepath.Join(dir, "a.gz"))
+	if bytes.Equal(raw, data) {
+		t.Fatalf("WriteAuto .gz wrote plain data")
+	}
+
+	for _, name := range []string{"a.bz2", "a.zst", "a.xz"} {
+		if err := WriteAuto(filepath.Join(dir, name), data, 0o644); !errors.Is(err, ErrUnsupportedCompression) {
+			t.Fatalf("WriteAuto(%s): expected ErrUnsupportedCompression, got %v", name, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b.zst"), data, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := ReadAuto(filepath.Join(dir, "b.zst")); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Fatalf("ReadAuto(.zst): expected ErrUnsupportedCompression, got %v", err)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	dir := t.TempDir()
+	v := map[string]any{"a": 1, "b": []int{2}}
+
+	path := filepath.Join(dir, "nested", "config.json")
+	if err := WriteJSON(path, v, 0o644); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "{\n  \"a\": 1,\n  \"b\": [\n    2\n  ]\n}\n" {
+		t.Fatalf("WriteJSON = %q", b)
+	}
+
+	for _, tc := range []struct {
+		opts WriteJSONOptions
+		want string
+	}{
+		{WriteJSONOptions{Compact: true, Indent: "  "}, "{\"a\":1,\"b\":[2]}\n"},
+		{WriteJSONOptions{}, "{\"a\":1,\"b\":[2]}\n"},
+		{WriteJSONOptions{Indent: "\t"}, "{\n\t\"a\": 1,\n\t\"b\": [\n\t\t2\n\t]\n}\n"},
+		{WriteJSONOptions{Prefix: "#", Indent: " "}, "{\n# \"a\": 1,\n# \"b\": [\n#  2\n# ]\n#}\n"},
+	} {
+		if err := WriteJSONWith(path, v, 0o644, tc.opts); err != nil {
+			t.Fatalf("WriteJSONWith(%+v): %v", tc.opts, err)
+		}
+		if b, _ := os.ReadFile(path); string(b) != tc.want {
+			t.Fatalf("WriteJSONWith(%+v) = %q, want %q", tc.opts, b, tc.want)
+		}
+	}
+
+	if err := WriteJSON(path, func() {}, 0o644); err == nil {
+		t.Fatal("unencodable value: want error")
+	}
+	if b, _ := os.ReadFile(path); len(b) == 0 {
+		t.Fatal("encode error truncated the existing file")
+	}
+}
+
+type jsonUpper string
+
+func (u jsonUpper) MarshalJSON() ([]byte, error) { return json.Marshal(strings.ToUpper(string(u))) }
+
+type jsonPtrMarshal struct{ A int }
+
+func (*jsonPtrMarshal) MarshalJSON() ([]byte, error) { return []byte(`"custom"`), nil }
+
+func TestWriteJSONStreamMatchesWriteJSON(t *testing.T) {
+	type row struct {
+		ID   int      `json:"id"`
+		Tags []string `json:"tags,omitempty"`
+		Note string   `json:"note"`
+	}
+	var nilSlice []row
+	var nilMap map[string]int
+	dir := t.TempDir()
+	path, wantPath := filepath.Join(dir, "v.json"), filepath.Join(dir, "want.json")
+	for name, v := range map[string]any{
+		"structs":       []row{{ID: 1, Tags: []string{"a", "b"}, Note: "<&>"}, {ID: 2}},
+		"empty":         []int{},
+		"nil slice":     nilSlice,
+		"array":         [3]float64{1.5, 0, -2},
+		"bytes":         []byte("base64"),
+		"map":           map[string]any{"z": 1, "a": []int{1, 2}, "<k>": map[string]string{"x": "y"}},
+		"empty map":     map[string]bool{},
+		"nil map":       nilMap,
+		"int keys":      map[int]string{2: "b", 10: "a"},
+		"marshaler":     []jsonUpper{"a", "b"},
+		"ptr marshaler": []jsonPtrMarshal{{A: 1}, {A: 2}},
+		"ptr array":     [2]jsonPtrMarshal{{A: 1}, {A: 2}},
+		"ptr map":       map[string]jsonPtrMarshal{"k": {A: 1}},
+		"scalar":        "text",
+		"nested":        [][]int{{1}, {}, nil},
+	} {
+		if err := WriteJSONStream(path, v, 0o644); err != nil {
+			t.Fatalf("%s: WriteJSONStream: %v", name, err)
+		}
+		if err := WriteJSON(wantPath, v, 0o644); err != nil {
+			t.Fatalf("%s: WriteJSON: %v", name, err)
+		}
+		got, _ := os.ReadFile(path)
+		want, _ := os.ReadFile(wantPath)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s:\ngot  %q\nwant %q", name, got, want)
+		}
+	}
+}
+
+func TestWriteJSONStream(t *testing.T) {
+	dir := t.TempDir()
+	rows := []map[string]int{{"n": 1}, {"n": 2}}
+
+	path := filepath.Join(dir, "nested", "dump.json")
+	if err := WriteJSONStream(path, rows, 0o644); err != nil {
+		t.Fatalf("WriteJSONStream: %v", err)
+	}
+	want := "[\n  {\n    \"n\": 1\n  },\n  {\n    \"n\": 2\n  }\n]\n"
+	if b, _ := os.ReadFile(path); string(b) != want {
+		t.Fatalf("WriteJSONStream = %q", b)
+	}
+	if err := WriteJSONStream(path, func() {}, 0o644); err == nil {
+		t.Fatal("unencodable value: want error")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("failed WriteJSONStream left a file: %v", err)
+	}
+
+	safe := filepath.Join(dir, "safe.json")
+	if err := SafeWriteJSON(safe, rows, 0o644); err != nil {
+		t.Fatalf("SafeWriteJSON: %v", err)
+	}
+	if err := SafeWriteJSON(safe, map[string]any{"bad": make(chan int)}, 0o644); err == nil {
+		t.Fatal("unencodable value: want error")
+	}
+	if b, _ := os.ReadFile(safe); string(b) != want {
+		t.Fatalf("failed SafeWriteJSON changed file: %q", b)
+	}
+}
+
+func TestWriteJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "out.ndjson")
+
+	type rec struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	err := WriteJSONLines(path, 0o644, func(emit func(v any) error) error {
+		for i := 1; i <= 2; i++ {
+			if err := emit(rec{ID: i, Name: "n"}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WriteJSONLines: %v", err)
+	}
+	b, _ := os.ReadFile(path)
+	if string(b) != "{\"id\":1,\"name\":\"n\"}\n{\"id\":2,\"name\":\"n\"}\n" {
+		t.Fatalf("WriteJSONLines content = %q", string(b))
+	}
+
+	boom := errors.New("boom")
+	err = SafeWriteJSONLines(path, 0o644, func(emit func(v any) error) error {
+		_ = emit(rec{ID: 3})
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("expected boom, got %v", err)
+	}
+	if b2, _ := os.ReadFile(path); !bytes.Equal(b, b2) {
+		t.Fatalf("SafeWriteJSONLines failure changed file: %q", string(b2))
+	}
+}
+
+func TestDoTempDir(t *testing.T) {
+	var seen string
+	boom := errors.New("boom")
+	err := DoTempDir(func(dir string) error {
+		seen = dir
+		return os.WriteFile(filepath.Join(dir, "nested.txt"), []byte("x"), 0o644)
+	})
+	if err != nil {
+		t.Fatalf("DoTempDir: %v", err)
+	}
+	if _, err := os.Stat(seen); !os.IsNotExist(err) {
+		t.Fatalf("dir not removed: %v", err)
+	}
+
+	if err := DoTempDir(func(dir string) error { seen = dir; return boom }); !errors.Is(err, boom) {
+		t.Fatalf("err = %v, want boom", err)
+	}
+	if _, err := os.Stat(seen); !os.IsNotExist(err) {
+		t.Fatalf("dir not removed after error: %v", err)
+	}
+
+	func() {
+		defer func() { _ = recover() }()
+		_ = DoTempDir(func(dir string) error { seen = dir; panic("boom") })
+	}()
+	if _, err := os.Stat(seen); !os.IsNotExist(err) {
+		t.Fatalf("dir not removed after panic: %v", err)
+	}
+}
+
+func TestTempDir(t *testing.T) {
+	parent := t.TempDir()
+	dir, cleanup, err := TempDir(parent, "job-*")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	if filepath.Dir(dir) != parent || !strings.HasPrefix(filepath.Base(dir), "job-") {
+		t.Fatalf("dir = %q", dir)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cleanup(); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("dir not removed: %v", err)
+	}
+
+	// A second call must not remove a new directory that reused the name.
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cleanup(); err != nil {
+		t.Fatalf("second cleanup: %v", err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("second cleanup removed dir: %v", err)
+	}
+
+	if _, _, err := TempDir(filepath.Join(parent, "missing"), ""); err == nil {
+		t.Fatal("missing parent: want error")
+	}
+}
+
+func TestDoTempFile(t *testing.T) {
+	var name string
+	err := DoTempFile("fio-*.txt", func(f *os.File) error {
+		name = f.Name()
+		if !strings.HasSuffix(name, ".txt") {
+			t.Errorf("name = %q, want .txt suffix", name)
+		}
+		_, err := f.WriteString("data")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("DoTempFile: %v", err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("file not removed: %v", err)
+	}
+
+	err = DoTempFile("", func(f *os.File) error {
+		name = f.Name()
+		return f.Close()
+	})
+	if err != nil {
+		t.Fatalf("fn closing file: %v", err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("file not removed: %v", err)
+	}
+}
+
+func TestReadAtFull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, 10, "0123456789"},
+		{3, 4, "3456"},
+		{6, 4, "6789"},
+		{10, 0, ""},
+	} {
+		b, err := ReadAtFull(path, tc.offset, tc.length)
+		if err != nil || string(b) != tc.want {
+			t.Fatalf("ReadAtFull(%d, %d) = %q, %v; want %q", tc.offset, tc.length, b, err, tc.want)
+		}
+	}
+
+	for _, tc := range []struct{ offset, length int64 }{{6, 5}, {10, 1}, {20, 1}, {0, 1 << 62}} {
+		if _, err := ReadAtFull(path, tc.offset, tc.length); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("ReadAtFull(%d, %d) err = %v, want io.ErrUnexpectedEOF", tc.offset, tc.length, err)
+		}
+	}
+	if _, err := ReadAtFull(path, -1, 1); err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("negative offset: err = %v", err)
+	}
+}
+
+func TestReadRanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadRanges(path, []Range{
+		{Offset: 6, Length: 2},
+		{Offset: 0, Length: 3},
+		{Offset: 8, Length: 5},
+		{Offset: 12, Length: 4},
+		{Offset: 0, Length: 1 << 62},
+	})
+	if err != nil {
+		t.Fatalf("ReadRanges: %v", err)
+	}
+	want := []string{"67", "012", "89", "", "0123456789"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d results, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if string(got[i]) != want[i] {
+			t.Fatalf("range %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	if got, err := ReadRanges(path, nil); err != nil || len(got) != 0 {
+		t.Fatalf("no ranges = %v, %v", got, err)
+	}
+	if _, err := ReadRanges(path, []Range{{Offset: 0, Length: -1}}); err == nil {
+		t.Fatal("negative length: want error")
+	}
+}
+
+func TestReadRangesUnknownSize(t *testing.T) {
+	// Neither reports a usable size; a huge Length must not be allocated
+	// up front.
+	if runtime.GOOS != "windows" {
+		got, err := ReadRanges(os.DevNull, []Range{{Offset: 0, Length: 1 << 50}})
+		if err != nil || len(got) != 1 || len(got[0]) != 0 {
+			t.Fatalf("ReadRanges(%s) = %q, %v", os.DevNull, got, err)
+		}
+		if _, err := ReadAtFull(os.DevNull, 0, 1<<50); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("ReadAtFull(%s) err = %v, want io.ErrUnexpectedEOF", os.DevNull, err)
+		}
+	}
+	if runtime.GOOS == "linux" {
+		got, err := ReadRanges("/proc/self/stat", []Range{{Offset: 0, Length: 1 << 50}})
+		if err != nil || len(got) != 1 || len(got[0]) == 0 {
+			t.Fatalf("ReadRanges(/proc/self/stat) = %d results, %v", len(got), err)
+		}
+		if b, err := ReadAtFull("/proc/self/stat", 0, 1); err != nil || len(b) != 1 {
+			t.Fatalf("ReadAtFull(/proc/self/stat) = %q, %v", b, err)
+		}
+	}
+}
+
+func TestReadChunks(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, []byte("0123456789"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var chunks []string
+	err := ReadChunks(path, 4, func(chunk []byte) error {
+		chunks = append(chunks, string(chunk))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ReadChunks: %v", err)
+	}
+	if strings.Join(chunks, "|") != "0123|4567|89" {
+		t.Fatalf("chunks = %q", chunks)
+	}
+
+	boom := errors.New("boom")
+	calls := 0
+	err = ReadChunks(path, 3, func([]byte) error {
+		calls++
+		return boom
+	})
+	if !errors.Is(err, boom) || calls != 1 {
+		t.Fatalf("fn error: err = %v, calls = %d", err, calls)
+	}
+
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadChunks(empty, 4, func([]byte) error { calls++; return nil }); err != nil || calls != 1 {
+		t.Fatalf("empty file: err = %v, calls = %d", err, calls)
+	}
+	if err := ReadChunks(path, 0, func([]byte) error { return nil }); err == nil {
+		t.Fatal("zero chunk size: want error")
+	}
+}
+
+func TestReadNoBOM(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	utf8BOM := write("utf8", []byte("\xEF\xBB\xBFname,age"))
+	if s, err := ReadStringNoBOM(utf8BOM); err != nil || s != "name,age" {
+		t.Fatalf("UTF-8 BOM = %q, %v", s, err)
+	}
+	plain := write("plain", []byte("héllo"))
+	if s, err := ReadStringNoBOM(plain, WithUTF16ToUTF8()); err != nil || s != "héllo" {
+		t.Fatalf("no BOM = %q, %v", s, err)
+	}
+
+	le := write("le", []byte{0xFF, 0xFE, 'h', 0, 0xE9, 0, '!', 0, 0x3D, 0xD8, 0x00, 0xDE})
+	if b, err := ReadNoBOM(le); err != nil || !bytes.Equal(b, []byte{'h', 0, 0xE9, 0, '!', 0, 0x3D, 0xD8, 0x00, 0xDE}) {
+		t.Fatalf("UTF-16 LE raw = %v, %v", b, err)
+	}
+	if s, err := ReadStringNoBOM(le, WithUTF16ToUTF8()); err != nil || s != "hé!\U0001F600" {
+		t.Fatalf("UTF-16 LE = %q, %v", s, err)
+	}
+	be := write("be", []byte{0xFE, 0xFF, 0, 'o', 0, 'k', 0})
+	if s, err := ReadStringNoBOM(be, WithUTF16ToUTF8()); err != nil || s != "ok\uFFFD" {
+		t.Fatalf("UTF-16 BE = %q, %v", s, err)
+	}
+
+	for _, tc := range []struct {
+		in   []byte
+		want BOM
+	}{
+		{[]byte("\xEF\xBB\xBFx"), BOMUTF8},
+		{[]byte{0xFF, 0xFE}, BOMUTF16LE},
+		{[]byte{0xFE, 0xFF, 0}, BOMUTF16BE},
+		{[]byte{0xEF, 0xBB}, BOMNone},
+		{nil, BOMNone},
+	} {
+		if got := DetectBOM(tc.in); got != tc.want {
+			t.Fatalf("DetectBOM(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestAppendLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "audit.log")
+
+	const workers, perWorker = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			line := []byte(strings.Repeat(strconv.Itoa(w), 100) + "\n")
+			for i := 0; i < perWorker; i++ {
+				if err := AppendLocked(path, line, 0o644); err != nil {
+					t.Errorf("AppendLocked: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != workers*perWorker {
+		t.Fatalf("lines = %d, want %d", len(lines), workers*perWorker)
+	}
+	for _, line := range lines {
+		if len(line) != 100 || strings.Count(line, line[:1]) != 100 {
+			t.Fatalf("interleaved line: %q", line)
+		}
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.lock")
+
+	lock, err := FileLock(path)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("locking unsupported")
+	}
+	if err != nil {
+		t.Fatalf("FileLock: %v", err)
+	}
+	if _, err := TryFileLock(path); !errors.Is(err, ErrLocked) {
+		t.Fatalf("TryFileLock while held: err = %v", err)
+	}
+	if _, err := TryFileLockShared(path); !errors.Is(err, ErrLocked) {
+		t.Fatalf("TryFileLockShared while held: err = %v", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("second Unlock: %v", err)
+	}
+
+	r1, err := FileLockShared(path)
+	if err != nil {
+		t.Fatalf("FileLockShared: %v", err)
+	}
+	r2, err := TryFileLockShared(path)
+	if err != nil {
+		t.Fatalf("second shared lock: %v", err)
+	}
+	if _, err := TryFileLock(path); !errors.Is(err, ErrLocked) {
+		t.Fatalf("TryFileLock under shared: err = %v", err)
+	}
+	_ = r1.Unlock()
+	_ = r2.Unlock()
+
+	lock, err = TryFileLock(path)
+	if err != nil {
+		t.Fatalf("TryFileLock after release: %v", err)
+	}
+	_ = lock.Unlock()
+
+	if _, err := FileLock(""); !errors.Is(err, ErrEmptyPath) {
+		t.Fatalf("empty path: err = %v", err)
+	}
+}
+
+func TestWithFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.lock")
+	if l, err := TryFileLock(path); errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("locking unsupported")
+	} else if err != nil {
+		t.Fatal(err)
+	} else {
+		_ = l.Unlock()
+	}
+
+	boom := errors.New("boom")
+	err := WithFileLock(path, func() error {
+		if _, err := TryFileLock(path); !errors.Is(err, ErrLocked) {
+			t.Errorf("lock not held inside fn: %v", err)
+		}
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("err = %v, want boom", err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("panic not propagated")
+			}
+		}()
+		_ = WithFileLock(path, func() error { panic("boom") })
+	}()
+	l, err := TryFileLock(path)
+	if err != nil {
+		t.Fatalf("lock leaked after panic: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ran := false
+	err = WithFileLockContext(ctx, path, func() error { ran = true; return nil })
+	if !errors.Is(err, context.DeadlineExceeded) || ran {
+		t.Fatalf("held lock: err = %v, ran = %v", err, ran)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = l.Unlock()
+	}()
+	err = WithFileLockContext(context.Background(), path, func() error { ran = true; return nil })
+	if err != nil || !ran {
+		t.Fatalf("after release: err = %v, ran = %v", err, ran)
+	}
+}
+
+func TestWriteLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "lines.txt")
+
+	if err := WriteLines(path, []string{"a", "b"}, 0o644); err != nil {
+		t.Fatalf("WriteLines: %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "a\nb\n" {
+		t.Fatalf("WriteLines LF = %q", string(b))
+	}
+
+	if err := WriteLines(path, []string{"a", "b"}, 0o644, WithEOL(CRLF)); err != nil {
+		t.Fatalf("WriteLines: %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "a\r\nb\r\n" {
+		t.Fatalf("WriteLines CRLF = %q", string(b))
+	}
+}
+
+func TestNormalizeEOL(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mixed.txt")
+	if err := os.WriteFile(path, []byte("a\r\nb\nc\r\nd\re"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if eol, err := DetectEOL(path); err != nil || eol != CRLF {
+		t.Fatalf("DetectEOL mixed = %v, %v", eol, err)
+	}
+	if err := NormalizeEOL(path, LF); err != nil {
+		t.Fatalf("NormalizeEOL LF: %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "a\nb\nc\nd\re" {
+		t.Fatalf("LF = %q", b)
+	}
+	if eol, _ := DetectEOL(path); eol != LF {
+		t.Fatalf("DetectEOL after LF = %v", eol)
+	}
+	if err := NormalizeEOL(path, CRLF); err != nil {
+		t.Fatalf("NormalizeEOL CRLF: %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "a\r\nb\r\nc\r\nd\re" {
+		t.Fatalf("CRLF = %q", b)
+	}
+	if runtime.GOOS != "windows" {
+		if fi, _ := os.Stat(path); fi.Mode().Perm() != 0o600 {
+			t.Fatalf("mode = %v, want 0600", fi.Mode().Perm())
+		}
+	}
+
+	bin := filepath.Join(dir, "blob.bin")
+	orig := []byte("PK\x00\x01\r\nrest\n")
+	if err := os.WriteFile(bin, orig, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NormalizeEOL(bin, LF, WithSkipBinary()); err != nil {
+		t.Fatalf("NormalizeEOL binary: %v", err)
+	}
+	if b, _ := os.ReadFile(bin); !bytes.Equal(b, orig) {
+		t.Fatalf("binary file changed: %q", b)
+	}
+
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, []byte("no newline"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if eol, err := DetectEOL(empty); err != nil || eol != LF {
+		t.Fatalf("DetectEOL no newline = %v, %v", eol, err)
+	}
+}
+
+func TestAppendLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "app.log")
+
+	if err := AppendLines(path, []string{"a", "b\n"}, 0o644); err != nil {
+		t.Fatalf("AppendLines: %v", err)
+	}
+	if err := AppendLines(path, []string{"c"}, 0o644); err != nil {
+		t.Fatalf("AppendLines: %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "a\nb\nc\n" {
+		t.Fatalf("AppendLines = %q", string(b))
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ring.bin")
+	if err := Truncate(path, 10); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing without WithCreate: %v", err)
+	}
+	if err := Truncate(path, 8, WithCreate(0o644)); err != nil {
+		t.Fatalf("Truncate create: %v", err)
+	}
+	if b, _ := os.ReadFile(path); !bytes.Equal(b, make([]byte, 8)) {
+		t.Fatalf("created = %q", b)
+	}
+
+	if err := os.WriteFile(path, []byte("abcdef"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Truncate(path, 3); err != nil {
+		t.Fatalf("shrink: %v", err)
+	}
+	if err := Truncate(path, 5); err != nil {
+		t.Fatalf("extend: %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "abc\x00\x00" {
+		t.Fatalf("after shrink+extend = %q", b)
+	}
+
+	if err := Grow(path, 2); err != nil {
+		t.Fatalf("Grow smaller: %v", err)
+	}
+	if fi, _ := os.Stat(path); fi.Size() != 5 {
+		t.Fatalf("Grow shrank the file to %d", fi.Size())
+	}
+	if err := Grow(path, 7); err != nil {
+		t.Fatalf("Grow: %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "abc\x00\x00\x00\x00" {
+		t.Fatalf("after Grow = %q", b)
+	}
+	nested := filepath.Join(dir, "a", "b", "new.bin")
+	if err := Grow(nested, 4, WithCreate(0o600)); err != nil {
+		t.Fatalf("Grow create: %v", err)
+	}
+	if fi, err := os.Stat(nested); err != nil || fi.Size() != 4 {
+		t.Fatalf("Grow create: %v, %v", fi, err)
+	}
+
+	if err := Truncate(path, -1); !errors.Is(err, ErrInvalidSize) {
+		t.Fatalf("negative size: %v", err)
+	}
+	if err := Grow("", 1); !errors.Is(err, ErrEmptyPath) {
+		t.Fatalf("empty path: %v", err)
+	}
+}
+
+func TestPreallocate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(path, []byte("head"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := Preallocate(path, 1<<20)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("preallocation not supported here")
+	}
+	if err != nil {
+		t.Fatalf("Preallocate: %v", err)
+	}
+	b, _ := os.ReadFile(path)
+	if len(b) != 1<<20 || string(b[:4]) != "head" || !bytes.Equal(b[4:], make([]byte, 1<<20-4)) {
+		t.Fatalf("after Preallocate: %d bytes, head %q", len(b), b[:min(len(b), 4)])
+	}
+	if err := Preallocate(path, 10); err != nil {
+		t.Fatalf("smaller size: %v", err)
+	}
+	if fi, _ := os.Stat(path); fi.Size() != 1<<20 {
+		t.Fatalf("Preallocate shrank the file to %d", fi.Size())
+	}
+
+	fresh := filepath.Join(filepath.Dir(path), "fresh.bin")
+	if err := Preallocate(fresh, 4096); err != nil {
+		t.Fatalf("Preallocate new file: %v", err)
+	}
+	if fi, err := os.Stat(fresh); err != nil || fi.Size() != 4096 {
+		t.Fatalf("new file: %v, %v", fi, err)
+	}
+	if err := Preallocate(path, -1); !errors.Is(err, ErrInvalidSize) {
+		t.Fatalf("negative size: %v", err)
+	}
+}
+
+func TestSafeWriteConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+
+	const writers = 16
+	inputs := make([][]byte, writers)
+	for i := range inputs {
+		inputs[i] = bytes.Repeat([]byte{byte('a' + i)}, 64<<10)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if err := SafeWrite(path, inputs[i], 0o644); err != nil {
+					t.Errorf("SafeWrite: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	matched := false
+	for _, in := range inputs {
+		if bytes.Equal(got, in) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		t.Fatalf("final content is not one of the inputs (len %d)", len(got))
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("temp files left behind: %d entries", len(entries))
+	}
+}
+
+func TestSafeWriteReader(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sub", "big.bin")
+	data := bytes.Repeat([]byte("stream "), 100000)
+	n, err := SafeWriteReader(path, struct{ io.Reader }{bytes.NewReader(data)}, 0o600)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("SafeWriteReader = %d, %v", n, err)
+	}
+	got, _ := os.ReadFile(path)
+	if !bytes.Equal(got, data) {
+		t.Fatalf("content: %d bytes", len(got))
+	}
+	if runtime.GOOS != "windows" {
+		if fi, _ := os.Stat(path); fi.Mode().Perm() != 0o600 {
+			t.Fatalf("perm = %v", fi.Mode().Perm())
+		}
+	}
+
+	boom := errors.New("boom")
+	n, err = SafeWriteReader(path, io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(boom)), 0o600)
+	if !errors.Is(err, boom) || n != int64(len("partial")) {
+		t.Fatalf("failing reader = %d, %v", n, err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatal("failed write replaced the file")
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Fatalf("temp file left behind: %d entries", len(entries))
+	}
+
+	if _, err := SafeWriteReader("", strings.NewReader("x"), 0o644); !errors.Is(err, ErrEmptyPath) {
+		t.Fatalf("empty path: %v", err)
+	}
+	if _, err := SafeWriteReader(path, nil, 0o644); !errors.Is(err, ErrNilReader) {
+		t.Fatalf("nil reader: %v", err)
+	}
+}
+
+func TestSave(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("save "), 50000)
+	srcPath := filepath.Join(dir, "src.bin")
+	if err := os.WriteFile(srcPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(dir, "out", "saved.bin")
+	for name, src := range map[string]Source{
+		"path":  PathSource(srcPath),
+		"bytes": BytesSource(data),
+		"url":   URLSource(srv.URL),
+	} {
+		n, err := Save(ctx, src, path, 0o600)
+		if err != nil || n != int64(len(data)) {
+			t.Fatalf("%s: Save = %d, %v", name, n, err)
+		}
+		if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+			t.Fatalf("%s: content: %d bytes", name, len(got))
+		}
+	}
+	if runtime.GOOS != "windows" {
+		if fi, _ := os.Stat(path); fi.Mode().Perm() != 0o600 {
+			t.Fatalf("perm = %v", fi.Mode().Perm())
+		}
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	var read int64
+	endless := FuncSource(func(context.Context) (io.ReadCloser, int64, error) {
+		return io.NopCloser(readerFunc(func(p []byte) (int, error) {
+			if read += int64(len(p)); read > 1<<20 {
+				cancel()
+			}
+			return len(p), nil
+		})), -1, nil
+	})
+	if _, err := Save(cctx, endless, path, 0o600); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancel: err = %v", err)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatal("cancelled save replaced the file")
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatalf("temp file left behind: %d entries", len(entries))
+	}
+
+	if _, err := Save(ctx, BytesSource(data), "", 0o644); !errors.Is(err, ErrEmptyPath) {
+		t.Fatalf("empty path: %v", err)
+	}
+}
+
+func TestSafeWritePreserveExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.conf")
+	if err := os.WriteFile(path, []byte("old"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Chmod(path, 0o640); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	chowned := os.Geteuid() == 0 && os.Chown(path, 1234, 5678) == nil
+
+	if err := SafeWrite(path, []byte("new"), 0o600, PreserveExisting()); err != nil {
+		t.Fatalf("SafeWrite: %v", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0o640 {
+		t.Fatalf("mode = %v, want 0640", fi.Mode().Perm())
+	}
+	if uid, gid, ok := fileOwner(fi); ok && chowned && (uid != 1234 || gid != 5678) {
+		t.Fatalf("owner = %d:%d, want 1234:5678", uid, gid)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "new" {
+		t.Fatalf("content = %q", string(b))
+	}
+
+	if err := SafeWrite(path, []byte("again"), 0o600); err != nil {
+		t.Fatalf("SafeWrite: %v", err)
+	}
+	if fi, _ := os.Stat(path); runtime.GOOS != "windows" && fi.Mode().Perm() != 0o600 {
+		t.Fatalf("mode without PreserveExisting = %v, want 0600", fi.Mode().Perm())
+	}
+}
+
+func TestSafeWriteUmask(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no umask on windows")
+	}
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "plain")
+	if err := os.WriteFile(plain, []byte("x"), 0o777); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	want, _ := os.Stat(plain)
+
+	path := filepath.Join(dir, "safe")
+	if err := SafeWrite(path, []byte("x"), 0o777); err != nil {
+		t.Fatalf("SafeWrite: %v", err)
+	}
+	fi, _ := os.Stat(path)
+	if fi.Mode().Perm() != want.Mode().Perm() {
+		t.Fatalf("mode = %v, want %v as with os.WriteFile", fi.Mode().Perm(), want.Mode().Perm())
+	}
+
+	if err := os.Chmod(path, 0o777); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if err := SafeWrite(path, []byte("y"), 0o600, PreserveExisting()); err != nil {
+		t.Fatalf("SafeWrite: %v", err)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0o777 {
+		t.Fatalf("preserved mode = %v, want 0777", fi.Mode().Perm())
+	}
+}
+
+func TestWriteIfChanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "gen.go")
+
+	changed, err := WriteIfChanged(path, []byte("v1"), 0o644)
+	if err != nil || !changed {
+		t.Fatalf("first WriteIfChanged = %v, %v", changed, err)
+	}
+
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	changed, err = WriteIfChanged(path, []byte("v1"), 0o644)
+	if err != nil || changed {
+		t.Fatalf("same-content WriteIfChanged = %v, %v", changed, err)
+	}
+	if fi, _ := os.Stat(path); !fi.ModTime().Equal(old) {
+		t.Fatalf("mtime changed on no-op write")
+	}
+
+	changed, err = WriteIfChanged(path, []byte("v2"), 0o644)
+	if err != nil || !changed {
+		t.Fatalf("changed WriteIfChanged = %v, %v", changed, err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "v2" {
+		t.Fatalf("content = %q", string(b))
+	}
+}
+
+func TestWriteWithBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.conf")
+
+	if err := WriteWithBackup(path, []byte("v1"), 0o644, ".bak"); err != nil {
+		t.Fatalf("WriteWithBackup: %v", err)
+	}
+	if _, err := os.Stat(path + ".bak"); !os.IsNotExist(err) {
+		t.Fatalf("backup created for missing target: %v", err)
+	}
+
+	for _, v := range []string{"v2", "v3"} {
+		if err := WriteWithBackup(path, []byte(v), 0o644, ""); err != nil {
+			t.Fatalf("WriteWithBackup: %v", err)
+		}
+	}
+	if b, _ := os.ReadFile(path); string(b) != "v3" {
+		t.Fatalf("content = %q", string(b))
+	}
+	if b, _ := os.ReadFile(path + ".bak"); string(b) != "v2" {
+		t.Fatalf("backup = %q", string(b))
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	got, err := SHA256(path)
+	want := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if err != nil || got != want {
+		t.Fatalf("SHA256 = %s, %v", got, err)
+	}
+
+	sum, err := Checksum(path, md5.New())
+	if err != nil || hex.EncodeToString(sum) != "900150983cd24fb0d6963f7d28e17f72" {
+		t.Fatalf("Checksum md5 = %x, %v", sum, err)
+	}
+	if _, err := Checksum(path, nil); !errors.Is(err, ErrNilHash) {
+		t.Fatalf("expected ErrNilHash, got %v", err)
+	}
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(path, []byte("abc"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	ok, err := VerifyChecksum(path, "BA7816BF8F01CFEA414140DE5DAE2223B00361A396177A9CB410FF61F20015AD", sha256.New())
+	if !ok || err != nil {
+		t.Fatalf("VerifyChecksum = %v, %v", ok, err)
+	}
+	if ok, err := VerifyChecksum(path, "900150983cd24fb0d6963f7d28e17f72", sha256.New()); ok || !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v, %v", ok, err)
+	}
+	if ok, err := VerifyChecksum(path, "zz", sha256.New()); ok || !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch for bad hex, got %v, %v", ok, err)
+	}
+	_, err = VerifyChecksum(filepath.Join(t.TempDir(), "missing"), "00", sha256.New())
+	if err == nil || errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected I/O error, got %v", err)
+	}
+}
+
+func TestHashDir(t *testing.T) {
+	root := t.TempDir()
+	write := func(rel, data string) {
+		t.Helper()
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.txt", "a")
+	write("sub/b.txt", "b")
+	hashDir := func() string {
+		t.Helper()
+		sum, err := HashDir(root, sha256.New)
+		if err != nil {
+			t.Fatalf("HashDir: %v", err)
+		}
+		return sum
+	}
+
+	// Pins the format so digests stay comparable across platforms and releases.
+	base := hashDir()
+	if base != "0dbf74cf07734a3967003080e179910ba5b79176d80971057e740f5765b7006d" {
+		t.Fatalf("HashDir = %s", base)
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "a.txt"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	if got := hashDir(); got != base {
+		t.Fatal("mtime changed the digest")
+	}
+
+	// The exec bit only counts with WithExecBit, so by default the digest
+	// of a tree with executables is the same on Windows and Unix.
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(filepath.Join(root, "a.txt"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if got := hashDir(); got != base {
+			t.Fatal("exec bit changed the default digest")
+		}
+		withExec, err := HashDir(root, sha256.New, WithExecBit())
+		if err != nil || withExec != "66c1b40c38a54e4a5933826f926abb17049c5c9d8cb102648512b5eb35052ae7" {
+			t.Fatalf("HashDir WithExecBit = %s, %v", withExec, err)
+		}
+		if err := os.Chmod(filepath.Join(root, "a.txt"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type change struct {
+		name string
+		fn   func() error
+	}
+	changes := []change{
+		{"content", func() error { return os.WriteFile(filepath.Join(root, "a.txt"), []byte("A"), 0o644) }},
+		{"rename", func() error { return os.Rename(filepath.Join(root, "sub"), filepath.Join(root, "sub2")) }},
+		{"empty dir", func() error { return os.Mkdir(filepath.Join(root, "empty"), 0o755) }},
+	}
+	if runtime.GOOS != "windows" {
+		link := filepath.Join(root, "link")
+		changes = append(changes,
+			change{"symlink", func() error { return os.Symlink("missing", link) }},
+			change{"symlink target", func() error {
+				_ = os.Remove(link)
+				return os.Symlink("a.txt", link)
+			}},
+		)
+	}
+	seen := map[string]string{base: "base"}
+	for _, c := range changes {
+		if err := c.fn(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		got := hashDir()
+		if prev, ok := seen[got]; ok {
+			t.Fatalf("%s: digest same as after %s", c.name, prev)
+		}
+		seen[got] = c.name
+	}
+
+	if _, err := HashDir(filepath.Join(root, "a.txt"), sha256.New); err == nil {
+		t.Fatal("file root: want error")
+	}
+	if _, err := HashDir(root, nil); !errors.Is(err, ErrNilHash) {
+		t.Fatalf("nil hash: %v", err)
+	}
+}
+
+func TestChecksumSource(t *testing.T) {
+	ctx, _ := newTestSession(t, Memory)
+
+	src := ChecksumSource(BytesSource([]byte("abc")), sha256.New())
+	if _, err := src.Sum(); !errors.Is(err, ErrSumIncomplete) {
+		t.Fatalf("Sum before Copy: %v", err)
+	}
+	out, err := Copy(ctx, src, Out(Txt))
+	if err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if b, _ := out.Bytes(); string(b) != "abc" {
+		t.Fatalf("Copy bytes = %q", string(b))
+	}
+	want := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	sum, err := src.Sum()
+	if got := hex.EncodeToString(sum); err != nil || got != want {
+		t.Fatalf("Sum = %s, %v, want %s", got, err, want)
+	}
+	if got := hex.EncodeToString(out.Sum()); got != want {
+		t.Fatalf("Output.Sum = %s, want %s", got, want)
+	}
+	tee, err := CopyTee(ctx, ChecksumSource(ReaderSource(strings.NewReader("abc")), sha256.New()), Out(Txt), Out(Txt, File))
+	if err != nil {
+		t.Fatalf("CopyTee: %v", err)
+	}
+	for i, o := range tee {
+		if got := hex.EncodeToString(o.Sum()); got != want {
+			t.Fatalf("CopyTee output %d Sum = %s", i, got)
+		}
+	}
+	if plain, _ := Copy(ctx, BytesSource([]byte("abc")), Out(Txt)); plain.Sum() != nil {
+		t.Fatalf("Sum without ChecksumSource = %x", plain.Sum())
+	}
+
+	// A second read starts over rather than hashing "abcabc".
+	if _, err := Copy(ctx, src, Out(Txt)); err != nil {
+		t.Fatalf("second Copy: %v", err)
+	}
+	if sum, _ := src.Sum(); hex.EncodeToString(sum) != want {
+		t.Fatalf("Sum after second Copy = %x", sum)
+	}
+
+	// A read that stops early or fails leaves no digest.
+	if err := Read(ctx, src, func(r io.Reader) error {
+		_, err := r.Read(make([]byte, 1))
+		return err
+	}); err != nil {
+		t.Fatalf("partial Read: %v", err)
+	}
+	if _, err := src.Sum(); !errors.Is(err, ErrSumIncomplete) {
+		t.Fatalf("Sum after partial read: %v", err)
+	}
+	boom := errors.New("boom")
+	failing := ChecksumSource(ReaderSource(io.MultiReader(strings.NewReader("ab"), iotest.ErrReader(boom))), sha256.New())
+	if _, err := Copy(ctx, failing, Out(Txt)); !errors.Is(err, boom) {
+		t.Fatalf("failing Copy: %v", err)
+	}
+	if _, err := failing.Sum(); !errors.Is(err, ErrSumIncomplete) {
+		t.Fatalf("Sum after failed Copy: %v", err)
+	}
+	if got := SizeFromStream(src); got != 3 {
+		t.Fatalf("SizeFromStream = %d", got)
+	}
+}
+
+func TestDetectMIME(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		return p
+	}
+
+	png := write("image.bin", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"))
+	if got, err := DetectMIME(png); err != nil || got != "image/png" {
+		t.Fatalf("DetectMIME png = %q, %v", got, err)
+	}
+
+	// generic sniff falls back to the extension
+	generic := write("doc.json", []byte{0x00, 0x01, 0x02})
+	info, err := DetectMIMEInfo(generic)
+	if err != nil {
+		t.Fatalf("DetectMIMEInfo: %v", err)
+	}
+	if info.Sniffed != "application/octet-stream" || info.ByExtension != "application/json" {
+		t.Fatalf("info = %+v", info)
+	}
+	if info.Type() != "application/json" {
+		t.Fatalf("Type = %q", info.Type())
+	}
+
+	empty := write("empty", nil)
+	if got, err := DetectMIME(empty); err != nil || got != "application/octet-stream" {
+		t.Fatalf("DetectMIME empty = %q, %v", got, err)
+	}
+
+	if _, err := DetectMIME(""); !errors.Is(err, ErrEmptyPath) {
+		t.Fatalf("expected ErrEmptyPath, got %v", err)
+	}
+}
+
+func TestChmodRecursive(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix permissions")
+	}
+	root := t.TempDir()
+	sub := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	file := filepath.Join(sub, "f.txt")
+	if err := os.WriteFile(file, []byte("x"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := Chmod(file, 0o600); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if err := ChmodRecursive(root, 0o750, 0o640, nil); err != nil {
+		t.Fatalf("ChmodRecursive: %v", err)
+	}
+	for path, want := range map[string]os.FileMode{root: 0o750, sub: 0o750, file: 0o640} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if got := fi.Mode().Perm(); got != want {
+			t.Fatalf("%s mode = %o, want %o", path, got, want)
+		}
+	}
+
+	if err := ChownRecursive(root, os.Getuid(), os.Getgid(), nil); err != nil {
+		t.Fatalf("ChownRecursive: %v", err)
+	}
+	if err := Chown(file, -1, -1); err != nil {
+		t.Fatalf("Chown: %v", err)
+	}
+
+	var visited []string
+	err := ChmodRecursive(filepath.Join(root, "missing"), 0o755, 0o644, func(path string, err error) error {
+		visited = append(visited, path)
+		return nil
+	})
+	if err != nil || len(visited) != 1 {
+		t.Fatalf("handler: err=%v visited=%v", err, visited)
+	}
+	if err := ChmodRecursive(filepath.Join(root, "missing"), 0o755, 0o644, nil); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestSameFile(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "b.txt")
+	if err := os.WriteFile(a, []byte("x"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.WriteFile(b, []byte("x"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if same, err := SameFile(a, filepath.Join(dir, ".", "a.txt")); err != nil || !same {
+		t.Fatalf("SameFile self = %v, %v", same, err)
+	}
+	if same, err := SameFile(a, b); err != nil || same {
+		t.Fatalf("SameFile distinct = %v, %v", same, err)
+	}
+	link := filepath.Join(dir, "hard.txt")
+	if err := os.Link(a, link); err == nil {
+		if same, err := SameFile(a, link); err != nil || !same {
+			t.Fatalf("SameFile hardlink = %v, %v", same, err)
+		}
+	}
+	if same, err := SameFile(a, filepath.Join(dir, "missing")); err != nil || same {
+		t.Fatalf("SameFile missing = %v, %v", same, err)
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "sub")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "a"), make([]byte, 100), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(sub, "b"), make([]byte, 50), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if got, err := DirSize(root); err != nil || got != 150 {
+		t.Fatalf("DirSize = %d, %v", got, err)
+	}
+
+	if runtime.GOOS != "windows" {
+		if err := os.Symlink(filepath.Join(root, "a"), filepath.Join(sub, "link")); err != nil {
+			t.Fatalf("Symlink: %v", err)
+		}
+		if err := os.Symlink(root, filepath.Join(sub, "loop")); err != nil {
+			t.Fatalf("Symlink: %v", err)
+		}
+		if got, err := DirSize(root); err != nil || got != 150 {
+			t.Fatalf("DirSize no-follow = %d, %v", got, err)
+		}
+		if got, err := DirSize(root, WithFollowSymlinks()); err != nil || got != 250 {
+			t.Fatalf("DirSize follow = %d, %v", got, err)
+		}
+	}
+
+	sparse := filepath.Join(t.TempDir(), "sparse")
+	f, err := os.Create(sparse)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := f.Truncate(64 << 20); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	_ = f.Close()
+	onDisk, err := DirSizeOnDisk(filepath.Dir(sparse))
+	if err != nil {
+		t.Fatalf("DirSizeOnDisk: %v", err)
+	}
+	if runtime.GOOS == "linux" && onDisk >= 64<<20 {
+		t.Fatalf("DirSizeOnDisk = %d, expected sparse file to be smaller", onDisk)
+	}
+
+	if _, err := DirSize(""); !errors.Is(err, ErrEmptyPath) {
+		t.Fatalf("expected ErrEmptyPath, got %v", err)
+	}
+}
+
+func TestIsExecutable(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "run.sh")
+	plain := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.WriteFile(plain, []byte("x"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if runtime.GOOS != "windows" {
+		if ok, err := IsExecutable(script); err != nil || !ok {
+			t.Fatalf("IsExecutable script = %v, %v", ok, err)
+		}
+	}
+	if ok, err := IsExecutable(plain); err != nil || ok {
+		t.Fatalf("IsExecutable plain = %v, %v", ok, err)
+	}
+	if ok, err := IsExecutable(dir); err != nil || ok {
+		t.Fatalf("IsExecutable dir = %v, %v", ok, err)
+	}
+	if ok, err := IsExecutable(filepath.Join(dir, "missing")); err != nil || ok {
+		t.Fatalf("IsExecutable missing = %v, %v", ok, err)
+	}
+
+	if !hasExecExt(`C:\tools\app.EXE`, "") || hasExecExt("app.sh", "") {
+		t.Fatalf("hasExecExt default PATHEXT mismatch")
+	}
+	if !hasExecExt("build.PS1", ".COM;.EXE;.PS1") {
+		t.Fatalf("hasExecExt custom PATHEXT mismatch")
+	}
+}
+
+func TestCopyProgress(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.bin")
+	data := bytes.Repeat([]byte("0123456789abcdef"), (3<<20)/16+7)
+	if err := os.WriteFile(src, data, 0o640); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	type call struct{ copied, total int64 }
+	var calls []call
+	dst := filepath.Join(dir, "nested", "dst.bin")
+	n, err := CopyProgress(dst, src, func(copied, total int64) {
+		calls = append(calls, call{copied, total})
+	})
+	if err != nil {
+		t.Fatalf("CopyProgress: %v", err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("n = %d, want %d", n, len(data))
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("dst content mismatch: %v", err)
+	}
+	if len(calls) < 3 {
+		t.Fatalf("expected periodic callbacks, got %v", calls)
+	}
+	for i := 1; i < len(calls); i++ {
+		if calls[i].copied <= calls[i-1].copied {
+			t.Fatalf("progress not increasing: %v", calls)
+		}
+	}
+	if last := calls[len(calls)-1]; last.copied != n || last.total != n {
+		t.Fatalf("final callback = %+v", last)
+	}
+	if runtime.GOOS != "windows" {
+		if fi, _ := os.Stat(dst); fi.Mode().Perm() != 0o640 {
+			t.Fatalf("mode = %o", fi.Mode().Perm())
+		}
+	}
+
+	// copying onto itself must not truncate
+	if _, err := CopyProgress(src, src, nil); err != nil {
+		t.Fatalf("self copy: %v", err)
+	}
+	if fi, _ := os.Stat(src); fi.Size() != int64(len(data)) {
+		t.Fatalf("self copy truncated source to %d", fi.Size())
+	}
+
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	var final []int64
+	if _, err := CopyProgress(filepath.Join(dir, "empty2"), empty, func(c, total int64) { final = append(final, c, total) }); err != nil {
+		t.Fatalf("CopyProgress empty: %v", err)
+	}
+	if len(final) != 2 || final[0] != 0 || final[1] != 0 {
+		t.Fatalf("empty callbacks = %v", final)
+	}
+}
+
+func TestCopyPreserve(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.txt")
+	if err := os.WriteFile(src, []byte("hello"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	mtime := time.Date(2020, 5, 17, 10, 30, 15, 123456789, time.UTC)
+	atime := time.Date(2021, 1, 2, 3, 4, 5, 987654321, time.UTC)
+	if err := os.Chtimes(src, atime, mtime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	// the destination filesystem may store coarser timestamps than the source
+	near := func(got, want time.Time) bool {
+		d := want.Sub(got)
+		return d >= 0 && d < 2*time.Second
+	}
+
+	dst := filepath.Join(dir, "dst.txt")
+	if _, err := CopyPreserve(dst, src, CopyOptions{PreserveModTime: true, PreserveAccessTime: true}); err != nil {
+		t.Fatalf("CopyPreserve: %v", err)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if !near(fi.ModTime(), mtime) {
+		t.Fatalf("mtime = %v, want %v", fi.ModTime(), mtime)
+	}
+	if got, ok := fileAccessTime(fi); ok && !near(got, atime) {
+		t.Fatalf("atime = %v, want %v", got, atime)
+	}
+
+	plain := filepath.Join(dir, "plain.txt")
+	if _, err := CopyPreserve(plain, src, CopyOptions{}); err != nil {
+		t.Fatalf("CopyPreserve: %v", err)
+	}
+	if fi, _ := os.Stat(plain); near(fi.ModTime(), mtime) {
+		t.Fatalf("mtime preserved without PreserveModTime")
+	}
+}
+
+func TestCopyNoSync(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.txt")
+	if err := os.WriteFile(src, []byte("hello"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	dst := filepath.Join(dir, "scratch", "dst.txt")
+	if _, err := CopyPreserve(dst, src, CopyOptions{NoSync: true}); err != nil {
+		t.Fatalf("CopyPreserve: %v", err)
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "hello" {
+		t.Fatalf("NoSync copy = %q", got)
+	}
+	tree := filepath.Join(dir, "tree")
+	if err := CopyDir(tree, filepath.Join(dir, "scratch"), CopyOptions{NoSync: true}); err != nil {
+		t.Fatalf("CopyDir: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(tree, "dst.txt")); string(got) != "hello" {
+		t.Fatalf("NoSync tree copy = %q", got)
+	}
+}
+
+func TestCopyPreserveOwner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix ownership")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.txt")
+	if err := os.WriteFile(src, []byte("x"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	wantUID, wantGID := os.Getuid(), os.Getgid()
+	if os.Getuid() == 0 {
+		wantUID, wantGID = 1234, 5678
+		if err := os.Chown(src, wantUID, wantGID); err != nil {
+			t.Fatalf("Chown: %v", err)
+		}
+	}
+
+	dst := filepath.Join(dir, "dst.txt")
+	if _, err := CopyPreserve(dst, src, CopyOptions{PreserveOwner: true, StrictOwner: true}); err != nil {
+		t.Fatalf("CopyPreserve: %v", err)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if uid, gid, ok := fileOwner(fi); ok && (uid != wantUID || gid != wantGID) {
+		t.Fatalf("owner = %d:%d, want %d:%d", uid, gid, wantUID, wantGID)
+	}
+}
+
+func TestCopyDirSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on windows")
+	}
+	src := filepath.Join(t.TempDir(), "src")
+	outside := filepath.Join(t.TempDir(), "outside")
+	for _, d := range []string{filepath.Join(src, "sub"), outside} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+	}
+	write := func(path, data string) {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	write(filepath.Join(src, "a.txt"), "a")
+	write(filepath.Join(src, "sub", "b.txt"), "b")
+	write(filepath.Join(outside, "c.txt"), "c")
+
+	links := map[string]string{
+		"file-link": "a.txt",                    // relative, to a file
+		"dir-link":  outside,                    // absolute, to a directory
+		"dangling":  "missing.txt",              // dangling
+		"loop":      filepath.Join("..", "src"), // cycle back to the root
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(src, name)); err != nil {
+			t.Fatalf("Symlink: %v", err)
+		}
+	}
+	readString := func(path string) string {
+		t.Helper()
+		b, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		return string(b)
+	}
+
+	t.Run("skip", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "dst")
+		if err := CopyDir(dst, src, CopyOptions{}); err != nil {
+			t.Fatalf("CopyDir: %v", err)
+		}
+		if readString(filepath.Join(dst, "sub", "b.txt")) != "b" {
+			t.Fatalf("regular file not copied")
+		}
+		for name := range links {
+			if _, err := os.Lstat(filepath.Join(dst, name)); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("%s: expected skipped, got %v", name, err)
+			}
+		}
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "dst")
+		if err := CopyDir(dst, src, CopyOptions{Symlinks: SymlinkCopy}); err != nil {
+			t.Fatalf("CopyDir: %v", err)
+		}
+		for name, target := range links {
+			got, err := os.Readlink(filepath.Join(dst, name))
+			if err != nil || got != target {
+				t.Fatalf("%s: Readlink = %q, %v; want %q", name, got, err, target)
+			}
+		}
+	})
+
+	t.Run("dereference", func(t *testing.T) {
+		if err := os.Remove(filepath.Join(src, "dangling")); err != nil {
+			t.Fatalf("Remove: %v", err)
+		}
+		dst := filepath.Join(t.TempDir(), "dst")
+		if err := CopyDir(dst, src, CopyOptions{Symlinks: SymlinkDereference}); err != nil {
+			t.Fatalf("CopyDir: %v", err)
+		}
+		if fi, err := os.Lstat(filepath.Join(dst, "file-link")); err != nil || !fi.Mode().IsRegular() {
+			t.Fatalf("file-link not dereferenced: %v", err)
+		}
+		if readString(filepath.Join(dst, "dir-link", "c.txt")) != "c" {
+			t.Fatalf("dir-link contents not copied")
+		}
+		if _, err := os.Lstat(filepath.Join(dst, "loop")); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("loop should be visited once, got %v", err)
+		}
+
+		if err := os.Symlink("missing.txt", filepath.Join(src, "dangling")); err != nil {
+			t.Fatalf("Symlink: %v", err)
+		}
+		if err := CopyDir(filepath.Join(t.TempDir(), "dst"), src, CopyOptions{Symlinks: SymlinkDereference}); err == nil {
+			t.Fatalf("expected error for dangling link")
+		}
+	})
+
+	if err := CopyDir(filepath.Join(src, "sub", "inner"), src, CopyOptions{}); err == nil {
+		t.Fatalf("expected error copying into itself")
+	}
+}
+
+func TestCopyDirSymlinkRoot(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on windows")
+	}
+	dir := t.TempDir()
+	target := filepath.Join(dir, "real")
+	if err := os.MkdirAll(filepath.Join(target, "sub"), 0o755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(target, "sub", "f.txt"), []byte("via link"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	for name, copyDir := range map[string]func(dst, src string) error{
+		"CopyDir":         func(dst, src string) error { return CopyDir(dst, src, CopyOptions{}) },
+		"CopyDirParallel": func(dst, src string) error { return CopyDirParallel(dst, src, 2) },
+	} {
+		dst := filepath.Join(dir, "out-"+name)
+		if err := copyDir(dst, link); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got, err := os.ReadFile(filepath.Join(dst, "sub", "f.txt")); err != nil || string(got) != "via link" {
+			t.Fatalf("%s: copied file = %q, %v", name, got, err)
+		}
+	}
+}
+
+func TestCopyDirParallel(t *testing.T) {
+	src := t.TempDir()
+	want := make(map[string]string)
+	for i := 0; i < 120; i++ {
+		rel := filepath.Join("d"+strconv.Itoa(i%7), "f"+strconv.Itoa(i)+".txt")
+		if err := os.MkdirAll(filepath.Join(src, filepath.Dir(rel)), 0o755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(src, rel), []byte(rel), 0o640); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		want[rel] = rel
+	}
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := CopyDirParallel(dst, src, 4); err != nil {
+		t.Fatalf("CopyDirParallel: %v", err)
+	}
+	for rel, data := range want {
+		path := filepath.Join(dst, rel)
+		got, err := os.ReadFile(path)
+		if err != nil || string(got) != data {
+			t.Fatalf("%s = %q, %v", rel, got, err)
+		}
+		if runtime.GOOS != "windows" {
+			if fi, _ := os.Stat(path); fi.Mode().Perm() != 0o640 {
+				t.Fatalf("%s mode = %o", rel, fi.Mode().Perm())
+			}
+		}
+	}
+
+	// a directory where a file should go makes one worker fail
+	bad := filepath.Join(t.TempDir(), "bad")
+	if err := os.MkdirAll(filepath.Join(bad, "d0", "f0.txt"), 0o755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := CopyDirParallel(bad, src, 0); err == nil {
+		t.Fatalf("expected error from conflicting destination")
+	}
+}
+
+func TestCopyDirFilter(t *testing.T) {
+	src := t.TempDir()
+	files := []string{
+		"main.go",
+		"README.md",
+		filepath.Join("node_modules", "pkg", "index.js"),
+		filepath.Join(".git", "HEAD"),
+		filepath.Join("assets", "logo.png"),
+		filepath.Join("assets", "disk.iso"),
+	}
+	for _, rel := range files {
+		path := filepath.Join(src, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(rel), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	var seen []string
+	dst := filepath.Join(t.TempDir(), "dst")
+	filter := GlobFilter(nil, []string{"node_modules", ".git", "*.iso"})
+	err := CopyDir(dst, src, CopyOptions{Filter: func(path string, info os.FileInfo) (bool, bool) {
+		seen = append(seen, filepath.ToSlash(path))
+		return filter(path, info)
+	}})
+	if err != nil {
+		t.Fatalf("CopyDir: %v", err)
+	}
+	exists := func(rel string) bool {
+		_, err := os.Lstat(filepath.Join(dst, rel))
+		return err == nil
+	}
+	for _, rel := range []string{"main.go", "README.md", filepath.Join("assets", "logo.png")} {
+		if !exists(rel) {
+			t.Fatalf("%s missing", rel)
+		}
+	}
+	for _, rel := range []string{"node_modules", ".git", filepath.Join("assets", "disk.iso")} {
+		if exists(rel) {
+			t.Fatalf("%s should be excluded", rel)
+		}
+	}
+	for _, p := range seen {
+		if strings.HasPrefix(p, "node_modules/") {
+			t.Fatalf("filter descended into pruned dir: %s", p)
+		}
+	}
+
+	onlyGo := filepath.Join(t.TempDir(), "go")
+	if err := CopyDir(onlyGo, src, CopyOptions{Filter: GlobFilter([]string{"*.go"}, []string{".git", "node_modules"})}); err != nil {
+		t.Fatalf("CopyDir: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(onlyGo, "main.go")); err != nil {
+		t.Fatalf("main.go missing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(onlyGo, "README.md")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("README.md should not match include, got %v", err)
+	}
+}
+
+func TestCopyReflink(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.bin")
+	data := bytes.Repeat([]byte("reflink"), 10000)
+	if err := os.WriteFile(src, data, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	dst := filepath.Join(dir, "clone.bin")
+	cloned, err := CopyReflink(dst, src)
+	if err != nil {
+		t.Fatalf("CopyReflink: %v", err)
+	}
+	if cloned {
+		if got, err := os.ReadFile(dst); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("clone content mismatch: %v", err)
+		}
+	} else if _, err := os.Stat(dst); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("dst should be untouched when not cloned, got %v", err)
+	}
+
+	// clone-or-copy always yields the content
+	fallback := filepath.Join(dir, "copy.bin")
+	n, err := CopyPreserve(fallback, src, CopyOptions{Reflink: true})
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("CopyPreserve reflink = %d, %v", n, err)
+	}
+	if got, err := os.ReadFile(fallback); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("fallback content mismatch: %v", err)
+	}
+
+	// clone-or-copy finishes mode and times before dst appears
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chmod(src, 0o640); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	if _, err := CopyPreserve(fallback, src, CopyOptions{Reflink: true, PreserveModTime: true}); err != nil {
+		t.Fatalf("CopyPreserve reflink: %v", err)
+	}
+	if fi, _ := os.Stat(fallback); (runtime.GOOS != "windows" && fi.Mode().Perm() != 0o640) || !fi.ModTime().Equal(mtime) {
+		t.Fatalf("reflink copy mode = %v, mtime = %v", fi.Mode().Perm(), fi.ModTime())
+	}
+
+	if _, err := CopyReflink(dst, filepath.Join(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			t.Fatalf("temp file left behind: %s", e.Name())
+		}
+	}
+}
+
+func TestCopyN(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.txt")
+	if err := os.WriteFile(src, []byte("0123456789"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		offset, length int64
+		want           string
+	}{
+		{"prefix", 0, 4, "0123"},
+		{"middle", 3, 4, "3456"},
+		{"to-eof", 6, 0, "6789"},
+		{"length-past-eof", 8, 100, "89"},
+		{"offset-past-eof", 50, 4, ""},
+	}
+	for _, tc := range tests {
+		dst := filepath.Join(dir, "out", tc.name)
+		n, err := CopyN(dst, src, tc.offset, tc.length)
+		if err != nil {
+			t.Fatalf("%s: CopyN: %v", tc.name, err)
+		}
+		got, err := os.ReadFile(dst)
+		if err != nil || string(got) != tc.want || n != int64(len(tc.want)) {
+			t.Fatalf("%s: got %q (n=%d), %v; want %q", tc.name, got, n, err, tc.want)
+		}
+	}
+
+	if _, err := CopyN(filepath.Join(dir, "neg"), src, -1, 0); err == nil {
+		t.Fatalf("expected error for negative offset")
+	}
+	if _, err := CopyN(src, src, 2, 3); err != nil {
+		t.Fatalf("CopyN in place: %v", err)
+	}
+	if got, _ := os.ReadFile(src); string(got) != "234" {
+		t.Fatalf("in-place CopyN = %q", got)
+	}
+}
+
+func TestCopySparse(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "disk.img")
+	const size = 8 << 20
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for off, s := range map[int64]string{0: "boot", 1 << 20: "hello", 3<<20 + 4090: "straddles a block", size - 4: "tail"} {
+		if _, err := f.WriteAt([]byte(s), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := os.ReadFile(src)
+	sparse := func(path string) bool {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, ok := fileBlocks(fi)
+		return ok && n < 1<<20
+	}
+
+	dst := filepath.Join(dir, "copy", "disk.img")
+	n, err := CopySparse(dst, src)
+	if err != nil || n != size {
+		t.Fatalf("CopySparse = %d, %v", n, err)
+	}
+	if got, _ := os.ReadFile(dst); !bytes.Equal(got, want) {
+		t.Fatal("content differs")
+	}
+	if sparse(src) && !sparse(dst) {
+		t.Fatal("holes were filled in")
+	}
+
+	// The zero-detection fallback used where SEEK_HOLE is unavailable.
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	scan := filepath.Join(dir, "scan.img")
+	out, err := os.Create(scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := copyNonZero(out, in, size, make([]byte, 64<<10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	_ = out.Close()
+	if got, _ := os.ReadFile(scan); !bytes.Equal(got, want) {
+		t.Fatal("fallback content differs")
+	}
+	if sparse(src) && !sparse(scan) {
+		t.Fatal("fallback filled in holes")
+	}
+
+	if _, err := CopySparse(dst, dir); err == nil {
+		t.Fatal("directory source: want error")
+	}
+}
+
+func TestMove(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.txt")
+	if err := os.WriteFile(src, []byte("same device"), 0o640); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	dst := filepath.Join(dir, "a", "b", "dst.txt")
+	if err := Move(dst, src); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "same device" {
+		t.Fatalf("dst = %q", got)
+	}
+	if _, err := os.Stat(src); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("src still exists: %v", err)
+	}
+}
+
+func TestMoveCrossDevice(t *testing.T) {
+	orig := rename
+	t.Cleanup(func() { rename = orig })
+	rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errCrossDevice}
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.txt")
+	if err := os.WriteFile(src, []byte("other device"), 0o640); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	mtime := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	dst := filepath.Join(dir, "moved", "dst.txt")
+	if err := Move(dst, src); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Fatalf("mtime = %v, want %v", fi.ModTime(), mtime)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0o640 {
+		t.Fatalf("mode = %o", fi.Mode().Perm())
+	}
+	if got, _ := os.ReadFile(dst); string(got) != "other device" {
+		t.Fatalf("dst = %q", got)
+	}
+	if _, err := os.Stat(src); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("src still exists: %v", err)
+	}
+
+	// other rename errors are returned without copying
+	rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrPermission}
+	}
+	if err := os.WriteFile(src, []byte("x"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	other := filepath.Join(dir, "other.txt")
+	if err := Move(other, src); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected ErrPermission, got %v", err)
+	}
+	if _, err := os.Stat(other); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("dst should not exist: %v", err)
+	}
+}
+
+func TestMoveCrossDeviceKeepsDst(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs /proc/self/mem as a regular file that fails to read")
+	}
+	orig := rename
+	t.Cleanup(func() { rename = orig })
+	rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errCrossDevice}
+	}
+
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst.txt")
+	if err := os.WriteFile(dst, []byte("keep me"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := Move(dst, "/proc/self/mem"); err == nil {
+		t.Fatal("Move: want read error")
+	}
+	if got, err := os.ReadFile(dst); err != nil || string(got) != "keep me" {
+		t.Fatalf("dst after failed move = %q, %v", got, err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("temp file left behind: %d entries", len(entries))
+	}
+}
+
+func TestMoveDirCrossDevice(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and unix sockets")
+	}
+	orig := rename
+	t.Cleanup(func() { rename = orig })
+	rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errCrossDevice}
+	}
+
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0o750); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "f.txt"), []byte("data"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.Symlink(filepath.Join("sub", "f.txt"), filepath.Join(src, "link")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "moved", "dst")
+	if err := MoveDir(dst, src, CopyOptions{PreserveModTime: true}); err != nil {
+		t.Fatalf("MoveDir: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dst, "link")); string(got) != "data" {
+		t.Fatalf("moved link content = %q", got)
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "sub")); err != nil || fi.Mode().Perm() != 0o750 {
+		t.Fatalf("sub mode = %v, %v", fi, err)
+	}
+	if _, err := os.Stat(src); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("src still exists: %v", err)
+	}
+
+	// an entry CopyDir cannot reproduce keeps the source and drops the partial copy
+	src2 := filepath.Join(t.TempDir(), "s")
+	if err := os.MkdirAll(src2, 0o755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	ln, err := net.Listen("unix", filepath.Join(src2, "sock"))
+	if err != nil {
+		t.Skipf("unix socket: %v", err)
+	}
+	defer ln.Close()
+	dst2 := filepath.Join(t.TempDir(), "d")
+	if err := MoveDir(dst2, src2, CopyOptions{}); err == nil {
+		t.Fatalf("expected verification error")
+	}
+	if _, err := os.Stat(src2); err != nil {
+		t.Fatalf("src removed after failed move: %v", err)
+	}
+	if _, err := os.Stat(dst2); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("partial dst left behind: %v", err)
+	}
+}
+
+func TestRemoveMatching(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.tmp", "b.tmp", "keep.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "empty.tmp"), 0o755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	full := filepath.Join(dir, "full.tmp")
+	if err := os.MkdirAll(full, 0o755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(full, "inner"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	n, err := RemoveMatching(filepath.Join(dir, "*.tmp"))
+	if n != 3 || err == nil {
+		t.Fatalf("RemoveMatching = %d, %v; want 3 and an error for the non-empty dir", n, err)
+	}
+	if _, err := os.Stat(full); err != nil {
+		t.Fatalf("non-empty dir removed without WithRemoveAll: %v", err)
+	}
+
+	n, err = RemoveMatching(filepath.Join(dir, "*.tmp"), WithRemoveAll())
+	if n != 1 || err != nil {
+		t.Fatalf("RemoveMatching recursive = %d, %v", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "keep.txt")); err != nil {
+		t.Fatalf("keep.txt removed: %v", err)
+	}
+	if _, err := RemoveMatching(filepath.Join(dir, "[")); !errors.Is(err, filepath.ErrBadPattern) {
+		t.Fatalf("expected ErrBadPattern, got %v", err)
+	}
+}
+
+func TestRemoveEmptyDirs(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	for _, d := range []string{"a/b/c", "a/d", "keep/x"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(d)), 0o755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "keep", "file"), []byte("x"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// a/b/c, a/b, a/d, a (emptied by the walk), keep/x
+	n, err := RemoveEmptyDirs(root)
+	if err != nil || n != 5 {
+		t.Fatalf("RemoveEmptyDirs = %d, %v", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "keep", "file")); err != nil {
+		t.Fatalf("file removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("a should be removed: %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(root, "keep", "file")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if n, err := RemoveEmptyDirs(root); err != nil || n != 1 {
+		t.Fatalf("RemoveEmptyDirs keep = %d, %v", n, err)
+	}
+	if _, err := os.Stat(root); err != nil {
+		t.Fatalf("root removed without WithRemoveRoot: %v", err)
+	}
+	if n, err := RemoveEmptyDirs(root, WithRemoveRoot()); err != nil || n != 1 {
+		t.Fatalf("RemoveEmptyDirs root = %d, %v", n, err)
+	}
+	if _, err := os.Stat(root); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("root should be removed: %v", err)
+	}
+}
+
+func TestShred(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.txt")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("s3cr3t"), 20000), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if runtime.GOOS != "windows" {
+		link := filepath.Join(dir, "link")
+		if err := os.Symlink(path, link); err != nil {
+			t.Fatalf("Symlink: %v", err)
+		}
+		if err := Shred(link, 1); err == nil {
+			t.Fatalf("expected Shred to refuse a symlink")
+		}
+		if fi, err := os.Stat(path); err != nil || fi.Size() != 120000 {
+			t.Fatalf("target touched through symlink: %v", err)
+		}
+	}
+
+	if err := Shred(path, 2); err != nil {
+		t.Fatalf("Shred: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("file still exists: %v", err)
+	}
+	if err := Shred(dir, 1); err == nil {
+		t.Fatalf("expected error for a directory")
+	}
+}
+
+func TestRemoveOlderThan(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	write := func(rel string, aged bool) {
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		if aged {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatalf("Chtimes: %v", err)
+			}
+		}
+	}
+	write("old.log", true)
+	write("old.txt", true)
+	write("new.log", false)
+	write("sub/old.log", true)
+	write("sub/deep/old.log", true)
+	if err := os.MkdirAll(filepath.Join(dir, "already-empty"), 0o755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+
+	n, err := RemoveOlderThan(dir, 24*time.Hour, WithPattern("*.log"))
+	if err != nil || n != 1 {
+		t.Fatalf("RemoveOlderThan top-level = %d, %v", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old.txt")); err != nil {
+		t.Fatalf("pattern not honoured: %v", err)
+	}
+
+	n, err = RemoveOlderThan(dir, 24*time.Hour, WithRecursive(), WithPruneEmpty())
+	if err != nil || n != 3 {
+		t.Fatalf("RemoveOlderThan recursive = %d, %v", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("emptied sub should be pruned: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "already-empty")); err != nil {
+		t.Fatalf("pre-existing empty dir pruned: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new.log")); err != nil {
+		t.Fatalf("new.log removed: %v", err)
+	}
+	if _, err := RemoveOlderThan(dir, time.Hour, WithPattern("[")); !errors.Is(err, filepath.ErrBadPattern) {
+		t.Fatalf("expected ErrBadPattern, got %v", err)
+	}
+}
+
+// newWalkTree builds a small tree shared by the walk tests and returns its root.
+func newWalkTree(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, rel := range []string{
+		"a.txt",
+		"src/main.go",
+		"src/util/util.go",
+		".git/HEAD",
+		".git/objects/ab",
+		"vendor/lib/lib.go",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(rel), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	return root
+}
+
+// relPaths converts walked paths to sorted slash-separated paths relative to root.
+func relPaths(t *testing.T, root string, paths []string) []string {
+	t.Helper()
+	out := make([]string, 0, len(paths))
+	for _, p := range paths {
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			t.Fatalf("Rel: %v", err)
+		}
+		out = append(out, filepath.ToSlash(rel))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestWalkDir(t *testing.T) {
+	root := newWalkTree(t)
+
+	var files []string
+	if err := WalkFiles(root, func(path string, info os.FileInfo) error {
+		files = append(files, path)
+		return nil
+	}); err != nil {
+		t.Fatalf("WalkFiles: %v", err)
+	}
+	if len(files) != 6 {
+		t.Fatalf("WalkFiles visited %v", relPaths(t, root, files))
+	}
+
+	var seen []string
+	err := WalkDir(root, func(path string, d os.DirEntry) error {
+		if d.IsDir() && (d.Name() == ".git" || d.Name() == "vendor") {
+			return filepath.SkipDir
+		}
+		seen = append(seen, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkDir: %v", err)
+	}
+	got := strings.Join(relPaths(t, root, seen), ",")
+	want := ".,a.txt,src,src/main.go,src/util,src/util/util.go"
+	if got != want {
+		t.Fatalf("WalkDir = %s, want %s", got, want)
+	}
+
+	if err := WalkDir(root, nil); !errors.Is(err, ErrNilFunc) {
+		t.Fatalf("expected ErrNilFunc, got %v", err)
+	}
+}
+
+func TestWalkFilesContext(t *testing.T) {
+	root := newWalkTree(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	visited := 0
+	err := WalkFilesContext(ctx, root, func(path string, info os.FileInfo) error {
+		visited++
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if visited != 1 {
+		t.Fatalf("visited %d files after cancel", visited)
+	}
+
+	if err := WalkFilesContext(context.Background(), root, func(string, os.FileInfo) error { return nil }); err != nil {
+		t.Fatalf("WalkFilesContext: %v", err)
+	}
+}
+
+func TestWalkFilesDepth(t *testing.T) {
+	root := newWalkTree(t)
+	collect := func(depth int) string {
+		t.Helper()
+		var paths []string
+		if err := WalkFilesDepth(root, depth, func(path string, info os.FileInfo) error {
+			paths = append(paths, path)
+			return nil
+		}); err != nil {
+			t.Fatalf("WalkFilesDepth(%d): %v", depth, err)
+		}
+		return strings.Join(relPaths(t, root, paths), ",")
+	}
+
+	if got := collect(0); got != "a.txt" {
+		t.Fatalf("depth 0 = %s", got)
+	}
+	if got := collect(1); got != ".git/HEAD,a.txt,src/main.go" {
+		t.Fatalf("depth 1 = %s", got)
+	}
+	if got := collect(-1); strings.Count(got, ",") != 5 {
+		t.Fatalf("unlimited = %s", got)
+	}
+
+	file := filepath.Join(root, "a.txt")
+	var paths []string
+	if err := WalkFilesDepth(file, 0, func(path string, info os.FileInfo) error {
+		paths = append(paths, path)
+		return nil
+	}); err != nil {
+		t.Fatalf("WalkFilesDepth(file): %v", err)
+	}
+	if len(paths) != 1 || paths[0] != file {
+		t.Fatalf("file root = %v, want [%s]", paths, file)
+	}
+}
+
+func TestWalkFilesIgnore(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		".gitignore":     "# build output\n*.log\n!keep.log\nbuild/\n/top.txt\ndocs/**/*.tmp\n",
+		"sub/.gitignore": "!debug.log\n",
+		"a.log":          "",
+		"keep.log":       "",
+		"build/out.bin":  "",
+		"top.txt":        "",
+		"sub/top.txt":    "",
+		"sub/debug.log":  "",
+		"sub/other.log":  "",
+		"docs/z.tmp":     "",
+		"docs/x/y/z.tmp": "",
+		"docs/readme.md": "",
+		".git/HEAD":      "",
+		"main.go":        "",
+		"vendor/v.go":    "",
+	}
+	for rel, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	var paths []string
+	err := WalkFilesIgnore(root, func(path string, info os.FileInfo) error {
+		paths = append(paths, path)
+		return nil
+	}, WithIgnorePatterns("vendor/"))
+	if err != nil {
+		t.Fatalf("WalkFilesIgnore: %v", err)
+	}
+	got := strings.Join(relPaths(t, root, paths), ",")
+	want := ".gitignore,docs/readme.md,keep.log,main.go,sub/.gitignore,sub/debug.log,sub/top.txt"
+	if got != want {
+		t.Fatalf("WalkFilesIgnore =\n %s\nwant\n %s", got, want)
+	}
+}
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pat, name string
+		want      bool
+	}{
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "a/b/c.go", true},
+		{"src/**/*.go", "src/x.go", true},
+		{"src/**/*.go", "src/a/b/x.go", true},
+		{"src/**/*.go", "lib/x.go", false},
+		{"src/**", "src/a/b", true},
+		{"a/*/c", "a/b/c", true},
+		{"a/*/c", "a/b/x/c", false},
+		{"a/?.txt", "a/b.txt", true},
+		{"a/?.txt", "a/bc.txt", false},
+	}
+	for _, tc := range tests {
+		if got := matchSegments(strings.Split(tc.pat, "/"), strings.Split(tc.name, "/")); got != tc.want {
+			t.Errorf("matchSegments(%q, %q) = %v, want %v", tc.pat, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWalkDirs(t *testing.T) {
+	root := newWalkTree(t)
+
+	var dirs []string
+	err := WalkDirs(root, func(path string, info os.FileInfo) error {
+		if !info.IsDir() {
+			t.Fatalf("WalkDirs reported a file: %s", path)
+		}
+		if info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		dirs = append(dirs, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkDirs: %v", err)
+	}
+	if got := strings.Join(relPaths(t, root, dirs), ","); got != ".,src,src/util,vendor,vendor/lib" {
+		t.Fatalf("WalkDirs = %s", got)
+	}
+
+	dirs = nil
+	if err := WalkDirs(root, func(path string, info os.FileInfo) error {
+		dirs = append(dirs, path)
+		return nil
+	}, WithSkipRoot()); err != nil {
+		t.Fatalf("WalkDirs: %v", err)
+	}
+	for _, d := range dirs {
+		if d == root {
+			t.Fatalf("root reported with WithSkipRoot")
+		}
+	}
+}
+
+func TestWalkFilesParallel(t *testing.T) {
+	root := newWalkTree(t)
+
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	err := WalkFilesParallel(root, 3, func(path string, info os.FileInfo) error {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkFilesParallel: %v", err)
+	}
+	if len(paths) != 6 {
+		t.Fatalf("visited %v", relPaths(t, root, paths))
+	}
+
+	boom := errors.New("boom")
+	if err := WalkFilesParallel(root, 0, func(string, os.FileInfo) error { return boom }); !errors.Is(err, boom) {
+		t.Fatalf("expected boom, got %v", err)
+	}
+	if err := WalkFilesParallel(root, 2, func(string, os.FileInfo) error { return filepath.SkipAll }); err != nil {
+		t.Fatalf("SkipAll should stop without error, got %v", err)
+	}
+}
+
+func TestGlobRecursive(t *testing.T) {
+	root := newWalkTree(t)
+	glob := func(pattern string) string {
+		t.Helper()
+		matches, err := GlobRecursive(filepath.Join(root, filepath.FromSlash(pattern)))
+		if err != nil {
+			t.Fatalf("GlobRecursive(%q): %v", pattern, err)
+		}
+		return strings.Join(relPaths(t, root, matches), ",")
+	}
+
+	if got := glob("**/*.go"); got != "src/main.go,src/util/util.go,vendor/lib/lib.go" {
+		t.Fatalf("**/*.go = %s", got)
+	}
+	if got := glob("src/**/*.go"); got != "src/main.go,src/util/util.go" {
+		t.Fatalf("src/**/*.go = %s", got)
+	}
+	if got := glob("*/*.go"); got != "src/main.go" {
+		t.Fatalf("*/*.go = %s", got)
+	}
+	if got := glob(".git/**"); got != ".git/HEAD,.git/objects,.git/objects/ab" {
+		t.Fatalf(".git/** = %s", got)
+	}
+	if got := glob("a.txt"); got != "a.txt" {
+		t.Fatalf("literal = %s", got)
+	}
+	if got := glob("missing/**/*.go"); got != "" {
+		t.Fatalf("missing base = %s", got)
+	}
+	if _, err := GlobRecursive(filepath.Join(root, "[")); !errors.Is(err, filepath.ErrBadPattern) {
+		t.Fatalf("expected ErrBadPattern, got %v", err)
+	}
+}
+
+func TestListDirSorted(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Now().Add(-time.Hour)
+	for i, f := range []struct {
+		name string
+		size int
+	}{{"b", 30}, {"c", 10}, {"a", 20}} {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, make([]byte, f.size), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		mt := base.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(path, mt, mt); err != nil {
+			t.Fatalf("Chtimes: %v", err)
+		}
+	}
+	names := func(entries []os.DirEntry) string {
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.Name())
+		}
+		return strings.Join(out, ",")
+	}
+
+	entries, err := ListDirSortedByName(dir)
+	if err != nil || names(entries) != "a,b,c" {
+		t.Fatalf("by name = %s, %v", names(entries), err)
+	}
+	entries, err = ListDirSorted(dir, SortBySize)
+	if err != nil || names(entries) != "c,a,b" {
+		t.Fatalf("by size = %s, %v", names(entries), err)
+	}
+	entries, err = ListDirSorted(dir, SortByModTime)
+	if err != nil || names(entries) != "b,c,a" {
+		t.Fatalf("by modtime = %s, %v", names(entries), err)
+	}
+	entries, err = ListDirSorted(dir, func(a, b os.DirEntry) bool { return a.Name() > b.Name() })
+	if err != nil || names(entries) != "c,b,a" {
+		t.Fatalf("custom = %s, %v", names(entries), err)
+	}
+}
+
+func TestListDirFiltered(t *testing.T) {
+	root := newWalkTree(t)
+	names := func(entries []os.DirEntry, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.Name())
+		}
+		return strings.Join(out, ",")
+	}
+
+	if got := names(ListFiles(root)); got != "a.txt" {
+		t.Fatalf("ListFiles = %s", got)
+	}
+	if got := names(ListSubdirs(root)); got != ".git,src,vendor" {
+		t.Fatalf("ListSubdirs = %s", got)
+	}
+	got := names(ListDirFiltered(root, func(e os.DirEntry) bool { return !strings.HasPrefix(e.Name(), ".") }))
+	if got != "a.txt,src,vendor" {
+		t.Fatalf("ListDirFiltered = %s", got)
+	}
+}
+
+func TestFindFiles(t *testing.T) {
+	root := newWalkTree(t)
+	find := func(pattern string, opts ...WalkOption) string {
+		t.Helper()
+		found, err := FindFiles(root, pattern, opts...)
+		if err != nil {
+			t.Fatalf("FindFiles(%q): %v", pattern, err)
+		}
+		return strings.Join(relPaths(t, root, found), ",")
+	}
+
+	if got := find("*.go"); got != "src/main.go,src/util/util.go,vendor/lib/lib.go" {
+		t.Fatalf("*.go = %s", got)
+	}
+	if got := find("src/**/*.go", WithMatchPath()); got != "src/main.go,src/util/util.go" {
+		t.Fatalf("path match = %s", got)
+	}
+	if got := find("*l*", WithIncludeDirs()); got != "src/util,src/util/util.go,vendor/lib,vendor/lib/lib.go" {
+		t.Fatalf("include dirs = %s", got)
+	}
+	if _, err := FindFiles(root, "["); !errors.Is(err, filepath.ErrBadPattern) {
+		t.Fatalf("expected ErrBadPattern, got %v", err)
+	}
+}
+
+func TestEmptyDir(t *testing.T) {
+	root := newWalkTree(t)
+	if runtime.GOOS != "windows" {
+		if err := os.Chmod(root, 0o750); err != nil {
+			t.Fatalf("Chmod: %v", err)
+		}
+	}
+	if err := EmptyDir(root); err != nil {
+		t.Fatalf("EmptyDir: %v", err)
+	}
+	fi, err := os.Stat(root)
+	if err != nil || !fi.IsDir() {
+		t.Fatalf("dir removed: %v", err)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0o750 {
+		t.Fatalf("mode = %o, want 750", fi.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Fatalf("dir not empty: %v", entries)
+	}
+
+	missing := filepath.Join(t.TempDir(), "new", "cache")
+	if err := EmptyDir(missing); err != nil {
+		t.Fatalf("EmptyDir missing: %v", err)
+	}
+	if fi, err := os.Stat(missing); err != nil || !fi.IsDir() {
+		t.Fatalf("missing dir not created: %v", err)
+	}
+}
+
+func TestSymlinkForce(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on windows")
+	}
+	dir := t.TempDir()
+	for _, name := range []string{"blue", "green"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+	}
+	current := filepath.Join(dir, "current")
+
+	for _, target := range []string{"blue", "green", "blue"} {
+		if err := SymlinkForce(target, current); err != nil {
+			t.Fatalf("SymlinkForce(%s): %v", target, err)
+		}
+		if got, err := os.Readlink(current); err != nil || got != target {
+			t.Fatalf("Readlink = %q, %v; want %q", got, err, target)
+		}
+	}
+
+	file := filepath.Join(dir, "plain")
+	if err := os.WriteFile(file, []byte("x"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := SymlinkForce("green", file); err != nil {
+		t.Fatalf("SymlinkForce over file: %v", err)
+	}
+	if fi, err := os.Lstat(file); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("regular file not replaced: %v", err)
+	}
+
+	if err := SymlinkForce("green", filepath.Join(dir, "blue")); err == nil {
+		t.Fatalf("expected error replacing a directory")
+	}
+	if entries, _ := filepath.Glob(filepath.Join(dir, ".*.tmp")); len(entries) != 0 {
+		t.Fatalf("temp links left behind: %v", entries)
+	}
+}
+
+func TestEvalSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges on windows")
+	}
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("EvalSymlinks: %v", err)
+	}
+	real := filepath.Join(dir, "real.txt")
+	if err := os.WriteFile(real, []byte("x"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	hop1 := filepath.Join(dir, "hop1")
+	hop2 := filepath.Join(dir, "hop2")
+	if err := os.Symlink("real.txt", hop1); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	if err := os.Symlink(hop1, hop2); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	if got, err := EvalSymlinks(hop2); err != nil || got != real {
+		t.Fatalf("EvalSymlinks = %q, %v; want %q", got, err, real)
+	}
+
+	dangling := filepath.Join(dir, "dangling")
+	if err := os.Symlink("missing", dangling); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	loopA, loopB := filepath.Join(dir, "loopA"), filepath.Join(dir, "loopB")
+	if err := os.Symlink(loopB, loopA); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	if err := os.Symlink(loopA, loopB); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	for path, want := range map[string]bool{hop2: false, real: false, dangling: true, loopA: true} {
+		if got, err := IsSymlinkChainBroken(path); err != nil || got != want {
+			t.Fatalf("IsSymlinkChainBroken(%s) = %v, %v; want %v", filepath.Base(path), got, err, want)
+		}
+	}
+	if _, err := IsSymlinkChainBroken(filepath.Join(dir, "nope")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestExpandHome(t *testing.T) {
+	home := filepath.Join(t.TempDir(), "home")
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	tests := []struct{ in, want string }{
+		{"~", home},
+		{"~/.config/app", home + "/.config/app"},
+		{"a/~/b", "a/~/b"},
+		{"/abs/path", "/abs/path"},
+		{"~no-such-user-fio/x", "~no-such-user-fio/x"},
+	}
+	for _, tc := range tests {
+		got, err := ExpandHome(tc.in)
+		if err != nil || got != tc.want {
+			t.Fatalf("ExpandHome(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+
+	if u, err := user.Current(); err == nil && u.Username != "" && !strings.ContainsAny(u.Username, `\/`) {
+		got, err := ExpandHome("~" + u.Username + "/x")
+		if err != nil || got != strings.TrimSuffix(u.HomeDir, string(filepath.Separator))+"/x" {
+			t.Fatalf("ExpandHome(~%s/x) = %q, %v", u.Username, got, err)
+		}
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	home := filepath.Join(t.TempDir(), "home")
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("FIO_APP", "myapp")
+	t.Setenv("FIO_TILDE", "~/tilde")
+	t.Setenv("FIO_UNSET_VAR", "")
+
+	tests := []struct{ in, want string }{
+		{"~/.config/$FIO_APP/", filepath.Join(home, ".config", "myapp")},
+		{"${FIO_APP}/./logs/../data", filepath.Join("myapp", "data")},
+		{"$FIO_TILDE/x", filepath.Join(home, "tilde", "x")},
+		{"/opt/$FIO_UNSET_VAR/bin", filepath.FromSlash("/opt/bin")},
+	}
+	for _, tc := range tests {
+		got, err := ExpandPath(tc.in)
+		if err != nil || got != tc.want {
+			t.Fatalf("ExpandPath(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+	if _, err := ExpandPath("$FIO_UNSET_VAR"); !errors.Is(err, ErrEmptyPath) {
+		t.Fatalf("expected ErrEmptyPath, got %v", err)
+	}
+}
+
+func TestChangeExt(t *testing.T) {
+	tests := []struct{ path, ext, want string }{
+		{"report.txt", ".pdf", "report.pdf"},
+		{"report.txt", "pdf", "report.pdf"},
+		{"dir/report.txt", ".pdf", "dir/report.pdf"},
+		{"archive.tar.gz", ".zst", "archive.tar.zst"},
+		{"Makefile", ".bak", "Makefile.bak"},
+		{".bashrc", ".bak", ".bashrc.bak"},
+		{"dir.d/file", "txt", "dir.d/file.txt"},
+		{"report.txt", "", "report"},
+		{"trailing.", ".md", "trailing.md"},
+	}
+	for _, tc := range tests {
+		if got := ChangeExt(tc.path, tc.ext); got != tc.want {
+			t.Errorf("ChangeExt(%q, %q) = %q, want %q", tc.path, tc.ext, got, tc.want)
+		}
+	}
+}
+
+func TestSplitExt(t *testing.T) {
+	tests := []struct{ path, stem, ext string }{
+		{"file.tar.gz", "file", ".tar.gz"},
+		{"dir/backup.TAR.ZST", "dir/backup", ".TAR.ZST"},
+		{"file.tar.bz2", "file", ".tar.bz2"},
+		{"file.gz", "file", ".gz"},
+		{"report.txt", "report", ".txt"},
+		{"Makefile", "Makefile", ""},
+		{".bashrc", ".bashrc", ""},
+		{".tar.gz", ".tar", ".gz"},
+	}
+	for _, tc := range tests {
+		stem, ext := SplitExt(tc.path)
+		if stem != tc.stem || ext != tc.ext {
+			t.Errorf("SplitExt(%q) = (%q, %q), want (%q, %q)", tc.path, stem, ext, tc.stem, tc.ext)
+		}
+	}
+
+	orig := CompoundExts
+	t.Cleanup(func() { CompoundExts = orig })
+	CompoundExts = append(append([]string{}, orig...), ".pkg.tar.zst")
+	if stem, ext := SplitExt("pacman.pkg.tar.zst"); stem != "pacman" || ext != ".pkg.tar.zst" {
+		t.Fatalf("custom compound = (%q, %q)", stem, ext)
+	}
+}
+
+func TestTouchTimes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "stamp")
+
+	before := time.Now().Add(-time.Second)
+	if err := Touch(path); err != nil {
+		t.Fatalf("Touch: %v", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.ModTime().Before(before) {
+		t.Fatalf("Touch mtime = %v, %v", fi, err)
+	}
+
+	fixed := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := TouchTime(path, fixed); err != nil {
+		t.Fatalf("TouchTime: %v", err)
+	}
+	if fi, _ := os.Stat(path); !fi.ModTime().Equal(fixed) {
+		t.Fatalf("TouchTime mtime = %v", fi.ModTime())
+	}
+
+	created := filepath.Join(dir, "new")
+	atime := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := TouchTimes(created, atime, fixed); err != nil {
+		t.Fatalf("TouchTimes: %v", err)
+	}
+	fi, err := os.Stat(created)
+	if err != nil || fi.Size() != 0 || !fi.ModTime().Equal(fixed) {
+		t.Fatalf("TouchTimes created = %v, %v", fi, err)
+	}
+	if got, ok := fileAccessTime(fi); ok && !got.Equal(atime) {
+		t.Fatalf("atime = %v, want %v", got, atime)
+	}
+
+	if runtime.GOOS != "windows" {
+		if err := TouchTime(dir, fixed); err != nil {
+			t.Fatalf("TouchTime dir: %v", err)
+		}
+		if fi, _ := os.Stat(dir); !fi.ModTime().Equal(fixed) {
+			t.Fatalf("dir mtime = %v", fi.ModTime())
+		}
+	}
+}
+
+func TestSetModAccessTime(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f")
+	if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	atime := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	if err := TouchTimes(path, atime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	newM := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+	if err := SetModTime(path, newM); err != nil {
+		t.Fatalf("SetModTime: %v", err)
+	}
+	fi, _ := os.Stat(path)
+	if !fi.ModTime().Equal(newM) {
+		t.Fatalf("mtime = %v, want %v", fi.ModTime(), newM)
+	}
+	if got, ok := fileAccessTime(fi); ok && !got.Equal(atime) {
+		t.Fatalf("SetModTime changed atime to %v", got)
+	}
+
+	newA := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := SetAccessTime(path, newA); err != nil {
+		t.Fatalf("SetAccessTime: %v", err)
+	}
+	fi, _ = os.Stat(path)
+	if !fi.ModTime().Equal(newM) {
+		t.Fatalf("SetAccessTime changed mtime to %v", fi.ModTime())
+	}
+	if got, ok := fileAccessTime(fi); ok && !got.Equal(newA) {
+		t.Fatalf("atime = %v, want %v", got, newA)
+	}
+
+	if runtime.GOOS != "windows" {
+		if err := SetModTime(dir, newM); err != nil {
+			t.Fatalf("SetModTime dir: %v", err)
+		}
+		if fi, _ := os.Stat(dir); !fi.ModTime().Equal(newM) {
+			t.Fatalf("dir mtime = %v", fi.ModTime())
+		}
+	}
+
+	if err := SetModTime(filepath.Join(dir, "missing"), newM); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing: err = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("SetModTime created the file")
+	}
+}
+
 func TestOpenInReusable(t *testing.T) {
 	ctx, _ := newTestSession(t, Memory)
 
-	in, err := OpenIn(ctx, BytesSource([]byte("abc")), Reusable())
+	in, err := OpenIn(ctx, BytesSource([]byte("abc")), Reusable())
+	if err != nil {
+		t.Fatalf("OpenIn: %v", err)
+	}
+	t.Cleanup(func() { _ = in.Close() })
+
+	readOnce := func() string {
+		got, err := ReadResult(ctx, InputSource(in), func(r io.Reader) (*string, error) {
+			b, err := io.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			s := string(b)
+			return &s, nil
+		})
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if got == nil {
+			t.Fatalf("Read: nil result")
+		}
+		return *got
+	}
+	if got := readOnce(); got != "abc" {
+		t.Fatalf("Read once = %q", got)
+	}
+	if got := readOnce(); got != "abc" {
+		t.Fatalf("Read twice = %q", got)
+	}
+}
+
+func TestDownloadReaderCloser(t *testing.T) {
+	called := 0
+	rc, err := NewDownloadReaderCloser(BytesSource([]byte("abc")), func() { called++ })
+	if err != nil {
+		t.Fatalf("NewDownloadReaderCloser: %v", err)
+	}
+	b, err := io.ReadAll(rc)
+	if err != nil || string(b) != "abc" {
+		t.Fatalf("ReadAll = %q, %v", string(b), err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if called != 1 {
+		t.Fatalf("cleanup called %d", called)
+	}
+}
+
+func TestToReaderAtVariants(t *testing.T) {
+	ctx, _ := newTestSession(t, Memory)
+
+	res, err := ToReaderAt(ctx, bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatalf("ToReaderAt: %v", err)
+	}
+	if res.Source() != readerAtSourceDirect {
+		t.Fatalf("source = %s", res.Source())
+	}
+	if res.Size() != 5 {
+		t.Fatalf("size = %d", res.Size())
+	}
+	_ = res.Cleanup()
+
+	res, err = ToReaderAt(ctx, bytes.NewBufferString("abc"), WithMaxMemoryBytes(1))
+	if err != nil {
+		t.Fatalf("ToReaderAt: %v", err)
+	}
+	if res.Source() != readerAtSourceTempFile {
+		t.Fatalf("expected temp file source, got %s", res.Source())
+	}
+	_ = res.Cleanup()
+}
+
+func TestURLSource(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, _ := newTestSession(t, Memory)
+	got, err := ReadResult(ctx, URLSource(srv.URL), func(r io.Reader) (*string, error) {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		s := string(b)
+		return &s, nil
+	})
+	if err != nil || got == nil || *got != "ok" {
+		t.Fatalf("URLSource = %v, %v", got, err)
+	}
+}
+
+func TestReaderSourceSingleUse(t *testing.T) {
+	ctx, _ := newTestSession(t, Memory)
+	read := func(src Source) string {
+		t.Helper()
+		var got []byte
+		if err := Read(ctx, src, func(r io.Reader) error {
+			var err error
+			got, err = io.ReadAll(r)
+			return err
+		}); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		return string(got)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, _ = pw.Write([]byte("streamed"))
+		_ = pw.Close()
+	}()
+	src := ReaderSource(pr)
+	in, err := OpenIn(ctx, src)
+	if err != nil || in.Size != -1 {
+		t.Fatalf("OpenIn pipe: size = %d, %v", in.Size, err)
+	}
+	if got := read(src); got != "streamed" {
+		t.Fatalf("first read = %q", got)
+	}
+	if got := read(src); got != "" {
+		t.Fatalf("second read = %q, want empty", got)
+	}
+
+	cc := &closeCounter{Reader: strings.NewReader("owned")}
+	if got := read(ReadCloserSource(cc)); got != "owned" || cc.closes != 1 {
+		t.Fatalf("ReadCloserSource = %q, closes = %d", got, cc.closes)
+	}
+}
+
+func TestBase64Source(t *testing.T) {
+	ctx, _ := newTestSession(t, Memory)
+	read := func(src Source) (string, error) {
+		var got []byte
+		err := Read(ctx, src, func(r io.Reader) error {
+			var err error
+			got, err = io.ReadAll(r)
+			return err
+		})
+		return string(got), err
+	}
+
+	data := "hello, base64 \x00\xff"
+	src := Base64Source(base64.StdEncoding.EncodeToString([]byte(data)), nil)
+	for i := 0; i < 2; i++ {
+		if got, err := read(src); err != nil || got != data {
+			t.Fatalf("read %d = %q, %v", i, got, err)
+		}
+	}
+
+	url := Base64Source(base64.RawURLEncoding.EncodeToString([]byte{0xfb, 0xff}), base64.RawURLEncoding)
+	if got, err := read(url); err != nil || got != "\xfb\xff" {
+		t.Fatalf("RawURLEncoding = %q, %v", got, err)
+	}
+
+	var corrupt base64.CorruptInputError
+	if _, err := read(Base64Source("aGVsbG8!!!", nil)); !errors.As(err, &corrupt) {
+		t.Fatalf("corrupt input: err = %v", err)
+	}
+}
+
+func TestURLSourceWith(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		_, _ = io.WriteString(w, r.Method+" "+strings.Join(r.Header.Values("X-Tag"), ",")+" "+string(body))
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, _ := newTestSession(t, Memory)
+	read := func(src Source) (string, error) {
+		var got []byte
+		err := Read(ctx, src, func(r io.Reader) error {
+			var err error
+			got, err = io.ReadAll(r)
+			return err
+		})
+		return string(got), err
+	}
+
+	src := URLSourceWith(srv.URL,
+		WithHeader("Authorization", "Bearer secret"),
+		WithHeader("X-Tag", "a"),
+		WithHeader("X-Tag", "b"),
+		WithMethod(http.MethodPost),
+		WithBody([]byte("payload")),
+	)
+	for i := 0; i < 2; i++ {
+		if got, err := read(src); err != nil || got != "POST a,b payload" {
+			t.Fatalf("read %d = %q, %v", i, got, err)
+		}
+	}
+	if got, err := read(URLSourceWith(srv.URL, WithHeader("Authorization", "Bearer secret"))); err != nil || got != "GET  " {
+		t.Fatalf("default GET = %q, %v", got, err)
+	}
+	if _, err := read(URLSourceWith(srv.URL)); !errors.Is(err, ErrDownloadFailed) {
+		t.Fatalf("missing auth: err = %v", err)
+	}
+	if _, err := read(URLSourceWith(" ")); !errors.Is(err, ErrEmptyURL) {
+		t.Fatalf("empty url: err = %v", err)
+	}
+}
+
+func TestResumableURLSource(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	var gotRange string
+	var ignoreRange bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRange = r.Header.Get("Range")
+		switch {
+		case r.URL.Path == "/short":
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 10-%d/%d", len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(content[10:20])
+		case r.URL.Path == "/skew":
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(content)
+		case ignoreRange:
+			_, _ = w.Write(content)
+		default:
+			http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(content))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, _ := newTestSession(t, Memory)
+	read := func(src Source) ([]byte, error) {
+		var got []byte
+		err := Read(ctx, src, func(r io.Reader) error {
+			var err error
+			got, err = io.ReadAll(r)
+			return err
+		})
+		return got, err
+	}
+	dir := t.TempDir()
+	part := filepath.Join(dir, "nested", "blob.part")
+
+	// Fresh download.
+	if got, err := read(ResumableURLSource(srv.URL, part)); err != nil || !bytes.Equal(got, content) || gotRange != "" {
+		t.Fatalf("fresh = %d bytes, %v, Range %q", len(got), err, gotRange)
+	}
+
+	// Resume from a partial file.
+	if err := os.WriteFile(part, content[:100], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := read(ResumableURLSource(srv.URL, part))
+	if err != nil || !bytes.Equal(got, content) || gotRange != "bytes=100-" {
+		t.Fatalf("resume = %d bytes, %v, Range %q", len(got), err, gotRange)
+	}
+	if b, _ := os.ReadFile(part); !bytes.Equal(b, content) {
+		t.Fatalf("part file = %d bytes after resume", len(b))
+	}
+
+	// Already complete: 416 with the full size.
+	if got, err := read(ResumableURLSource(srv.URL, part)); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("complete = %d bytes, %v", len(got), err)
+	}
+
+	// Server ignores ranges: stale prefix is discarded.
+	ignoreRange = true
+	if err := os.WriteFile(part, []byte("stale"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := read(ResumableURLSource(srv.URL, part)); err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("range ignored = %d bytes, %v", len(got), err)
+	}
+	if b, _ := os.ReadFile(part); !bytes.Equal(b, content) {
+		t.Fatalf("part file = %d bytes after full download", len(b))
+	}
+	ignoreRange = false
+
+	// Truncated transfer keeps what arrived.
+	if err := os.WriteFile(part, content[:10], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := read(ResumableURLSource(srv.URL+"/short", part)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("short body: err = %v", err)
+	}
+	if b, _ := os.ReadFile(part); !bytes.Equal(b, content[:20]) {
+		t.Fatalf("part file = %d bytes after short transfer, want 20", len(b))
+	}
+
+	// A range that does not start where the file ends is rejected.
+	if _, err := read(ResumableURLSource(srv.URL+"/skew", part)); !errors.Is(err, ErrDownloadFailed) {
+		t.Fatalf("skewed range: err = %v", err)
+	}
+	if b, _ := os.ReadFile(part); !bytes.Equal(b, content[:20]) {
+		t.Fatal("skewed range changed the part file")
+	}
+}
+
+func TestSaveResumable(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	var gotRange string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRange = r.Header.Get("Range")
+		if r.URL.Path == "/short" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			_, _ = w.Write(content[:30])
+			return
+		}
+		http.ServeContent(w, r, "blob", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "nested", "blob.bin")
+	part := path + ".part"
+
+	// An interrupted transfer keeps its bytes in the part file only.
+	if _, err := SaveResumable(ctx, srv.URL+"/short", path, 0o644); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("short: err = %v", err)
+	}
+	if b, _ := os.ReadFile(part); !bytes.Equal(b, content[:30]) {
+		t.Fatalf("part file = %d bytes, want 30", len(b))
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("path exists before completion: %v", err)
+	}
+
+	// The next call asks for the rest and renames the part into place.
+	n, err := SaveResumable(ctx, srv.URL, path, 0o644)
+	if err != nil || n != int64(len(content)) || gotRange != "bytes=30-" {
+		t.Fatalf("resume = %d, %v, Range %q", n, err, gotRange)
+	}
+	if b, _ := os.ReadFile(path); !bytes.Equal(b, content) {
+		t.Fatalf("saved = %d bytes", len(b))
+	}
+	if _, err := os.Stat(part); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("part file left behind: %v", err)
+	}
+}
+
+func TestFuncSource(t *testing.T) {
+	ctx, _ := newTestSession(t, Memory)
+	cc := &closeCounter{Reader: strings.NewReader("custom")}
+	var opened context.Context
+	src := FuncSource(func(ctx context.Context) (io.ReadCloser, int64, error) {
+		opened = ctx
+		return cc, 6, nil
+	})
+	if err := Read(ctx, src, func(r io.Reader) error {
+		b, err := io.ReadAll(r)
+		if string(b) != "custom" {
+			t.Errorf("read = %q", b)
+		}
+		return err
+	}); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if opened == nil || Session(opened) == nil {
+		t.Fatal("open did not get the read context")
+	}
+	if cc.closes != 1 {
+		t.Fatalf("closes = %d, want 1", cc.closes)
+	}
+
+	boom := errors.New("boom")
+	if err := Read(ctx, FuncSource(func(context.Context) (io.ReadCloser, int64, error) {
+		return nil, -1, boom
+	}), func(io.Reader) error { return nil }); !errors.Is(err, boom) {
+		t.Fatalf("open error: %v", err)
+	}
+	if err := Read(ctx, FuncSource(nil), func(io.Reader) error { return nil }); !errors.Is(err, ErrNilFunc) {
+		t.Fatalf("nil open: %v", err)
+	}
+}
+
+type sizedSource struct {
+	Source
+	n  int64
+	ok bool
+}
+
+func (s sizedSource) Size() (int64, bool) { return s.n, s.ok }
+
+func TestSizer(t *testing.T) {
+	ctx, _ := newTestSession(t, Memory)
+	path := filepath.Join(t.TempDir(), "f.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := PathSource(path).(Sizer).Size(); !ok || n != 5 {
+		t.Fatalf("PathSource Size = %d, %v", n, ok)
+	}
+	if _, ok := PathSource(filepath.Join(t.TempDir(), "missing")).(Sizer).Size(); ok {
+		t.Fatal("missing path: want ok = false")
+	}
+	if got := SizeFromStream(PathSource(path)); got != 5 {
+		t.Fatalf("SizeFromStream(PathSource) = %d", got)
+	}
+
+	stream := FuncSource(func(context.Context) (io.ReadCloser, int64, error) {
+		return io.NopCloser(strings.NewReader("abc")), -1, nil
+	})
+	for _, tc := range []struct {
+		src  Source
+		want int64
+	}{
+		{stream, -1},
+		{sizedSource{Source: stream, n: 3, ok: true}, 3},
+		{sizedSource{Source: BytesSource([]byte("abc"))}, -1},
+	} {
+		if got := SizeFromStream(tc.src); got != tc.want {
+			t.Errorf("SizeFromStream(%T) = %d, want %d", tc.src, got, tc.want)
+		}
+		if _, err := Do(ctx, func(s *Scope) (*int64, error) {
+			r, size, err := s.UseSized(tc.src)
+			if err != nil {
+				return nil, err
+			}
+			if size != tc.want {
+				t.Errorf("UseSized(%T) size = %d, want %d", tc.src, size, tc.want)
+			}
+			_, err = io.Copy(io.Discard, r)
+			return &size, err
+		}); err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	mgr, err := NewIoManager(t.TempDir(), Memory, WithBufferPool(16))
+	if err != nil {
+		t.Fatalf("NewIoManager: %v", err)
+	}
+	t.Cleanup(func() { _ = mgr.Cleanup() })
+	ses, err := mgr.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	t.Cleanup(func() { _ = ses.Cleanup() })
+	ctx := WithSession(context.Background(), ses)
+
+	data := strings.Repeat("0123456789", 100)
+	stream := func() Source { return ReaderSource(struct{ io.Reader }{strings.NewReader(data)}) }
+	for _, st := range []StorageType{Memory, File} {
+		out, err := Copy(ctx, stream(), Out(Txt, st))
+		if err != nil {
+			t.Fatalf("Copy %v: %v", st, err)
+		}
+		if b, _ := out.Bytes(); string(b) != data {
+			t.Fatalf("Copy %v: got %d bytes", st, len(b))
+		}
+	}
+
+	if err := Read(ctx, stream(), func(r io.Reader) error {
+		if _, ok := r.(io.WriterTo); !ok {
+			t.Error("Read reader is not an io.WriterTo")
+		}
+		var sb strings.Builder
+		if _, err := io.Copy(&sb, r); err != nil {
+			return err
+		}
+		if sb.String() != data {
+			t.Errorf("Read got %d bytes", sb.Len())
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+}
+
+type progressLog [][2]int64
+
+func (l *progressLog) fn(copied, total int64) { *l = append(*l, [2]int64{copied, total}) }
+
+func (l progressLog) check(t *testing.T, name string, n, total int64) {
+	t.Helper()
+	if len(l) == 0 {
+		t.Fatalf("%s: no progress reported", name)
+	}
+	for i := 1; i < len(l); i++ {
+		if l[i][0] < l[i-1][0] {
+			t.Fatalf("%s: progress went backwards: %v", name, l)
+		}
+	}
+	if last := l[len(l)-1]; last != [2]int64{n, total} {
+		t.Fatalf("%s: final progress = %v, want [%d %d]", name, last, n, total)
+	}
+}
+
+func TestCopyProgressOption(t *testing.T) {
+	ctx, _ := newTestSession(t, Memory)
+	data := bytes.Repeat([]byte("x"), 3<<20+5)
+	n := int64(len(data))
+
+	var known progressLog
+	if _, err := Copy(ctx, BytesSource(data), Out(Txt, WithProgress(known.fn))); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	known.check(t, "bytes", n, n)
+	if len(known) < 3 {
+		t.Fatalf("bytes: want intermediate callbacks, got %v", known)
+	}
+
+	var unknown progressLog
+	stream := ReaderSource(struct{ io.Reader }{bytes.NewReader(data)})
+	if _, err := Copy(ctx, stream, Out(Txt, File, WithProgress(unknown.fn))); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	unknown.check(t, "stream", n, -1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(data[:100])
+	}))
+	defer srv.Close()
+	var url progressLog
+	if _, err := Copy(ctx, URLSource(srv.URL), Out(Txt, WithProgress(url.fn))); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	url.check(t, "url", 100, 100)
+
+	var empty progressLog
+	if _, err := Copy(ctx, BytesSource([]byte{}), Out(Txt, WithProgress(empty.fn))); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	empty.check(t, "empty", 0, 0)
+}
+
+func TestManagerProgress(t *testing.T) {
+	var log progressLog
+	mgr, err := NewIoManager(t.TempDir(), Memory, WithProgress(log.fn))
 	if err != nil {
-		t.Fatalf("OpenIn: %v", err)
+		t.Fatalf("NewIoManager: %v", err)
 	}
-	t.Cleanup(func() { _ = in.Close() })
+	t.Cleanup(func() { _ = mgr.Cleanup() })
+	ses, err := mgr.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	t.Cleanup(func() { _ = ses.Cleanup() })
+	ctx := WithSession(context.Background(), ses)
 
-	readOnce := func() string {
-		got, err := ReadResult(ctx, InputSource(in), func(r io.Reader) (*string, error) {
-			b, err := io.ReadAll(r)
-			if err != nil {
-				return nil, err
-			}
-			s := string(b)
-			return &s, nil
-		})
+	if err := Read(ctx, BytesSource([]byte("hello")), func(r io.Reader) error {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	log.check(t, "Read", 5, 5)
+
+	log = nil
+	if _, err := Copy(ctx, BytesSource([]byte("abc")), Out(Txt)); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	log.check(t, "Copy", 3, 3)
+
+	var own progressLog
+	log = nil
+	if _, err := Copy(ctx, BytesSource([]byte("abc")), Out(Txt, WithProgress(own.fn))); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	own.check(t, "override", 3, 3)
+	if len(log) != 0 {
+		t.Fatalf("manager default called despite override: %v", log)
+	}
+}
+
+func TestStats(t *testing.T) {
+	mgr, err := NewIoManager(t.TempDir(), Memory, WithSpillThreshold(1000))
+	if err != nil {
+		t.Fatalf("NewIoManager: %v", err)
+	}
+	t.Cleanup(func() { _ = mgr.Cleanup() })
+	newSes := func() (context.Context, IoSession) {
+		ses, err := mgr.NewSession()
 		if err != nil {
-			t.Fatalf("Read: %v", err)
+			t.Fatalf("NewSession: %v", err)
 		}
-		if got == nil {
-			t.Fatalf("Read: nil result")
+		t.Cleanup(func() { _ = ses.Cleanup() })
+		return WithSession(context.Background(), ses), ses
+	}
+	path := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("b"), 2000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctxA, sesA := newSes()
+	first, err := Copy(ctxA, BytesSource(bytes.Repeat([]byte("a"), 100)), Out(Txt))
+	if err != nil {
+		t.Fatalf("Copy bytes: %v", err)
+	}
+	stream := ReaderSource(struct{ io.Reader }{strings.NewReader(strings.Repeat("s", 50))})
+	if _, err := Copy(ctxA, stream, Out(Txt)); err != nil {
+		t.Fatalf("Copy stream: %v", err)
+	}
+	big, err := Copy(ctxA, PathSource(path), Out(Txt))
+	if err != nil {
+		t.Fatalf("Copy path: %v", err)
+	}
+	if big.StorageType() != File {
+		t.Fatalf("2000 bytes with spill threshold 1000 stored in %v", big.StorageType())
+	}
+	if err := Read(ctxA, BytesSource([]byte("0123456789")), func(r io.Reader) error {
+		_, err := io.ReadAll(r)
+		return err
+	}); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	want := Stats{BytesRead: 2150, BytesWritten: 2150, SpilledToDisk: 1, PeakMemory: 150, Operations: 4}
+	if got := sesA.(StatsProvider).Stats(); got != want {
+		t.Fatalf("session A stats = %+v, want %+v", got, want)
+	}
+
+	_ = first.cleanup()
+	ctxB, sesB := newSes()
+	if _, err := Copy(ctxB, BytesSource(bytes.Repeat([]byte("c"), 30)), Out(Txt)); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if got := sesB.(StatsProvider).Stats(); got != (Stats{BytesRead: 30, BytesWritten: 30, PeakMemory: 30, Operations: 1}) {
+		t.Fatalf("session B stats = %+v", got)
+	}
+	want = Stats{BytesRead: 2180, BytesWritten: 2180, SpilledToDisk: 1, PeakMemory: 150, Operations: 5}
+	if got := mgr.(StatsProvider).Stats(); got != want {
+		t.Fatalf("manager stats = %+v, want %+v", got, want)
+	}
+	if got := sesA.(StatsProvider).Stats().PeakMemory; got != 150 {
+		t.Fatalf("peak dropped after cleanup: %d", got)
+	}
+}
+
+func TestSessionReaderTypes(t *testing.T) {
+	mgr, err := NewIoManager(t.TempDir(), Memory, WithBufferPool(0))
+	if err != nil {
+		t.Fatalf("NewIoManager: %v", err)
+	}
+	t.Cleanup(func() { _ = mgr.Cleanup() })
+	ses, err := mgr.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	t.Cleanup(func() { _ = ses.Cleanup() })
+	ctx := WithSession(context.Background(), ses)
+	path := filepath.Join(t.TempDir(), "f.txt")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stats and the buffer pool must not hide what callers assert on.
+	if err := Read(ctx, PathSource(path), func(r io.Reader) error {
+		if _, ok := r.(*os.File); !ok {
+			t.Errorf("PathSource reader is %T, want *os.File", r)
 		}
-		return *got
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
-	if got := readOnce(); got != "abc" {
-		t.Fatalf("Read once = %q", got)
+	if err := Read(ctx, BytesSource([]byte("data")), func(r io.Reader) error {
+		if _, ok := r.(*bytes.Reader); !ok {
+			t.Errorf("BytesSource reader is %T, want *bytes.Reader", r)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
-	if got := readOnce(); got != "abc" {
-		t.Fatalf("Read twice = %q", got)
+	section := io.NewSectionReader(strings.NewReader("data"), 0, 4)
+	rc := struct {
+		*io.SectionReader
+		io.Closer
+	}{section, io.NopCloser(nil)}
+	if err := Read(ctx, ReadCloserSource(rc), func(r io.Reader) error {
+		if _, ok := r.(io.ReaderAt); !ok {
+			t.Errorf("ReaderAt source reader is %T, want an io.ReaderAt", r)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
 }
 
-func TestDownloadReaderCloser(t *testing.T) {
-	called := 0
-	rc, err := NewDownloadReaderCloser(BytesSource([]byte("abc")), func() { called++ })
+func TestCopyTee(t *testing.T) {
+	ctx, ses := newTestSession(t, Memory)
+	dir := ses.(*ioSession).dir
+	data := strings.Repeat("tee ", 5000)
+	once := func() Source { return ReaderSource(struct{ io.Reader }{strings.NewReader(data)}) }
+
+	outputs, err := CopyTee(ctx, once(), Out(Txt, Memory), Out(Txt, File), GzipOut(gzip.BestSpeed, Out(".gz")))
 	if err != nil {
-		t.Fatalf("NewDownloadReaderCloser: %v", err)
+		t.Fatalf("CopyTee: %v", err)
 	}
-	b, err := io.ReadAll(rc)
-	if err != nil || string(b) != "abc" {
-		t.Fatalf("ReadAll = %q, %v", string(b), err)
+	if len(outputs) != 3 || outputs[0].StorageType() != Memory || outputs[1].StorageType() != File {
+		t.Fatalf("outputs = %v", outputs)
 	}
-	if err := rc.Close(); err != nil {
-		t.Fatalf("Close: %v", err)
+	for i, o := range outputs[:2] {
+		if b, _ := o.Bytes(); string(b) != data {
+			t.Fatalf("output %d: %d bytes", i, len(b))
+		}
 	}
-	if called != 1 {
-		t.Fatalf("cleanup called %d", called)
+	zr, err := gzip.NewReader(bytes.NewReader(outputs[2].Data()))
+	if err != nil {
+		t.Fatalf("gzip target: %v", err)
+	}
+	if b, _ := io.ReadAll(zr); string(b) != data {
+		t.Fatalf("gzip target: %d bytes", len(b))
+	}
+
+	first, err := Copy(ctx, once(), Out(Txt, File), Out(Txt, Memory))
+	if err != nil {
+		t.Fatalf("Copy tee: %v", err)
+	}
+	if first.StorageType() != File || first.Size() != int64(len(data)) {
+		t.Fatalf("Copy tee returned %v output of %d bytes", first.StorageType(), first.Size())
+	}
+
+	empty, err := CopyTee(ctx, ReaderSource(strings.NewReader("")), Out(Txt, File), Out(Txt))
+	if err != nil || len(empty) != 2 || empty[0].Size() != 0 || empty[1].Size() != 0 {
+		t.Fatalf("empty source: %v, %v", empty, err)
+	}
+
+	files := func() int {
+		entries, _ := os.ReadDir(dir)
+		return len(entries)
+	}
+	before := files()
+	boom := errors.New("boom")
+	failing := FuncSource(func(context.Context) (io.ReadCloser, int64, error) {
+		return io.NopCloser(io.MultiReader(strings.NewReader(data), iotest.ErrReader(boom))), -1, nil
+	})
+	if _, err := CopyTee(ctx, failing, Out(Txt, File), Out(Txt, File)); !errors.Is(err, boom) {
+		t.Fatalf("read failure: err = %v", err)
+	}
+	if _, err := CopyTee(ctx, once(), Out(Txt, File), EncryptedOut([]byte("bad"), Out(Txt, File))); err == nil {
+		t.Fatal("target failure: want error")
+	}
+	if n := files(); n != before {
+		t.Fatalf("failed tees left %d files behind", n-before)
+	}
+	if _, err := CopyTee(ctx, once()); err == nil {
+		t.Fatal("no outputs: want error")
 	}
 }
 
-func TestToReaderAtVariants(t *testing.T) {
+func TestHashOut(t *testing.T) {
 	ctx, _ := newTestSession(t, Memory)
+	data := bytes.Repeat([]byte("hash me "), 10000)
+	want := sha256.Sum256(data)
 
-	res, err := ToReaderAt(ctx, bytes.NewReader([]byte("hello")))
+	h := sha256.New()
+	stored, err := Copy(ctx, BytesSource(data), Out(Txt, File), HashOut(h))
 	if err != nil {
-		t.Fatalf("ToReaderAt: %v", err)
+		t.Fatalf("Copy: %v", err)
 	}
-	if res.Source() != readerAtSourceDirect {
-		t.Fatalf("source = %s", res.Source())
+	if !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Fatal("tee digest mismatch")
 	}
-	if res.Size() != 5 {
-		t.Fatalf("size = %d", res.Size())
+	if stored.Size() != int64(len(data)) {
+		t.Fatalf("stored %d bytes", stored.Size())
 	}
-	_ = res.Cleanup()
 
-	res, err = ToReaderAt(ctx, bytes.NewBufferString("abc"), WithMaxMemoryBytes(1))
+	h.Reset()
+	out, err := Copy(ctx, BytesSource(data), HashOut(h))
 	if err != nil {
-		t.Fatalf("ToReaderAt: %v", err)
+		t.Fatalf("Copy: %v", err)
 	}
-	if res.Source() != readerAtSourceTempFile {
-		t.Fatalf("expected temp file source, got %s", res.Source())
+	if !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Fatal("digest mismatch")
+	}
+	if out.Size() != 0 {
+		t.Fatalf("HashOut output holds %d bytes", out.Size())
+	}
+
+	h.Reset()
+	if _, err := Process(ctx, BytesSource(data), HashOut(h), func(r io.Reader, w io.Writer) error {
+		_, err := io.Copy(w, io.LimitReader(r, 8))
+		return err
+	}); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if got, want := h.Sum(nil), sha256.Sum256(data[:8]); !bytes.Equal(got, want[:]) {
+		t.Fatal("Process digest is not of the bytes written")
+	}
+
+	if _, err := Copy(ctx, BytesSource(data), HashOut(nil)); !errors.Is(err, ErrNilHash) {
+		t.Fatalf("nil hash: err = %v", err)
 	}
-	_ = res.Cleanup()
 }
 
-func TestURLSource(t *testing.T) {
-	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, _ = w.Write([]byte("ok"))
-	}))
-	t.Cleanup(srv.Close)
+func TestOutputReadBack(t *testing.T) {
+	ctx, _ := newTestSession(t, Memory)
+	data := "slurp and read back"
+	for _, st := range []StorageType{Memory, File} {
+		out, err := Copy(ctx, ReaderSource(strings.NewReader(data)), Out(Txt, st))
+		if err != nil {
+			t.Fatalf("Copy %v: %v", st, err)
+		}
+		if out.Size() != int64(len(data)) {
+			t.Fatalf("%v: Size = %d", st, out.Size())
+		}
+		if path := out.Path(); (path != "") != (st == File) {
+			t.Fatalf("%v: Path = %q", st, path)
+		}
+		for i := 0; i < 2; i++ {
+			r, err := out.OpenReader()
+			if err != nil {
+				t.Fatalf("%v: OpenReader: %v", st, err)
+			}
+			b, _ := io.ReadAll(r)
+			_ = r.Close()
+			if string(b) != data {
+				t.Fatalf("%v: read %d = %q", st, i, b)
+			}
+		}
+		_ = out.cleanup()
+		if _, err := out.OpenReader(); !errors.Is(err, ErrOutputCleaned) {
+			t.Fatalf("%v: OpenReader after cleanup: %v", st, err)
+		}
+		if out.Size() != -1 {
+			t.Fatalf("%v: Size after cleanup = %d", st, out.Size())
+		}
+	}
+}
+
+func TestMmapAdvice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapped.bin")
+	data := bytes.Repeat([]byte("page"), 10000)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, advice := range []MmapAdvice{0, MmapSequential | MmapWillNeed, MmapRandom} {
+		mgr, err := NewIoManager(t.TempDir(), Memory, WithMmap(true), WithMmapAdvice(advice))
+		if err != nil {
+			t.Fatalf("NewIoManager: %v", err)
+		}
+		ses, err := mgr.NewSession()
+		if err != nil {
+			t.Fatalf("NewSession: %v", err)
+		}
+		out, err := Copy(WithSession(context.Background(), ses), PathSource(path), Out(Txt))
+		if err != nil {
+			t.Fatalf("Copy: %v", err)
+		}
+		if !bytes.Equal(out.Data(), data) {
+			t.Fatalf("advice %d: data mismatch", advice)
+		}
+		_ = ses.Cleanup()
+		_ = mgr.Cleanup()
+	}
+}
+
+func TestCopyCancel(t *testing.T) {
+	ctx, ses := newTestSession(t, File)
+	dir := ses.(*ioSession).dir
+	files := func() int {
+		entries, _ := os.ReadDir(dir)
+		return len(entries)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	var read int64
+	endless := FuncSource(func(context.Context) (io.ReadCloser, int64, error) {
+		return io.NopCloser(readerFunc(func(p []byte) (int, error) {
+			if read += int64(len(p)); read > 1<<20 {
+				cancel()
+			}
+			return len(p), nil
+		})), -1, nil
+	})
+	if _, err := Copy(cctx, endless, Out(Txt)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("stream: err = %v", err)
+	}
+	if n := files(); n != 0 {
+		t.Fatalf("cancelled copy left %d files", n)
+	}
+
+	path := filepath.Join(t.TempDir(), "src.txt")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range map[string]Source{"path": PathSource(path), "bytes": BytesSource([]byte("data"))} {
+		if _, err := Copy(cctx, src, Out(Txt)); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: err = %v", name, err)
+		}
+	}
+	if _, err := CopyTee(cctx, BytesSource([]byte("data")), Out(Txt), Out(Txt)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("tee: err = %v", err)
+	}
+	if n := files(); n != 0 {
+		t.Fatalf("cancelled copies left %d files", n)
+	}
 
+	// Copies under a live cancellable context are unaffected.
+	lctx, lcancel := context.WithCancel(ctx)
+	defer lcancel()
+	for name, src := range map[string]Source{"path": PathSource(path), "stream": ReaderSource(strings.NewReader("data"))} {
+		out, err := Copy(lctx, src, Out(Txt))
+		if err != nil || out.Size() != 4 {
+			t.Fatalf("%s: live copy: %v", name, err)
+		}
+	}
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+func TestReadEach(t *testing.T) {
 	ctx, _ := newTestSession(t, Memory)
-	got, err := ReadResult(ctx, URLSource(srv.URL), func(r io.Reader) (*string, error) {
+	sources := make([]Source, 20)
+	for i := range sources {
+		sources[i] = BytesSource([]byte(strconv.Itoa(i)))
+	}
+
+	var (
+		mu             sync.Mutex
+		seen           = make(map[int]string)
+		active, maxAct int
+	)
+	err := ReadEach(ctx, sources, 4, func(i int, r io.Reader) error {
+		mu.Lock()
+		active++
+		maxAct = max(maxAct, active)
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
 		b, err := io.ReadAll(r)
-		if err != nil {
-			return nil, err
+		mu.Lock()
+		active--
+		seen[i] = string(b)
+		mu.Unlock()
+		return err
+	})
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(seen) != len(sources) || maxAct > 4 {
+		t.Fatalf("read %d sources, %d at once", len(seen), maxAct)
+	}
+	for i, got := range seen {
+		if got != strconv.Itoa(i) {
+			t.Fatalf("source %d delivered %q", i, got)
 		}
-		s := string(b)
-		return &s, nil
+	}
+
+	// The first error cancels reads still in flight.
+	started := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	boom := errors.New("boom")
+	err = ReadEach(ctx, []Source{URLSource(srv.URL), BytesSource([]byte("x"))}, 2, func(i int, r io.Reader) error {
+		if i == 1 {
+			<-started
+			return boom
+		}
+		_, err := io.ReadAll(r)
+		return err
 	})
-	if err != nil || got == nil || *got != "ok" {
-		t.Fatalf("URLSource = %v, %v", got, err)
+	if !errors.Is(err, boom) {
+		t.Fatalf("err = %v, want boom", err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := ReadEach(cctx, sources, 2, func(int, io.Reader) error { return nil }); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled: err = %v", err)
+	}
+	if err := ReadEach(ctx, nil, 2, func(int, io.Reader) error {
+		t.Error("fn called for no sources")
+		return nil
+	}); err != nil {
+		t.Fatalf("no sources: err = %v", err)
+	}
+	if err := ReadEach(ctx, nil, 2, nil); !errors.Is(err, ErrNilFunc) {
+		t.Fatalf("nil fn: err = %v", err)
 	}
 }
 
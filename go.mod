@@ -1,3 +1,5 @@
 module github.com/dreamph/fio
 
 go 1.24
+
+require golang.org/x/sys v0.13.0
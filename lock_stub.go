@@ -0,0 +1,16 @@
+//go:build !darwin && !linux && !freebsd && !netbsd && !openbsd && !windows
+
+package fio
+
+import (
+	"errors"
+	"os"
+)
+
+func lockFile(_ *os.File, _, _ bool) error {
+	return errors.ErrUnsupported
+}
+
+func unlockFile(_ *os.File) error {
+	return nil
+}
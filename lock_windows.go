@@ -0,0 +1,52 @@
+//go:build windows
+
+package fio
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// lockFile takes a LockFileEx lock over the whole file.
+// Without block it returns errLockWouldBlock if the lock is held elsewhere.
+func lockFile(f *os.File, exclusive, block bool) error {
+	var flags uint32
+	if exclusive {
+		flags |= lockfileExclusiveLock
+	}
+	if !block {
+		flags |= lockfileFailImmediately
+	}
+	ol := new(syscall.Overlapped)
+	r1, _, e1 := syscall.SyscallN(procLockFileEx.Addr(), f.Fd(), uintptr(flags), 0, ^uintptr(0), ^uintptr(0), uintptr(unsafe.Pointer(ol)))
+	if r1 == 0 {
+		if e1 == errorLockViolation {
+			return errLockWouldBlock
+		}
+		return e1
+	}
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	ol := new(syscall.Overlapped)
+	r1, _, e1 := syscall.SyscallN(procUnlockFileEx.Addr(), f.Fd(), 0, ^uintptr(0), ^uintptr(0), uintptr(unsafe.Pointer(ol)))
+	if r1 == 0 {
+		return e1
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package fio
+
+import "syscall"
+
+// madvise passes each hint in advice to the kernel. Hints are best effort,
+// so errors are ignored.
+func madvise(b []byte, advice MmapAdvice) {
+	for _, h := range []struct {
+		flag   MmapAdvice
+		advice int
+	}{
+		{MmapSequential, syscall.MADV_SEQUENTIAL},
+		{MmapRandom, syscall.MADV_RANDOM},
+		{MmapWillNeed, syscall.MADV_WILLNEED},
+	} {
+		if advice&h.flag != 0 {
+			_ = syscall.Madvise(b, h.advice)
+		}
+	}
+}
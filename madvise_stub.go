@@ -0,0 +1,6 @@
+//go:build !linux
+
+package fio
+
+// madvise is a no-op where the syscall package has no Madvise.
+func madvise(_ []byte, _ MmapAdvice) {}
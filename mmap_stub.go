@@ -4,7 +4,7 @@ package fio
 
 import "os"
 
-func tryMmap(_ *os.File, _ int64) ([]byte, func() error, bool) {
+func tryMmap(_ *os.File, _ int64, _ MmapAdvice) ([]byte, func() error, bool) {
 
 	return nil, nil, false
 }
@@ -7,7 +7,7 @@ import (
 	"syscall"
 )
 
-func tryMmap(f *os.File, size int64) ([]byte, func() error, bool) {
+func tryMmap(f *os.File, size int64, advice MmapAdvice) ([]byte, func() error, bool) {
 	if f == nil || size <= 0 {
 		return nil, nil, false
 	}
@@ -21,6 +21,7 @@ func tryMmap(f *os.File, size int64) ([]byte, func() error, bool) {
 	if err != nil {
 		return nil, nil, false
 	}
+	madvise(data, advice)
 
 	cleanup := func() error { return syscall.Munmap(data) }
 	return data, cleanup, true
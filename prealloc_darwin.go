@@ -0,0 +1,54 @@
+//go:build darwin
+
+package fio
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// fcntl F_PREALLOCATE and its fstore_t flags, from <sys/fcntl.h>.
+const (
+	fPreallocate    = 42
+	fAllocateContig = 0x2
+	fAllocateAll    = 0x4
+	fPeofPosMode    = 3
+)
+
+type fstore struct {
+	flags      uint32
+	posmode    int32
+	offset     int64
+	length     int64
+	bytesalloc int64
+}
+
+// preallocate allocates disk blocks for the first size bytes of f and
+// extends it to size if it is shorter. Existing data is kept. A contiguous
+// allocation is tried first, then any allocation.
+func preallocate(f *os.File, size int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() >= size {
+		return nil
+	}
+	st := fstore{flags: fAllocateContig | fAllocateAll, posmode: fPeofPosMode, length: size - fi.Size()}
+	if err := fcntlPreallocate(f, &st); err != nil {
+		st.flags = fAllocateAll
+		if err := fcntlPreallocate(f, &st); err != nil {
+			return err
+		}
+	}
+	return f.Truncate(size)
+}
+
+func fcntlPreallocate(f *os.File, st *fstore) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), fPreallocate, uintptr(unsafe.Pointer(st)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package fio
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate allocates disk blocks for the first size bytes of f and
+// extends it to size if it is shorter. Existing data is kept.
+func preallocate(f *os.File, size int64) error {
+	for {
+		err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !windows
+
+package fio
+
+import (
+	"errors"
+	"os"
+)
+
+func preallocate(_ *os.File, _ int64) error {
+	return errors.ErrUnsupported
+}
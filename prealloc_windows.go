@@ -0,0 +1,20 @@
+//go:build windows
+
+package fio
+
+import "os"
+
+// preallocate extends f to size if it is shorter. On NTFS, setting the end
+// of a non-sparse file allocates its clusters, so this reserves the space.
+// SetFileValidData is not used: it needs SE_MANAGE_VOLUME_NAME and exposes
+// whatever the clusters held before.
+func preallocate(f *os.File, size int64) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() >= size {
+		return nil
+	}
+	return f.Truncate(size)
+}
@@ -0,0 +1,25 @@
+//go:build darwin
+
+package fio
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneInto replaces the empty file tmp with an APFS clone of src made by
+// clonefile(2), which only creates new paths, and returns the clone open for
+// writing. tmp is closed. Any failure means the filesystem or file pair
+// cannot be cloned.
+func cloneInto(tmp, src *os.File) (*os.File, error) {
+	name := tmp.Name()
+	_ = tmp.Close()
+	if err := os.Remove(name); err != nil {
+		return nil, err
+	}
+	if err := unix.Clonefile(src.Name(), name, 0); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(name, os.O_WRONLY, 0)
+}
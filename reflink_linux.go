@@ -0,0 +1,36 @@
+//go:build linux
+
+package fio
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl, _IOW(0x94, 9, int).
+const ficlone = 0x40049409
+
+// cloneInto makes the empty file tmp share src's extents (Btrfs, XFS,
+// bcachefs, ...) and returns it. Any failure means the filesystem or file
+// pair cannot be cloned.
+func cloneInto(tmp, src *os.File) (*os.File, error) {
+	if err := cloneFile(tmp, src); err != nil {
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// cloneFile makes dst share src's extents with the FICLONE ioctl.
+func cloneFile(dst, src *os.File) error {
+	for {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+		switch errno {
+		case 0:
+			return nil
+		case syscall.EINTR:
+			continue
+		default:
+			return errno
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package fio
+
+import (
+	"errors"
+	"os"
+)
+
+func cloneInto(_, _ *os.File) (*os.File, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,9 @@
+//go:build !darwin && !linux && !freebsd && !netbsd && !openbsd && !windows
+
+package fio
+
+import "errors"
+
+// errCrossDevice never matches a real rename error here, so Move and MoveDir
+// do not fall back to copying.
+var errCrossDevice = errors.New("fio: cross-device rename")
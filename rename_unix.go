@@ -0,0 +1,8 @@
+//go:build darwin || linux || freebsd || netbsd || openbsd
+
+package fio
+
+import "syscall"
+
+// errCrossDevice is what rename reports when src and dst are on different filesystems.
+var errCrossDevice error = syscall.EXDEV
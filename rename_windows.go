@@ -0,0 +1,10 @@
+//go:build windows
+
+package fio
+
+import "syscall"
+
+// errorNotSameDevice is ERROR_NOT_SAME_DEVICE, returned by MoveFileEx across volumes.
+const errorNotSameDevice syscall.Errno = 17
+
+var errCrossDevice error = errorNotSameDevice
@@ -0,0 +1,53 @@
+// Package s3fio streams Amazon S3 objects through fio with S3Source, which
+// takes any client with the GetObject method of *s3.Client. It is a
+// separate module, github.com/dreamph/fio/s3fio, so the AWS SDK is not in
+// the module graph of fio users who do not import it.
+package s3fio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/dreamph/fio"
+)
+
+// ErrEmptyKey is returned when the bucket or key is empty.
+var ErrEmptyKey = errors.New("s3fio: empty bucket or key")
+
+// S3API is the part of *s3.Client that S3Source uses, so tests and wrappers
+// can stand in for it.
+type S3API interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// S3Source streams the object at bucket/key through the fio Source pipeline.
+// GetObject runs with the read's context, so cancelling it aborts the
+// transfer, and the response body is closed when the read is done. The size
+// comes from ContentLength, enabling preallocation.
+func S3Source(client S3API, bucket, key string) fio.Source {
+	return fio.FuncSource(func(ctx context.Context) (io.ReadCloser, int64, error) {
+		if client == nil {
+			return nil, -1, fio.ErrNilSource
+		}
+		if strings.TrimSpace(bucket) == "" || strings.TrimSpace(key) == "" {
+			return nil, -1, ErrEmptyKey
+		}
+		out, err := client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return nil, -1, fmt.Errorf("s3fio: s3://%s/%s: %w", bucket, key, err)
+		}
+		size := int64(-1)
+		if out.ContentLength != nil {
+			size = *out.ContentLength
+		}
+		return out.Body, size, nil
+	})
+}
@@ -0,0 +1,68 @@
+package s3fio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/dreamph/fio"
+)
+
+type fakeS3 struct {
+	objects map[string][]byte
+	ctx     context.Context
+	body    *trackedBody
+}
+
+type trackedBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *trackedBody) Close() error { b.closed = true; return nil }
+
+func (f *fakeS3) GetObject(ctx context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.ctx = ctx
+	data, ok := f.objects[*in.Bucket+"/"+*in.Key]
+	if !ok {
+		return nil, errors.New("NoSuchKey")
+	}
+	f.body = &trackedBody{Reader: bytes.NewReader(data)}
+	return &s3.GetObjectOutput{Body: f.body, ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+type ctxKey struct{}
+
+func TestS3Source(t *testing.T) {
+	client := &fakeS3{objects: map[string][]byte{"artifacts/build.tar": []byte("tarball")}}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "read")
+
+	in, err := fio.OpenIn(ctx, S3Source(client, "artifacts", "build.tar"))
+	if err != nil {
+		t.Fatalf("OpenIn: %v", err)
+	}
+	if in.Size != 7 {
+		t.Fatalf("Size = %d, want 7", in.Size)
+	}
+	if client.ctx.Value(ctxKey{}) != "read" {
+		t.Fatal("GetObject did not get the read context")
+	}
+	b, err := io.ReadAll(in.Reader)
+	if err != nil || string(b) != "tarball" {
+		t.Fatalf("read = %q, %v", b, err)
+	}
+	if err := in.Close(); err != nil || !client.body.closed {
+		t.Fatalf("Close: err = %v, body closed = %v", err, client.body.closed)
+	}
+
+	if _, err := fio.OpenIn(ctx, S3Source(client, "artifacts", "missing")); err == nil {
+		t.Fatal("missing key: want error")
+	}
+	if _, err := fio.OpenIn(ctx, S3Source(client, "", "k")); !errors.Is(err, ErrEmptyKey) {
+		t.Fatalf("empty bucket: err = %v", err)
+	}
+}
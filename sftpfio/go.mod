@@ -0,0 +1,16 @@
+module github.com/dreamph/fio/sftpfio
+
+go 1.24
+
+require (
+	github.com/dreamph/fio v0.0.0-00010101000000-000000000000
+	github.com/pkg/sftp v1.13.10
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+)
+
+replace github.com/dreamph/fio => ../
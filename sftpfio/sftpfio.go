@@ -0,0 +1,90 @@
+// Package sftpfio streams files from an SFTP server (github.com/pkg/sftp)
+// through the fio Source pipeline. It is a separate module, so the SSH and
+// SFTP packages are only required by programs that import it.
+package sftpfio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+
+	"github.com/dreamph/fio"
+	"github.com/pkg/sftp"
+)
+
+// file is the part of *sftp.File that SFTPSource uses.
+type file interface {
+	io.ReadCloser
+	Stat() (fs.FileInfo, error)
+}
+
+// SFTPSource streams the remote file at path through the fio Source pipeline,
+// reporting its size from Stat:
+//
+//	src := sftpfio.SFTPSource(client, "/outbox/report.csv")
+//
+// When the read's context is done, the remote file is closed to abort the
+// transfer and further reads return ctx.Err(). The file is closed when the
+// read is done; the client stays open.
+func SFTPSource(client *sftp.Client, path string) fio.Source {
+	var open func(path string) (file, error)
+	if client != nil {
+		open = func(path string) (file, error) { return client.Open(path) }
+	}
+	return openSource(open, path)
+}
+
+func openSource(open func(path string) (file, error), path string) fio.Source {
+	return fio.FuncSource(func(ctx context.Context) (io.ReadCloser, int64, error) {
+		if open == nil {
+			return nil, -1, fio.ErrNilSource
+		}
+		if strings.TrimSpace(path) == "" {
+			return nil, -1, fio.ErrEmptyPath
+		}
+		f, err := open(path)
+		if err != nil {
+			return nil, -1, fmt.Errorf("sftpfio: %s: %w", path, err)
+		}
+		size := int64(-1)
+		if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+			size = fi.Size()
+		}
+		rf := &remoteFile{ctx: ctx, f: f}
+		rf.stop = context.AfterFunc(ctx, func() { _ = rf.close() })
+		return rf, size, nil
+	})
+}
+
+// remoteFile closes f once, either on Close or when ctx is done.
+type remoteFile struct {
+	ctx  context.Context
+	f    file
+	stop func() bool
+	once sync.Once
+	err  error
+}
+
+func (r *remoteFile) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.f.Read(p)
+	if cerr := r.ctx.Err(); err != nil && cerr != nil {
+		return n, cerr
+	}
+	return n, err
+}
+
+func (r *remoteFile) Close() error {
+	r.stop()
+	return r.close()
+}
+
+func (r *remoteFile) close() error {
+	r.once.Do(func() { r.err = r.f.Close() })
+	return r.err
+}
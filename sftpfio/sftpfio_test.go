@@ -0,0 +1,142 @@
+package sftpfio
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dreamph/fio"
+	"github.com/pkg/sftp"
+)
+
+// localClient serves files from the local disk and counts closes.
+type localClient struct{ closes atomic.Int32 }
+
+type localFile struct {
+	*os.File
+	c *localClient
+}
+
+func (f *localFile) Close() error {
+	f.c.closes.Add(1)
+	return f.File.Close()
+}
+
+func (c *localClient) Open(path string) (file, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &localFile{File: f, c: c}, nil
+}
+
+func TestSFTPSourceClient(t *testing.T) {
+	// An in-memory SFTP server on a pipe, no SSH needed.
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	srv := sftp.NewRequestServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw}, sftp.InMemHandler())
+	go func() { _ = srv.Serve() }()
+	client, err := sftp.NewClientPipe(cr, cw)
+	if err != nil {
+		t.Fatalf("NewClientPipe: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = srv.Close()
+		_ = sw.Close() // unblocks the client's receive loop
+		_ = client.Close()
+	})
+
+	w, err := client.Create("/report.csv")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := w.Write([]byte("a,b\n1,2\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	_ = w.Close()
+
+	in, err := fio.OpenIn(context.Background(), SFTPSource(client, "/report.csv"))
+	if err != nil {
+		t.Fatalf("OpenIn: %v", err)
+	}
+	defer in.Close()
+	if in.Size != 8 {
+		t.Fatalf("Size = %d, want 8", in.Size)
+	}
+	if b, err := io.ReadAll(in.Reader); err != nil || string(b) != "a,b\n1,2\n" {
+		t.Fatalf("read = %q, %v", b, err)
+	}
+	if _, err := fio.OpenIn(context.Background(), SFTPSource(nil, "/report.csv")); !errors.Is(err, fio.ErrNilSource) {
+		t.Fatalf("nil client: err = %v", err)
+	}
+}
+
+func TestSFTPSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.csv")
+	if err := os.WriteFile(path, []byte("a,b\n1,2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := &localClient{}
+
+	in, err := fio.OpenIn(context.Background(), openSource(client.Open, path))
+	if err != nil {
+		t.Fatalf("OpenIn: %v", err)
+	}
+	if in.Size != 8 {
+		t.Fatalf("Size = %d, want 8", in.Size)
+	}
+	b, err := io.ReadAll(in.Reader)
+	if err != nil || string(b) != "a,b\n1,2\n" {
+		t.Fatalf("read = %q, %v", b, err)
+	}
+	if err := in.Close(); err != nil || client.closes.Load() != 1 {
+		t.Fatalf("Close: err = %v, closes = %d", err, client.closes.Load())
+	}
+
+	if _, err := fio.OpenIn(context.Background(), openSource(client.Open, path+".missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("missing file: err = %v", err)
+	}
+}
+
+func TestSFTPSourceCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(path, []byte(strings.Repeat("x", 1<<16)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := &localClient{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	in, err := fio.OpenIn(ctx, openSource(client.Open, path))
+	if err != nil {
+		t.Fatalf("OpenIn: %v", err)
+	}
+	buf := make([]byte, 1024)
+	if _, err := in.Reader.Read(buf); err != nil {
+		t.Fatalf("first read: %v", err)
+	}
+	cancel()
+	if _, err := in.Reader.Read(buf); !errors.Is(err, context.Canceled) {
+		t.Fatalf("read after cancel: err = %v", err)
+	}
+	// The close runs on its own goroutine after cancel.
+	for i := 0; i < 100 && client.closes.Load() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.closes.Load() != 1 {
+		t.Fatalf("cancel did not close the remote file (closes = %d)", client.closes.Load())
+	}
+	_ = in.Close()
+	if client.closes.Load() != 1 {
+		t.Fatalf("file closed %d times", client.closes.Load())
+	}
+}
@@ -0,0 +1,37 @@
+//go:build linux
+
+package fio
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// lseek whence values for hole detection, from <unistd.h>.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// nextDataRegion returns the first data region [start, end) of f at or after
+// off, or io.EOF when only holes remain. Kernels or filesystems without
+// SEEK_DATA report EINVAL, returned as errors.ErrUnsupported.
+func nextDataRegion(f *os.File, off int64) (start, end int64, err error) {
+	start, err = f.Seek(off, seekData)
+	if errors.Is(err, syscall.ENXIO) {
+		return 0, 0, io.EOF
+	}
+	if errors.Is(err, syscall.EINVAL) {
+		return 0, 0, errors.ErrUnsupported
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err = f.Seek(start, seekHole)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package fio
+
+import (
+	"errors"
+	"os"
+)
+
+func nextDataRegion(_ *os.File, _ int64) (start, end int64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
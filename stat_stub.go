@@ -0,0 +1,20 @@
+//go:build !darwin && !linux && !freebsd && !netbsd && !openbsd
+
+package fio
+
+import (
+	"os"
+	"time"
+)
+
+func fileOwner(_ os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+func fileBlocks(_ os.FileInfo) (int64, bool) {
+	return 0, false
+}
+
+func fileAccessTime(_ os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
@@ -0,0 +1,73 @@
+// Package textfio reads and writes files in legacy and UTF-16 encodings,
+// converting to and from UTF-8 with golang.org/x/text. It is a separate
+// module, github.com/dreamph/fio/textfio, since fio itself only handles
+// UTF-8 and byte-order marks.
+package textfio
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dreamph/fio"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// ReadStringEncoding reads the file at path and decodes it from enc to UTF-8,
+// e.g. charmap.ISO8859_1 or unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM).
+//
+// With a nil enc the encoding is picked from the byte-order mark (see
+// fio.DetectBOM): UTF-16 LE or BE is decoded, a UTF-8 mark is stripped, and a
+// file without a mark is returned as is, assumed to be UTF-8.
+func ReadStringEncoding(path string, enc encoding.Encoding) (string, error) {
+	if strings.TrimSpace(path) == "" {
+		return "", fio.ErrEmptyPath
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if enc == nil {
+		enc = detectEncoding(data)
+	}
+	out, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return "", fmt.Errorf("textfio: %s: %w", path, err)
+	}
+	return string(out), nil
+}
+
+// WriteStringEncoding encodes s from UTF-8 to enc and writes it to path,
+// creating parent dirs. A nil enc writes s unchanged as UTF-8. Characters enc
+// cannot represent (e.g. "€" in ISO-8859-1) fail the write, leaving path untouched.
+func WriteStringEncoding(path, s string, enc encoding.Encoding, perm os.FileMode) error {
+	if strings.TrimSpace(path) == "" {
+		return fio.ErrEmptyPath
+	}
+	data := []byte(s)
+	if enc != nil {
+		var err error
+		if data, err = enc.NewEncoder().Bytes(data); err != nil {
+			return fmt.Errorf("textfio: %s: %w", path, err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, perm)
+}
+
+func detectEncoding(data []byte) encoding.Encoding {
+	switch fio.DetectBOM(data) {
+	case fio.BOMUTF16LE:
+		return unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM)
+	case fio.BOMUTF16BE:
+		return unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM)
+	case fio.BOMUTF8:
+		return unicode.UTF8BOM
+	}
+	return encoding.Nop
+}
@@ -0,0 +1,70 @@
+package textfio
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestReadStringEncoding(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	latin1 := write("latin1", []byte{'c', 'a', 'f', 0xE9})
+	if s, err := ReadStringEncoding(latin1, charmap.ISO8859_1); err != nil || s != "café" {
+		t.Fatalf("Latin-1 = %q, %v", s, err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		in   []byte
+	}{
+		{"utf16le", []byte{0xFF, 0xFE, 'c', 0, 'a', 0, 'f', 0, 0xE9, 0}},
+		{"utf16be", []byte{0xFE, 0xFF, 0, 'c', 0, 'a', 0, 'f', 0, 0xE9}},
+		{"utf8bom", []byte("\xEF\xBB\xBFcafé")},
+		{"utf8", []byte("café")},
+	} {
+		if s, err := ReadStringEncoding(write(tc.name, tc.in), nil); err != nil || s != "café" {
+			t.Fatalf("%s auto = %q, %v", tc.name, s, err)
+		}
+	}
+}
+
+func TestWriteStringEncoding(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "nested", "out.txt")
+	if err := WriteStringEncoding(path, "café", charmap.ISO8859_1, 0o644); err != nil {
+		t.Fatalf("WriteStringEncoding: %v", err)
+	}
+	if b, _ := os.ReadFile(path); !bytes.Equal(b, []byte{'c', 'a', 'f', 0xE9}) {
+		t.Fatalf("Latin-1 bytes = %v", b)
+	}
+
+	utf16 := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+	path16 := filepath.Join(dir, "out16.txt")
+	if err := WriteStringEncoding(path16, "hé", utf16, 0o644); err != nil {
+		t.Fatalf("WriteStringEncoding UTF-16: %v", err)
+	}
+	if s, err := ReadStringEncoding(path16, nil); err != nil || s != "hé" {
+		t.Fatalf("UTF-16 round trip = %q, %v", s, err)
+	}
+
+	bad := filepath.Join(dir, "bad.txt")
+	if err := WriteStringEncoding(bad, "5€", charmap.ISO8859_1, 0o644); err == nil {
+		t.Fatal("unrepresentable rune: want error")
+	}
+	if _, err := os.Stat(bad); !os.IsNotExist(err) {
+		t.Fatalf("failed write created file: %v", err)
+	}
+}
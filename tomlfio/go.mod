@@ -0,0 +1,12 @@
+module github.com/dreamph/fio/tomlfio
+
+go 1.24
+
+require (
+	github.com/BurntSushi/toml v1.6.0
+	github.com/dreamph/fio v0.0.0-00010101000000-000000000000
+)
+
+require golang.org/x/sys v0.13.0 // indirect
+
+replace github.com/dreamph/fio => ../
@@ -0,0 +1,53 @@
+// Package tomlfio has ReadTOML and WriteTOML for config files, using
+// github.com/BurntSushi/toml; decode errors carry the line and column. It
+// is a separate module, github.com/dreamph/fio/tomlfio.
+package tomlfio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dreamph/fio"
+)
+
+// ReadTOML decodes the TOML file at path into v.
+// Parse errors are toml.ParseError, which carries the line and column.
+func ReadTOML(path string, v any) error {
+	if strings.TrimSpace(path) == "" {
+		return fio.ErrEmptyPath
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if _, err := toml.Decode(string(data), v); err != nil {
+		var perr toml.ParseError
+		if errors.As(err, &perr) {
+			return fmt.Errorf("tomlfio: %s:%d:%d: %w", path, perr.Position.Line, perr.Position.Col, err)
+		}
+		return fmt.Errorf("tomlfio: %s: %w", path, err)
+	}
+	return nil
+}
+
+// WriteTOML encodes v as TOML and writes it to path, creating parent dirs.
+func WriteTOML(path string, v any, perm os.FileMode) error {
+	if strings.TrimSpace(path) == "" {
+		return fio.ErrEmptyPath
+	}
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), perm)
+}
@@ -0,0 +1,44 @@
+package tomlfio
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+type config struct {
+	Name  string `toml:"name"`
+	Ports []int  `toml:"ports"`
+}
+
+func TestWriteReadTOML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "config.toml")
+
+	if err := WriteTOML(path, config{Name: "svc", Ports: []int{80, 443}}, 0o644); err != nil {
+		t.Fatalf("WriteTOML: %v", err)
+	}
+
+	var out config
+	if err := ReadTOML(path, &out); err != nil {
+		t.Fatalf("ReadTOML: %v", err)
+	}
+	if out.Name != "svc" || len(out.Ports) != 2 || out.Ports[1] != 443 {
+		t.Fatalf("ReadTOML = %+v", out)
+	}
+}
+
+func TestReadTOMLParseError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.toml")
+	if err := os.WriteFile(path, []byte("name = \"svc\"\nports = [1, \n"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	var out config
+	err := ReadTOML(path, &out)
+	var perr toml.ParseError
+	if !errors.As(err, &perr) || perr.Position.Line == 0 {
+		t.Fatalf("expected ParseError with position, got %v", err)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !darwin && !linux && !freebsd && !netbsd && !openbsd
+
+package fio
+
+import "os"
+
+func umask() os.FileMode { return 0 }
@@ -0,0 +1,19 @@
+//go:build darwin || linux || freebsd || netbsd || openbsd
+
+package fio
+
+import (
+	"os"
+	"syscall"
+)
+
+// processUmask is read once at init: syscall.Umask can only read the mask
+// by setting it, so doing it later would race with files created by other
+// goroutines.
+var processUmask = func() os.FileMode {
+	m := syscall.Umask(0)
+	syscall.Umask(m)
+	return os.FileMode(m)
+}()
+
+func umask() os.FileMode { return processUmask }
@@ -0,0 +1,297 @@
+// Package watchfio reports changes to a file or directory tree through
+// Watch, built on fsnotify, with optional recursion and write debouncing.
+// It is a separate module, github.com/dreamph/fio/watchfio, so fsnotify is
+// only required by programs that watch.
+package watchfio
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dreamph/fio"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Kind is the kind of change an Event reports.
+type Kind uint8
+
+const (
+	Create Kind = iota + 1
+	Write
+	Remove
+	Rename
+	Chmod
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Create:
+		return "create"
+	case Write:
+		return "write"
+	case Remove:
+		return "remove"
+	case Rename:
+		return "rename"
+	case Chmod:
+		return "chmod"
+	}
+	return "unknown"
+}
+
+// Event is a single change to Path. Rename is reported for the old name;
+// the new name, if it is inside a watched directory, arrives as Create.
+type Event struct {
+	Path string
+	Kind Kind
+}
+
+// Option configures Watch.
+type Option func(*config)
+
+type config struct {
+	recursive bool
+	debounce  time.Duration
+	onError   func(error)
+}
+
+// WithRecursive watches every directory below a watched directory, including
+// ones created after Watch starts. It has no effect when watching a file.
+func WithRecursive() Option { return func(c *config) { c.recursive = true } }
+
+// WithDebounce coalesces Write events for the same path that arrive less
+// than d apart into one, delivered d after the last of them. Other kinds are
+// delivered at once, after any pending Write for that path.
+func WithDebounce(d time.Duration) Option { return func(c *config) { c.debounce = d } }
+
+// WithErrorHandler receives errors reported by the underlying watcher (such
+// as a dropped-event overflow) and the error that ended the watch, if any.
+// Without it, these errors are discarded.
+func WithErrorHandler(fn func(error)) Option { return func(c *config) { c.onError = fn } }
+
+// Watch calls fn for changes to path, which may be a file or a directory.
+// For a directory, changes to its entries are reported; for a file, only
+// changes to that file, including it being replaced by a rename, as editors
+// do on save. fn runs on a single goroutine, one event at a time.
+//
+// A non-nil error from fn ends the watch. stop ends it from outside and
+// waits until fn is no longer running; it must not be called from fn, and
+// calling it more than once is a no-op.
+func Watch(path string, fn func(ev Event) error, opts ...Option) (stop func(), err error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, fio.ErrEmptyPath
+	}
+	if fn == nil {
+		return nil, fio.ErrNilFunc
+	}
+	var cfg config
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&cfg)
+		}
+	}
+
+	path = filepath.Clean(path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	wt := &watcher{w: w, fn: fn, cfg: cfg, done: make(chan struct{}), exited: make(chan struct{})}
+	if fi.IsDir() {
+		err = wt.addDir(path)
+	} else {
+		// Watch the parent so a file replaced by rename keeps being seen.
+		wt.file = path
+		err = w.Add(filepath.Dir(path))
+	}
+	if err != nil {
+		_ = w.Close()
+		return nil, err
+	}
+
+	go wt.run()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(wt.done)
+			<-wt.exited
+		})
+	}, nil
+}
+
+type watcher struct {
+	w      *fsnotify.Watcher
+	fn     func(Event) error
+	cfg    config
+	file   string // set when watching a single file
+	done   chan struct{}
+	exited chan struct{}
+
+	pending map[string]time.Time // debounced writes: path -> deadline
+	timer   *time.Timer
+}
+
+// addDir watches dir, and with WithRecursive every directory below it.
+func (wt *watcher) addDir(dir string) error {
+	if !wt.cfg.recursive {
+		return wt.w.Add(dir)
+	}
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p != dir && errors.Is(err, fs.ErrNotExist) {
+				return nil // removed while walking
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		return wt.w.Add(p)
+	})
+}
+
+func (wt *watcher) run() {
+	defer close(wt.exited)
+	defer wt.w.Close()
+	defer func() {
+		if wt.timer != nil {
+			wt.timer.Stop()
+		}
+	}()
+
+	for {
+		var timerC <-chan time.Time
+		if wt.timer != nil {
+			timerC = wt.timer.C
+		}
+		select {
+		case <-wt.done:
+			return
+		case ev, ok := <-wt.w.Events:
+			if !ok {
+				return
+			}
+			if err := wt.handle(ev); err != nil {
+				wt.report(err)
+				return
+			}
+		case err, ok := <-wt.w.Errors:
+			if !ok {
+				return
+			}
+			wt.report(err)
+		case <-timerC:
+			wt.timer = nil
+			if err := wt.flushDue(time.Now()); err != nil {
+				wt.report(err)
+				return
+			}
+		}
+	}
+}
+
+func (wt *watcher) report(err error) {
+	if wt.cfg.onError != nil {
+		wt.cfg.onError(err)
+	}
+}
+
+func (wt *watcher) handle(ev fsnotify.Event) error {
+	name := filepath.Clean(ev.Name)
+	if wt.file != "" && name != wt.file {
+		return nil
+	}
+	if wt.cfg.recursive && wt.file == "" && ev.Has(fsnotify.Create) {
+		if fi, err := os.Lstat(name); err == nil && fi.IsDir() {
+			if err := wt.addDir(name); err != nil {
+				wt.report(err)
+			}
+		}
+	}
+
+	for _, k := range kinds(ev.Op) {
+		if k == Write && wt.cfg.debounce > 0 {
+			wt.deferWrite(name)
+			continue
+		}
+		if err := wt.flushPath(name); err != nil {
+			return err
+		}
+		if err := wt.fn(Event{Path: name, Kind: k}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kinds splits op into Kinds, in the order the changes happen.
+func kinds(op fsnotify.Op) []Kind {
+	var ks []Kind
+	for _, m := range []struct {
+		op   fsnotify.Op
+		kind Kind
+	}{
+		{fsnotify.Create, Create},
+		{fsnotify.Write, Write},
+		{fsnotify.Chmod, Chmod},
+		{fsnotify.Rename, Rename},
+		{fsnotify.Remove, Remove},
+	} {
+		if op.Has(m.op) {
+			ks = append(ks, m.kind)
+		}
+	}
+	return ks
+}
+
+func (wt *watcher) deferWrite(name string) {
+	if wt.pending == nil {
+		wt.pending = make(map[string]time.Time)
+	}
+	wt.pending[name] = time.Now().Add(wt.cfg.debounce)
+	if wt.timer == nil {
+		wt.timer = time.NewTimer(wt.cfg.debounce)
+	}
+}
+
+// flushPath delivers a pending Write for name, so it is not reported after
+// a later event for the same path.
+func (wt *watcher) flushPath(name string) error {
+	if _, ok := wt.pending[name]; !ok {
+		return nil
+	}
+	delete(wt.pending, name)
+	return wt.fn(Event{Path: name, Kind: Write})
+}
+
+// flushDue delivers the pending Writes whose deadline has passed and re-arms
+// the timer for the rest.
+func (wt *watcher) flushDue(now time.Time) error {
+	var next time.Time
+	for name, deadline := range wt.pending {
+		if !deadline.After(now) {
+			delete(wt.pending, name)
+			if err := wt.fn(Event{Path: name, Kind: Write}); err != nil {
+				return err
+			}
+			continue
+		}
+		if next.IsZero() || deadline.Before(next) {
+			next = deadline
+		}
+	}
+	if !next.IsZero() {
+		wt.timer = time.NewTimer(next.Sub(now))
+	}
+	return nil
+}
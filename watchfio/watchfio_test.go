@@ -0,0 +1,173 @@
+package watchfio
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func collect(t *testing.T, path string, opts ...Option) (<-chan Event, func()) {
+	t.Helper()
+	ch := make(chan Event, 64)
+	stop, err := Watch(path, func(ev Event) error {
+		ch <- ev
+		return nil
+	}, opts...)
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	t.Cleanup(stop)
+	return ch, stop
+}
+
+func waitFor(t *testing.T, ch <-chan Event, path string, kind Kind) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-ch:
+			if ev.Path == path && ev.Kind == kind {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no %v event for %s", kind, path)
+		}
+	}
+}
+
+func TestWatchDir(t *testing.T) {
+	dir := t.TempDir()
+	ch, _ := collect(t, dir)
+
+	path := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, ch, path, Create)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, ch, path, Remove)
+}
+
+func TestWatchFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ch, _ := collect(t, path)
+
+	// Sibling changes are filtered out.
+	if err := os.WriteFile(filepath.Join(dir, "other"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(`{"a":1}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, ch, path, Write)
+	for len(ch) > 0 {
+		if ev := <-ch; ev.Path != path {
+			t.Fatalf("event for other path: %+v", ev)
+		}
+	}
+
+	// Replaced by rename, as editors do on save.
+	tmp := filepath.Join(dir, "config.json.tmp")
+	if err := os.WriteFile(tmp, []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, ch, path, Create)
+}
+
+func TestWatchRecursive(t *testing.T) {
+	dir := t.TempDir()
+	ch, _ := collect(t, dir, WithRecursive())
+
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, ch, sub, Create)
+	path := filepath.Join(sub, "deep.txt")
+	if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, ch, path, Create)
+}
+
+func TestWatchDebounce(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "f")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ch, stop := collect(t, path, WithDebounce(200*time.Millisecond))
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := f.WriteString("x"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = f.Close()
+
+	waitFor(t, ch, path, Write)
+	time.Sleep(300 * time.Millisecond)
+	stop()
+	for len(ch) > 0 {
+		if ev := <-ch; ev.Kind == Write {
+			t.Fatalf("write burst not coalesced: extra %+v", ev)
+		}
+	}
+}
+
+func TestWatchStopOnError(t *testing.T) {
+	dir := t.TempDir()
+	boom := errors.New("boom")
+	calls := 0
+	errCh := make(chan error, 4)
+	stop, err := Watch(dir, func(Event) error {
+		calls++
+		return boom
+	}, WithErrorHandler(func(err error) { errCh <- err }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	_ = os.WriteFile(filepath.Join(dir, "a"), nil, 0o644)
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, boom) {
+			t.Fatalf("handler got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("fn error not reported")
+	}
+	_ = os.WriteFile(filepath.Join(dir, "b"), nil, 0o644)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	stop()
+	if calls != 1 {
+		t.Fatalf("fn called %d times after error", calls)
+	}
+}
+
+func TestWatchErrors(t *testing.T) {
+	if _, err := Watch(filepath.Join(t.TempDir(), "missing"), func(Event) error { return nil }); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing path: err = %v", err)
+	}
+	if _, err := Watch(t.TempDir(), nil); err == nil {
+		t.Fatal("nil fn: want error")
+	}
+}
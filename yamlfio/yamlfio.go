@@ -0,0 +1,54 @@
+// Package yamlfio has ReadYAML and WriteYAML, the YAML counterparts of
+// fio's JSON file helpers, using gopkg.in/yaml.v3. It is a separate
+// module, github.com/dreamph/fio/yamlfio.
+package yamlfio
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dreamph/fio"
+	"gopkg.in/yaml.v3"
+)
+
+// ReadYAML decodes the YAML file at path into v.
+// Parse errors include the line reported by the decoder.
+func ReadYAML(path string, v any) error {
+	if strings.TrimSpace(path) == "" {
+		return fio.ErrEmptyPath
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("yamlfio: %s: %w", path, err)
+	}
+	return nil
+}
+
+// WriteYAML encodes v as YAML with two-space indentation and writes it to path,
+// creating parent dirs. Map keys are sorted, so output is stable.
+func WriteYAML(path string, v any, perm os.FileMode) error {
+	if strings.TrimSpace(path) == "" {
+		return fio.ErrEmptyPath
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), perm)
+}
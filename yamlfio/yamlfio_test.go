@@ -0,0 +1,48 @@
+package yamlfio
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type config struct {
+	Name  string            `yaml:"name"`
+	Ports []int             `yaml:"ports"`
+	Tags  map[string]string `yaml:"tags"`
+}
+
+func TestWriteReadYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "config.yaml")
+	in := config{Name: "svc", Ports: []int{80, 443}, Tags: map[string]string{"b": "2", "a": "1"}}
+
+	if err := WriteYAML(path, in, 0o644); err != nil {
+		t.Fatalf("WriteYAML: %v", err)
+	}
+	b, _ := os.ReadFile(path)
+	want := "name: svc\nports:\n  - 80\n  - 443\ntags:\n  a: \"1\"\n  b: \"2\"\n"
+	if string(b) != want {
+		t.Fatalf("WriteYAML content = %q, want %q", string(b), want)
+	}
+
+	var out config
+	if err := ReadYAML(path, &out); err != nil {
+		t.Fatalf("ReadYAML: %v", err)
+	}
+	if out.Name != "svc" || len(out.Ports) != 2 || out.Tags["a"] != "1" {
+		t.Fatalf("ReadYAML = %+v", out)
+	}
+}
+
+func TestReadYAMLParseError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.yaml")
+	if err := os.WriteFile(path, []byte("name: svc\nports: [1, 2\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	var out config
+	err := ReadYAML(path, &out)
+	if err == nil || !strings.Contains(err.Error(), "line") {
+		t.Fatalf("expected error with line info, got %v", err)
+	}
+}